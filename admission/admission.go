@@ -0,0 +1,309 @@
+/* Admission control for net/rpc servers
+ *
+ * rpc.Server.Accept starts a goroutine per connection and another per request
+ * without any bound. Server wraps an rpc.Server with three limits:
+ *
+ *   MaxConns            open connections
+ *   MaxInFlightPerConn  requests being served on one connection
+ *   MaxConcurrent       requests being served across all connections
+ *
+ * In Queue mode a request over a limit waits for a slot (at most
+ * QueueTimeout, if set), which pushes back on the client through TCP. In
+ * Reject mode it is answered at once with ErrOverloaded, which the client
+ * sees as an rpc.ServerError (see IsOverloaded). Connections over MaxConns
+ * wait in the listen backlog (Queue) or get every call rejected and are then
+ * closed (Reject).
+ *
+ * Basic usage:
+ *   s := admission.NewServer(admission.Limits{MaxConcurrent: 64, Mode: admission.Reject})
+ *   s.Register(new(Arith))
+ *   go s.Accept(listener)
+ */
+
+package admission
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorpc-tests/codec"
+)
+
+type Mode int
+
+const (
+	Queue Mode = iota
+	Reject
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "queue":
+		return Queue, nil
+	case "reject":
+		return Reject, nil
+	}
+	return 0, fmt.Errorf("unknown admission mode %q (want queue or reject)", s)
+}
+
+func (m Mode) String() string {
+	if m == Reject {
+		return "reject"
+	}
+	return "queue"
+}
+
+// Limits of zero mean unlimited.
+type Limits struct {
+	MaxConns           int
+	MaxInFlightPerConn int
+	MaxConcurrent      int
+	Mode               Mode
+	// in Queue mode, reject a request that waited this long (0 waits forever)
+	QueueTimeout time.Duration
+}
+
+var ErrOverloaded = errors.New("admission: server overloaded")
+
+// IsOverloaded reports whether a client-side call error is a rejection.
+func IsOverloaded(err error) bool {
+	se, ok := err.(rpc.ServerError)
+	return ok && string(se) == ErrOverloaded.Error()
+}
+
+const rejectMethod = "Admission.Reject"
+
+type Empty struct{}
+
+type rejecter struct{}
+
+func (r *rejecter) Reject(args *Empty, reply *Empty) error {
+	return ErrOverloaded
+}
+
+// Stats counts admission decisions since the server started.
+type Stats struct {
+	Conns         int64 // currently open
+	RejectedConns int64
+	Admitted      int64
+	Queued        int64 // admitted after waiting for a slot
+	Rejected      int64
+}
+
+type Server struct {
+	rpc    *rpc.Server
+	limits Limits
+	conns  chan bool
+	global chan bool
+
+	open, rejectedConns, admitted, queued, rejected int64
+}
+
+func NewServer(limits Limits) *Server {
+	s := &Server{rpc: rpc.NewServer(), limits: limits}
+	s.rpc.RegisterName("Admission", new(rejecter))
+	if limits.MaxConns > 0 {
+		s.conns = make(chan bool, limits.MaxConns)
+	}
+	if limits.MaxConcurrent > 0 {
+		s.global = make(chan bool, limits.MaxConcurrent)
+	}
+	return s
+}
+
+func (s *Server) Register(rcvr interface{}) error {
+	return s.rpc.Register(rcvr)
+}
+
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	return s.rpc.RegisterName(name, rcvr)
+}
+
+// Accept serves connections from l until it fails.
+func (s *Server) Accept(l net.Listener) {
+	for {
+		if s.conns != nil && s.limits.Mode == Queue {
+			// leave further connections in the listen backlog
+			s.conns <- true
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			log.Print("admission: accept: ", err)
+			return
+		}
+		go s.serve(codec.NewGobServerCodec(conn), true)
+	}
+}
+
+// ServeConn serves one connection with the gob codec.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	s.ServeCodec(codec.NewGobServerCodec(conn))
+}
+
+// ServeCodec serves one connection, subject to the limits.
+func (s *Server) ServeCodec(c rpc.ServerCodec) {
+	s.serve(c, false)
+}
+
+// haveSlot is set when Accept already waited for a connection slot
+func (s *Server) serve(c rpc.ServerCodec, haveSlot bool) {
+	switch {
+	case s.conns == nil:
+	case s.limits.Mode == Queue:
+		if !haveSlot {
+			s.conns <- true
+		}
+		defer func() { <-s.conns }()
+	default:
+		select {
+		case s.conns <- true:
+			defer func() { <-s.conns }()
+		default:
+			atomic.AddInt64(&s.rejectedConns, 1)
+			s.rpc.ServeCodec(&admitCodec{ServerCodec: c, s: s, rejectAll: true, admitted: make(map[uint64]bool)})
+			return
+		}
+	}
+	atomic.AddInt64(&s.open, 1)
+	defer atomic.AddInt64(&s.open, -1)
+
+	ac := &admitCodec{ServerCodec: c, s: s, admitted: make(map[uint64]bool)}
+	if s.limits.MaxInFlightPerConn > 0 {
+		ac.inFlight = make(chan bool, s.limits.MaxInFlightPerConn)
+	}
+	s.rpc.ServeCodec(ac)
+}
+
+func (s *Server) Stats() Stats {
+	return Stats{
+		Conns:         atomic.LoadInt64(&s.open),
+		RejectedConns: atomic.LoadInt64(&s.rejectedConns),
+		Admitted:      atomic.LoadInt64(&s.admitted),
+		Queued:        atomic.LoadInt64(&s.queued),
+		Rejected:      atomic.LoadInt64(&s.rejected),
+	}
+}
+
+// acquire takes a slot from sem, waiting in Queue mode; waited reports
+// whether the slot was not free immediately.
+func (s *Server) acquire(sem chan bool) (ok, waited bool) {
+	if sem == nil {
+		return true, false
+	}
+	select {
+	case sem <- true:
+		return true, false
+	default:
+	}
+	if s.limits.Mode == Reject {
+		return false, false
+	}
+	if s.limits.QueueTimeout <= 0 {
+		sem <- true
+		return true, true
+	}
+	timer := time.NewTimer(s.limits.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem <- true:
+		return true, true
+	case <-timer.C:
+		return false, true
+	}
+}
+
+func release(sem chan bool) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// admitCodec decides per request whether it is served or redirected to
+// Admission.Reject, and frees its slots when the response goes out.
+type admitCodec struct {
+	rpc.ServerCodec
+	s         *Server
+	inFlight  chan bool
+	rejectAll bool
+
+	mu         sync.Mutex
+	admitted   map[uint64]bool
+	rejecting  bool // the body of the current request is to be discarded
+	sentReject bool
+}
+
+func (c *admitCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	if c.rejectAll || !c.admit() {
+		atomic.AddInt64(&c.s.rejected, 1)
+		r.ServiceMethod = rejectMethod
+		c.rejecting = true
+		return nil
+	}
+	c.mu.Lock()
+	c.admitted[r.Seq] = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *admitCodec) admit() bool {
+	ok, waitedConn := c.s.acquire(c.inFlight)
+	if !ok {
+		return false
+	}
+	ok, waitedGlobal := c.s.acquire(c.s.global)
+	if !ok {
+		release(c.inFlight)
+		return false
+	}
+	atomic.AddInt64(&c.s.admitted, 1)
+	if waitedConn || waitedGlobal {
+		atomic.AddInt64(&c.s.queued, 1)
+	}
+	return true
+}
+
+func (c *admitCodec) ReadRequestBody(body interface{}) error {
+	if c.rejecting {
+		c.rejecting = false
+		return c.ServerCodec.ReadRequestBody(nil)
+	}
+	return c.ServerCodec.ReadRequestBody(body)
+}
+
+func (c *admitCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	if c.admitted[r.Seq] {
+		delete(c.admitted, r.Seq)
+		release(c.inFlight)
+		release(c.s.global)
+	}
+	c.mu.Unlock()
+	err := c.ServerCodec.WriteResponse(r, body)
+	if c.rejectAll && !c.sentReject {
+		// one rejection tells the client why; then the connection goes
+		c.sentReject = true
+		c.ServerCodec.Close()
+	}
+	return err
+}
+
+func (c *admitCodec) Close() error {
+	c.mu.Lock()
+	for seq := range c.admitted {
+		delete(c.admitted, seq)
+		release(c.inFlight)
+		release(c.s.global)
+	}
+	c.mu.Unlock()
+	return c.ServerCodec.Close()
+}
@@ -0,0 +1,158 @@
+package admission
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+type Svc struct {
+	release chan struct{}
+}
+
+func (s *Svc) Echo(args *int, reply *int) error {
+	*reply = *args
+	return nil
+}
+
+// Wait holds its slot until release is closed
+func (s *Svc) Wait(args *int, reply *int) error {
+	<-s.release
+	return nil
+}
+
+// serve starts a Server with limits; closing the returned channel lets its
+// Wait calls return.
+func serve(t *testing.T, limits Limits) (*Server, string, chan struct{}) {
+	s := NewServer(limits)
+	release := make(chan struct{})
+	s.Register(&Svc{release})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Accept(l)
+	return s, l.Addr().String(), release
+}
+
+func dial(t *testing.T, addr string) *rpc.Client {
+	c, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func echo(c *rpc.Client) error {
+	var reply int
+	return c.Call("Svc.Echo", new(int), &reply)
+}
+
+// hold starts n Wait calls on c and waits until the server has them
+func hold(t *testing.T, s *Server, c *rpc.Client, n int) []*rpc.Call {
+	var calls []*rpc.Call
+	for i := 0; i < n; i++ {
+		calls = append(calls, c.Go("Svc.Wait", new(int), new(int), nil))
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.Stats().Admitted < int64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d held calls admitted", s.Stats().Admitted, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return calls
+}
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{Queue, Reject} {
+		if got, err := ParseMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseMode(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := ParseMode("drop"); err == nil {
+		t.Error("ParseMode(drop) accepted")
+	}
+}
+
+// Over MaxConcurrent a request is rejected at once in Reject mode, and
+// served once a slot frees up
+func TestRejectConcurrent(t *testing.T) {
+	s, addr, release := serve(t, Limits{MaxConcurrent: 2, Mode: Reject})
+	c := dial(t, addr)
+	held := hold(t, s, c, 2)
+	if err := echo(c); !IsOverloaded(err) {
+		t.Errorf("third call returned %v, want overloaded", err)
+	}
+	close(release)
+	for _, call := range held {
+		if err := (<-call.Done).Error; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := echo(c); err != nil {
+		t.Errorf("call after the slots freed up: %v", err)
+	}
+	if st := s.Stats(); st.Admitted != 3 || st.Rejected != 1 || st.Queued != 0 {
+		t.Errorf("got %+v, want 3 admitted and 1 rejected", st)
+	}
+}
+
+// In Queue mode a request waits for a slot, up to QueueTimeout
+func TestQueue(t *testing.T) {
+	s, addr, release := serve(t, Limits{MaxConcurrent: 1, QueueTimeout: 20 * time.Millisecond})
+	c := dial(t, addr)
+	held := hold(t, s, c, 1)
+	if err := echo(c); !IsOverloaded(err) {
+		t.Errorf("call queued past QueueTimeout returned %v", err)
+	}
+	waiting := c.Go("Svc.Echo", new(int), new(int), nil)
+	time.Sleep(5 * time.Millisecond)
+	close(release)
+	if err := (<-waiting.Done).Error; err != nil {
+		t.Errorf("queued call: %v", err)
+	}
+	<-held[0].Done
+	if st := s.Stats(); st.Queued != 1 || st.Rejected != 1 {
+		t.Errorf("got %+v, want 1 queued and 1 rejected", st)
+	}
+}
+
+// MaxInFlightPerConn limits one connection, not the others
+func TestPerConn(t *testing.T) {
+	s, addr, release := serve(t, Limits{MaxInFlightPerConn: 1, Mode: Reject})
+	defer close(release)
+	c := dial(t, addr)
+	hold(t, s, c, 1)
+	if err := echo(c); !IsOverloaded(err) {
+		t.Errorf("second call on a full connection returned %v", err)
+	}
+	if err := echo(dial(t, addr)); err != nil {
+		t.Errorf("call on another connection: %v", err)
+	}
+}
+
+// Over MaxConns in Reject mode a connection gets its call rejected and is
+// then closed
+func TestRejectConns(t *testing.T) {
+	s, addr, _ := serve(t, Limits{MaxConns: 1, Mode: Reject})
+	first := dial(t, addr)
+	if err := echo(first); err != nil {
+		t.Fatal(err)
+	}
+	second := dial(t, addr)
+	if err := echo(second); !IsOverloaded(err) {
+		t.Errorf("call on a connection over MaxConns returned %v", err)
+	}
+	if err := echo(second); err == nil {
+		t.Error("the rejected connection stayed open")
+	}
+	if err := echo(first); err != nil {
+		t.Errorf("the admitted connection: %v", err)
+	}
+	if st := s.Stats(); st.Conns != 1 || st.RejectedConns != 1 {
+		t.Errorf("got %+v, want 1 open and 1 rejected connection", st)
+	}
+}
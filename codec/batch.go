@@ -0,0 +1,190 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Batching bounds how long and how much a batching codec holds back before
+// writing. A message is written at the latest Delay after it was encoded, or
+// as soon as MaxBytes are waiting. Like Nagle's algorithm, a message with
+// nothing else in flight is not held back at all: a client's only
+// outstanding request, or a server's reply to its only pending request.
+type Batching struct {
+	Delay    time.Duration
+	MaxBytes int
+}
+
+var DefaultBatching = Batching{Delay: 50 * time.Microsecond, MaxBytes: 64 << 10}
+
+// batchWriter buffers whole messages and writes them out together, from
+// whichever comes first of the size budget or a timer.
+type batchWriter struct {
+	opts Batching
+
+	mu      sync.Mutex
+	buf     *bufio.Writer
+	pending bool
+	err     error // from a flush on the timer, reported on the next write
+}
+
+func newBatchWriter(w io.Writer, opts Batching) *batchWriter {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultBatching.MaxBytes
+	}
+	// room for a full batch plus the message that pushed it over
+	return &batchWriter{opts: opts, buf: bufio.NewWriterSize(w, 2*opts.MaxBytes)}
+}
+
+func (b *batchWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.buf.Write(p)
+}
+
+// messageDone is called once a complete message has been written; alone
+// says no other message is in flight to share a write with.
+func (b *batchWriter) messageDone(alone bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if alone || b.opts.Delay <= 0 || b.buf.Buffered() >= b.opts.MaxBytes {
+		b.err = b.buf.Flush()
+		return b.err
+	}
+	if !b.pending {
+		b.pending = true
+		time.AfterFunc(b.opts.Delay, b.flushLater)
+	}
+	return nil
+}
+
+func (b *batchWriter) flushLater() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = false
+	if b.err == nil {
+		b.err = b.buf.Flush()
+	}
+}
+
+func (b *batchWriter) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = b.buf.Flush()
+	}
+	return b.err
+}
+
+type batchServerCodec struct {
+	rwc     io.ReadWriteCloser
+	dec     *gob.Decoder
+	enc     *gob.Encoder
+	out     *batchWriter
+	pending int64 // requests read but not yet answered
+	closed  bool
+}
+
+// NewBatchServerCodec is the gob codec with responses coalesced into as few
+// writes as the Batching budget allows. It talks to a plain gob client.
+func NewBatchServerCodec(conn io.ReadWriteCloser, opts Batching) rpc.ServerCodec {
+	out := newBatchWriter(conn, opts)
+	return &batchServerCodec{
+		rwc: conn,
+		dec: gob.NewDecoder(bufio.NewReader(conn)),
+		enc: gob.NewEncoder(out),
+		out: out,
+	}
+}
+
+func (c *batchServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.pending, 1)
+	return nil
+}
+
+func (c *batchServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *batchServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		c.Close()
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		c.Close()
+		return err
+	}
+	return c.out.messageDone(atomic.AddInt64(&c.pending, -1) == 0)
+}
+
+func (c *batchServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.out.flush()
+	return c.rwc.Close()
+}
+
+type batchClientCodec struct {
+	rwc         io.ReadWriteCloser
+	dec         *gob.Decoder
+	enc         *gob.Encoder
+	out         *batchWriter
+	outstanding int64 // requests written but not yet answered
+}
+
+// NewBatchClientCodec is the gob codec with requests from concurrent calls
+// coalesced into as few writes as the Batching budget allows. It talks to a
+// plain gob server.
+func NewBatchClientCodec(conn io.ReadWriteCloser, opts Batching) rpc.ClientCodec {
+	out := newBatchWriter(conn, opts)
+	return &batchClientCodec{
+		rwc: conn,
+		dec: gob.NewDecoder(bufio.NewReader(conn)),
+		enc: gob.NewEncoder(out),
+		out: out,
+	}
+}
+
+func (c *batchClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.out.messageDone(atomic.AddInt64(&c.outstanding, 1) == 1)
+}
+
+func (c *batchClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.outstanding, -1)
+	return nil
+}
+
+func (c *batchClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *batchClientCodec) Close() error {
+	c.out.flush()
+	return c.rwc.Close()
+}
@@ -0,0 +1,105 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+)
+
+// Options carries the parameters of the codecs that take any.
+type Options struct {
+	Batch    Batching
+	Compress Compression
+}
+
+func DefaultOptions() Options {
+	return Options{Batch: DefaultBatching, Compress: DefaultCompression}
+}
+
+// Names lists the codecs NewServer and NewClient know, for flag help.
+var Names = []string{"gob", "batch", "raw", "compress"}
+
+func unknown(name string) error {
+	return fmt.Errorf("unknown codec %q (want one of %v)", name, Names)
+}
+
+// Check reports whether name is a known codec.
+func Check(name string) error {
+	for _, n := range Names {
+		if n == name {
+			return nil
+		}
+	}
+	return unknown(name)
+}
+
+func NewServer(name string, conn io.ReadWriteCloser, opts Options) (rpc.ServerCodec, error) {
+	switch name {
+	case "gob":
+		return NewGobServerCodec(conn), nil
+	case "batch":
+		return NewBatchServerCodec(conn, opts.Batch), nil
+	case "raw":
+		return NewRawServerCodec(conn), nil
+	case "compress":
+		return NewCompressServerCodec(conn, opts.Compress), nil
+	}
+	return nil, unknown(name)
+}
+
+func NewClient(name string, conn io.ReadWriteCloser, opts Options) (rpc.ClientCodec, error) {
+	switch name {
+	case "gob":
+		return NewGobClientCodec(conn), nil
+	case "batch":
+		return NewBatchClientCodec(conn, opts.Batch), nil
+	case "raw":
+		return NewRawClientCodec(conn), nil
+	case "compress":
+		return NewCompressClientCodec(conn, opts.Compress)
+	}
+	return nil, unknown(name)
+}
+
+// Accept is rpc.Server.Accept with every connection served by the named codec.
+func Accept(server *rpc.Server, l net.Listener, name string, opts Options) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Print("codec: accept: ", err)
+			}
+			return
+		}
+		c, err := NewServer(name, conn, opts)
+		if err != nil {
+			log.Print(err)
+			conn.Close()
+			continue
+		}
+		go server.ServeCodec(c)
+	}
+}
+
+// Client wraps an established connection in an *rpc.Client using the named
+// codec.
+func Client(name string, conn io.ReadWriteCloser, opts Options) (*rpc.Client, error) {
+	c, err := NewClient(name, conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClientWithCodec(c), nil
+}
+
+// Dial is rpc.Dial with the named codec on the connection.
+func Dial(network, addr, name string, opts Options) (*rpc.Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return Client(name, conn, opts)
+}
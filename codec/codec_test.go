@@ -0,0 +1,304 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+type Pair struct {
+	Name  string
+	Count int
+}
+
+type Svc struct{}
+
+// Bytes and Buffer take the raw codec's fast path, Pair its gob path
+func (Svc) Bytes(args *[]byte, reply *[]byte) error {
+	*reply = append((*reply)[:0], *args...)
+	return nil
+}
+
+func (Svc) Buffer(args *[]byte, reply *Buffer) error {
+	b := GetBuffer(len(*args))
+	copy(b, *args)
+	*reply = b
+	return nil
+}
+
+func (Svc) Pair(args *Pair, reply *Pair) error {
+	*reply = Pair{args.Name + "!", args.Count + 1}
+	return nil
+}
+
+var errRefused = errors.New("refused")
+
+func (Svc) Fail(args *Pair, reply *Pair) error {
+	return errRefused
+}
+
+// counted counts the writes and bytes that reach a connection.
+type counted struct {
+	io.ReadWriteCloser
+	mu            sync.Mutex
+	writes, bytes int
+}
+
+func (c *counted) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.bytes += len(p)
+	c.mu.Unlock()
+	return c.ReadWriteCloser.Write(p)
+}
+
+func (c *counted) count() (writes, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes, c.bytes
+}
+
+// pair serves Svc with the named codec on one end of a loopback
+// connection and returns a client on the other, whose writes are counted.
+func pair(t testing.TB, name string, opts Options) (*rpc.Client, *counted) {
+	server := rpc.NewServer()
+	server.Register(Svc{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Accept(server, l, name, opts)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &counted{ReadWriteCloser: conn}
+	client, err := Client(name, c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, c
+}
+
+func TestCheck(t *testing.T) {
+	for _, name := range Names {
+		if err := Check(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := Check("json"); err == nil {
+		t.Error("Check(json) accepted")
+	}
+	if _, err := NewServer("json", nil, DefaultOptions()); err == nil {
+		t.Error("NewServer(json) accepted")
+	}
+}
+
+// Every codec carries raw bytes, gob values and errors
+func TestRoundTrip(t *testing.T) {
+	for _, name := range Names {
+		client, _ := pair(t, name, DefaultOptions())
+		for _, n := range []int{0, 1, 4096, 1 << 20} {
+			args := bytes.Repeat([]byte{'x', byte(n)}, n/2)
+			var reply []byte
+			if err := client.Call("Svc.Bytes", &args, &reply); err != nil {
+				t.Fatalf("%s: Bytes(%d): %v", name, n, err)
+			}
+			if !bytes.Equal(reply, args) {
+				t.Errorf("%s: Bytes(%d) came back changed", name, n)
+			}
+			var buf []byte
+			if err := client.Call("Svc.Buffer", &args, &buf); err != nil {
+				t.Fatalf("%s: Buffer(%d): %v", name, n, err)
+			}
+			if !bytes.Equal(buf, args) {
+				t.Errorf("%s: Buffer(%d) came back changed", name, n)
+			}
+		}
+		var p Pair
+		if err := client.Call("Svc.Pair", &Pair{"a", 1}, &p); err != nil {
+			t.Fatalf("%s: Pair: %v", name, err)
+		}
+		if p != (Pair{"a!", 2}) {
+			t.Errorf("%s: Pair returned %+v", name, p)
+		}
+		err := client.Call("Svc.Fail", &Pair{}, &p)
+		if _, ok := err.(rpc.ServerError); !ok || err.Error() != errRefused.Error() {
+			t.Errorf("%s: Fail returned %#v, want the server's error", name, err)
+		}
+		// the connection survives the error
+		if err := client.Call("Svc.Pair", &Pair{"b", 2}, &p); err != nil || p != (Pair{"b!", 3}) {
+			t.Errorf("%s: Pair after Fail: %+v, %v", name, p, err)
+		}
+	}
+}
+
+// Concurrent calls get their own replies back
+func TestConcurrent(t *testing.T) {
+	for _, name := range Names {
+		client, _ := pair(t, name, DefaultOptions())
+		done := make(chan *rpc.Call, 100)
+		for i := 0; i < 100; i++ {
+			args := []byte(fmt.Sprint(i))
+			client.Go("Svc.Bytes", &args, new([]byte), done)
+		}
+		for i := 0; i < 100; i++ {
+			call := <-done
+			if call.Error != nil {
+				t.Fatalf("%s: %v", name, call.Error)
+			}
+			if got, want := *call.Reply.(*[]byte), *call.Args.(*[]byte); !bytes.Equal(got, want) {
+				t.Errorf("%s: sent %s, got %s", name, want, got)
+			}
+		}
+	}
+}
+
+// The batch codec writes the requests of concurrent calls together
+func TestBatchCoalesces(t *testing.T) {
+	client, c := pair(t, "batch", DefaultOptions())
+	done := make(chan *rpc.Call, 100)
+	args := []byte("small")
+	for i := 0; i < 100; i++ {
+		client.Go("Svc.Bytes", &args, new([]byte), done)
+	}
+	for i := 0; i < 100; i++ {
+		if call := <-done; call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+	if writes, _ := c.count(); writes >= 100 {
+		t.Errorf("%d writes for 100 concurrent calls", writes)
+	}
+}
+
+// The raw codec reads a reply into the capacity the caller passed in
+func TestRawReusesReply(t *testing.T) {
+	client, _ := pair(t, "raw", DefaultOptions())
+	args := []byte("into the same memory")
+	reply := make([]byte, 0, 64)
+	before := &reply[:1][0]
+	if err := client.Call("Svc.Bytes", &args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if &reply[0] != before {
+		t.Error("reply was read into new memory")
+	}
+}
+
+// A corrupt raw body length is refused before any memory is taken for it
+func TestRawBodyTooLong(t *testing.T) {
+	var frame []byte
+	frame = append(frame, bodyRaw)
+	frame = binary.AppendUvarint(frame, maxFrame+1)
+	c := newRawConn(struct {
+		io.Reader
+		io.WriteCloser
+	}{bytes.NewReader(frame), nil})
+	var body []byte
+	err := c.readBody(&body, func(old []byte, n int) []byte {
+		t.Fatalf("asked for %d bytes", n)
+		return nil
+	})
+	if err != errTooLong {
+		t.Errorf("got %v, want %v", err, errTooLong)
+	}
+}
+
+// Compressible messages cross the wire compressed once an algorithm is
+// agreed on, and as they are below MinSize or when none is
+func TestCompress(t *testing.T) {
+	args := bytes.Repeat([]byte("compressible "), 10000)
+	wire := func(opts Options) int {
+		client, c := pair(t, "compress", opts)
+		var reply []byte
+		if err := client.Call("Svc.Bytes", &args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, args) {
+			t.Fatal("reply came back changed")
+		}
+		_, n := c.count()
+		return n
+	}
+	opts := DefaultOptions()
+	opts.Compress.Algorithms = []string{"zstd"}
+	if n := wire(opts); n > len(args)/10 {
+		t.Errorf("zstd: %d bytes written for %d compressible ones", n, len(args))
+	}
+	opts.Compress.Algorithms = []string{"deflate"}
+	if n := wire(opts); n > len(args)/10 {
+		t.Errorf("deflate: %d bytes written for %d compressible ones", n, len(args))
+	}
+	opts.Compress.MinSize = 2 * len(args)
+	if n := wire(opts); n < len(args) {
+		t.Errorf("below MinSize: %d bytes written for %d", n, len(args))
+	}
+	opts = DefaultOptions()
+	opts.Compress.Algorithms = []string{"lz4"}
+	if n := wire(opts); n < len(args) {
+		t.Errorf("nothing agreed on: %d bytes written for %d", n, len(args))
+	}
+}
+
+// Every algorithm decodes what it encoded, into a buffer of the message's
+// length
+func TestCompressors(t *testing.T) {
+	src := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	for _, name := range Compressions {
+		c := newCompressor(name)
+		if c == nil {
+			t.Fatalf("%s: no compressor", name)
+		}
+		for i := 0; i < 2; i++ {
+			enc, err := c.encode(nil, src)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			dec, err := c.decode(make([]byte, len(src)), enc)
+			if err != nil || !bytes.Equal(dec, src) {
+				t.Fatalf("%s: round trip %d: %v", name, i, err)
+			}
+		}
+	}
+	if newCompressor("lz4") != nil {
+		t.Error("a compressor for lz4")
+	}
+}
+
+// A compress client fails against a plain gob server instead of hanging
+func TestCompressAgainstGob(t *testing.T) {
+	server := rpc.NewServer()
+	server.Register(Svc{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Accept(server, l, "gob", DefaultOptions())
+	if client, err := Dial("tcp", l.Addr().String(), "compress", DefaultOptions()); err == nil {
+		client.Close()
+		t.Error("compress client connected to a gob server")
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	for _, c := range []struct{ n, cap int }{{0, 512}, {100, 512}, {513, 1024}, {1 << 20, 1 << 20}, {1<<26 + 1, 1<<26 + 1}} {
+		b := GetBuffer(c.n)
+		if len(b) != c.n || cap(b) != c.cap {
+			t.Errorf("GetBuffer(%d): len %d cap %d, want cap %d", c.n, len(b), cap(b), c.cap)
+		}
+		PutBuffer(b)
+	}
+	// not from GetBuffer: left alone
+	PutBuffer(make([]byte, 100))
+	PutBuffer(nil)
+}
@@ -0,0 +1,409 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression says what a compress codec offers and what it compresses.
+type Compression struct {
+	// Algorithms a client offers, most preferred first, or a server accepts;
+	// empty means all of Compressions
+	Algorithms []string
+	// Frames shorter than this are sent as they are
+	MinSize int
+}
+
+var DefaultCompression = Compression{MinSize: 1024}
+
+// Compressions lists the algorithms the compress codec can negotiate, in
+// the order a client offers them by default.
+var Compressions = []string{"snappy", "zstd", "deflate"}
+
+/* The compress codec is gob with every message (header and body) in a frame
+ * of its own, compressed when that makes it smaller:
+ *
+ *   hello    client: compressMagic, uvarint count, then each algorithm it
+ *            offers as a uvarint-prefixed name
+ *            server: the uvarint-prefixed name of the first of them it
+ *            accepts, or "" to send every frame as it is
+ *   frame    kind byte, uvarint length of what follows; a frameCompressed
+ *            frame then has the uvarint length of the message, and the
+ *            message compressed with the negotiated algorithm
+ *
+ * The gob stream runs through the frames unchanged, so types are still
+ * sent once per connection. It does not talk to the stock codec: the magic
+ * starts with a byte gob rejects, so a gob server hangs up on the hello
+ * rather than waiting for more of it.
+ */
+const compressMagic = "\x80gorpc-compress\n"
+
+const (
+	frameRaw byte = iota
+	frameCompressed
+)
+
+// maxFrame bounds a frame, so a corrupt one cannot make the reader allocate
+// without limit.
+const maxFrame = 1 << 30
+
+type compressor struct {
+	// encode compresses src, reusing dst's memory when it can
+	encode func(dst, src []byte) ([]byte, error)
+	// decode decompresses src into dst, which has the message's length
+	decode func(dst, src []byte) ([]byte, error)
+}
+
+// newCompressor returns a compressor of the named algorithm for one
+// connection, or nil.
+func newCompressor(name string) *compressor {
+	switch name {
+	case "snappy":
+		return &compressor{
+			encode: func(dst, src []byte) ([]byte, error) {
+				return snappy.Encode(dst[:cap(dst)], src)
+			},
+			decode: snappy.Decode,
+		}
+	case "zstd":
+		// a connection compresses one message at a time, so neither side
+		// needs goroutines of its own
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		r, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxFrame))
+		return &compressor{
+			encode: func(dst, src []byte) ([]byte, error) {
+				return w.EncodeAll(src, dst[:0]), nil
+			},
+			decode: func(dst, src []byte) ([]byte, error) {
+				return r.DecodeAll(src, dst[:0])
+			},
+		}
+	case "deflate":
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		r := flate.NewReader(nil)
+		return &compressor{
+			encode: func(dst, src []byte) ([]byte, error) {
+				buf := bytes.NewBuffer(dst[:0])
+				w.Reset(buf)
+				w.Write(src)
+				err := w.Close()
+				return buf.Bytes(), err
+			},
+			decode: func(dst, src []byte) ([]byte, error) {
+				r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+				_, err := io.ReadFull(r, dst)
+				return dst, err
+			},
+		}
+	}
+	return nil
+}
+
+type compressConn struct {
+	rwc  io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	opts Compression
+	comp *compressor // nil until negotiated, and if nothing was
+
+	// the message being encoded, and its compressed form
+	out    bytes.Buffer
+	packed []byte
+	enc    *gob.Encoder
+
+	// the message being decoded, what of it is read, and its compressed form
+	in     []byte
+	off    int
+	wire   []byte
+	dec    *gob.Decoder
+	varint [binary.MaxVarintLen64]byte
+}
+
+func newCompressConn(conn io.ReadWriteCloser, opts Compression) *compressConn {
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = Compressions
+	}
+	c := &compressConn{rwc: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), opts: opts}
+	c.enc = gob.NewEncoder(&c.out)
+	c.dec = gob.NewDecoder(c)
+	return c
+}
+
+func (c *compressConn) writeUvarint(x uint64) {
+	n := binary.PutUvarint(c.varint[:], x)
+	c.w.Write(c.varint[:n])
+}
+
+func (c *compressConn) writeString(s string) {
+	c.writeUvarint(uint64(len(s)))
+	c.w.WriteString(s)
+}
+
+func (c *compressConn) readString() (string, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxRawString {
+		return "", errTooLong
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(c.r, b)
+	return string(b), err
+}
+
+// offer is the client's half of the hello; it waits for the server's answer.
+func (c *compressConn) offer() error {
+	c.w.WriteString(compressMagic)
+	c.writeUvarint(uint64(len(c.opts.Algorithms)))
+	for _, name := range c.opts.Algorithms {
+		c.writeString(name)
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	name, err := c.readString()
+	if err != nil {
+		return fmt.Errorf("codec: compress hello: %v", err)
+	}
+	if name == "" {
+		return nil
+	}
+	if c.comp = newCompressor(name); c.comp == nil {
+		return fmt.Errorf("codec: server chose %q, which was not offered", name)
+	}
+	return nil
+}
+
+// accept is the server's half of the hello: it takes the first offered
+// algorithm it accepts.
+func (c *compressConn) accept() error {
+	magic := make([]byte, len(compressMagic))
+	if _, err := io.ReadFull(c.r, magic); err != nil {
+		return err
+	}
+	if string(magic) != compressMagic {
+		return errors.New("codec: not a compress client")
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	chosen := ""
+	for i := uint64(0); i < n; i++ {
+		name, err := c.readString()
+		if err != nil {
+			return err
+		}
+		if chosen == "" && contains(c.opts.Algorithms, name) && contains(Compressions, name) {
+			chosen = name
+		}
+	}
+	// built once, for the one chosen: a zstd compressor holds an encoder
+	// and a decoder
+	c.comp = newCompressor(chosen)
+	c.writeString(chosen)
+	return c.w.Flush()
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMessage encodes header and body into one frame and writes it.
+func (c *compressConn) writeMessage(header, body interface{}) error {
+	c.out.Reset()
+	if err := c.enc.Encode(header); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	msg := c.out.Bytes()
+	if c.comp != nil && len(msg) >= c.opts.MinSize {
+		packed, err := c.comp.encode(c.packed, msg)
+		if err == nil && len(packed) < len(msg) {
+			c.packed = packed
+			c.w.WriteByte(frameCompressed)
+			c.writeUvarint(uint64(len(packed)))
+			c.writeUvarint(uint64(len(msg)))
+			c.w.Write(packed)
+			return c.w.Flush()
+		}
+	}
+	c.w.WriteByte(frameRaw)
+	c.writeUvarint(uint64(len(msg)))
+	c.w.Write(msg)
+	return c.w.Flush()
+}
+
+// grow returns b resliced to n, reallocated if it is too small.
+func grow(b []byte, n uint64) []byte {
+	if uint64(cap(b)) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// readFrame reads the next frame into c.in, decompressed.
+func (c *compressConn) readFrame() error {
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if n > maxFrame {
+		return errTooLong
+	}
+	c.in, c.off = c.in[:0], 0
+	switch kind {
+	case frameRaw:
+		in := grow(c.in, n)
+		if _, err := io.ReadFull(c.r, in); err != nil {
+			return err
+		}
+		c.in = in
+		return nil
+	case frameCompressed:
+		if c.comp == nil {
+			return errors.New("codec: compressed frame on a connection that negotiated none")
+		}
+		size, err := binary.ReadUvarint(c.r)
+		if err != nil {
+			return err
+		}
+		if size > maxFrame {
+			return errTooLong
+		}
+		c.wire = grow(c.wire, n)
+		if _, err := io.ReadFull(c.r, c.wire); err != nil {
+			return err
+		}
+		in, err := c.comp.decode(grow(c.in, size), c.wire)
+		if err != nil {
+			return err
+		}
+		if uint64(len(in)) != size {
+			return fmt.Errorf("codec: frame decompressed to %d bytes, want %d", len(in), size)
+		}
+		c.in = in
+		return nil
+	}
+	return fmt.Errorf("codec: unknown compress frame kind %d", kind)
+}
+
+// Read and ReadByte give the gob decoder the frames' messages back to back.
+func (c *compressConn) Read(p []byte) (int, error) {
+	for c.off == len(c.in) {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.in[c.off:])
+	c.off += n
+	return n, nil
+}
+
+func (c *compressConn) ReadByte() (byte, error) {
+	for c.off == len(c.in) {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	c.off++
+	return c.in[c.off-1], nil
+}
+
+type compressServerCodec struct {
+	*compressConn
+	hello  bool
+	closed bool
+}
+
+// NewCompressServerCodec is the gob codec with messages compressed as
+// negotiated with a compress client. The hello is read with the first
+// request, so creating the codec does not block.
+func NewCompressServerCodec(conn io.ReadWriteCloser, opts Compression) rpc.ServerCodec {
+	return &compressServerCodec{compressConn: newCompressConn(conn, opts)}
+}
+
+func (c *compressServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if !c.hello {
+		// no response can be written before the first request is read
+		if err := c.accept(); err != nil {
+			return err
+		}
+		c.hello = true
+	}
+	return c.dec.Decode(r)
+}
+
+func (c *compressServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *compressServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.writeMessage(r, body); err != nil {
+		// a message the gob stream may have half taken
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *compressServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+type compressClientCodec struct {
+	*compressConn
+}
+
+// NewCompressClientCodec is the gob codec with messages compressed as
+// negotiated with a compress server; it waits for the server's half of the
+// hello.
+func NewCompressClientCodec(conn io.ReadWriteCloser, opts Compression) (rpc.ClientCodec, error) {
+	c := newCompressConn(conn, opts)
+	if err := c.offer(); err != nil {
+		return nil, err
+	}
+	return &compressClientCodec{c}, nil
+}
+
+func (c *compressClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.writeMessage(r, body)
+}
+
+func (c *compressClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *compressClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *compressClientCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,120 @@
+/* net/rpc codecs
+ *
+ * net/rpc's own gob codecs are unexported, so wrappers that need to sit
+ * between rpc.Server/rpc.Client and the wire (admission control, batching,
+ * compression) start from the equivalents here. They speak exactly the same
+ * protocol as rpc.Dial/rpc.ServeConn, so either end can use the stock codec.
+ *
+ * The codecs benchmarks can choose between by name (-codec):
+ *
+ *   gob       what net/rpc uses: one write per request or response
+ *   batch     gob, with messages coalesced into one write within a small
+ *             time or size budget (batch.go)
+ *   raw       []byte payloads copied straight to and from the wire in
+ *             pooled buffers, gob for everything else (raw.go); not gob
+ *             compatible
+ *   compress  gob, with snappy, zstd or deflate negotiated when the
+ *             connection opens and every message of MinSize bytes or more
+ *             compressed (compress.go); not gob compatible
+ *
+ * Basic usage:
+ *   go codec.Accept(rpcServer, listener, "batch", codec.DefaultOptions())
+ *   client, err := codec.Client("batch", conn, codec.DefaultOptions())
+ */
+
+package codec
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+)
+
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+// NewGobServerCodec returns the codec rpc.ServeConn would use on conn.
+func NewGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the header could not be encoded; the stream is unusable
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// only the body failed; the client sees an error for this call
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+// NewGobClientCodec returns the codec rpc.NewClient would use on conn.
+func NewGobClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,51 @@
+package codec
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers come in power-of-two size classes so a freed buffer can serve any
+// later request of up to its size. Smaller requests share the smallest class;
+// larger ones are allocated and dropped as usual.
+const (
+	minBufferShift = 9  // 512B
+	maxBufferShift = 26 // 64MB
+)
+
+var buffers [maxBufferShift - minBufferShift + 1]sync.Pool
+
+func bufferClass(n int) int {
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferShift
+}
+
+// GetBuffer returns a slice of length n, reusing a freed one when it can.
+// The contents are not zeroed.
+func GetBuffer(n int) []byte {
+	class := bufferClass(n)
+	if class >= len(buffers) {
+		return make([]byte, n)
+	}
+	if p, ok := buffers[class].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, 1<<(class+minBufferShift))
+}
+
+// PutBuffer frees b for reuse by GetBuffer. Nothing may use b afterwards.
+// Slices GetBuffer did not hand out are left to the garbage collector.
+func PutBuffer(b []byte) {
+	c := cap(b)
+	if c == 0 || c&(c-1) != 0 {
+		return
+	}
+	class := bufferClass(c)
+	if class >= len(buffers) || 1<<(class+minBufferShift) != c {
+		return
+	}
+	b = b[:0]
+	buffers[class].Put(&b)
+}
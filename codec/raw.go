@@ -0,0 +1,319 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// Buffer is a []byte payload the raw codec recycles once it has written it.
+// A handler that builds its reply in GetBuffer memory replies with *Buffer to
+// give the memory back; a *[]byte reply is left to the garbage collector.
+type Buffer []byte
+
+/* The raw codec frames every message as
+ *
+ *   header   uvarint-prefixed method, uvarint seq, and for responses a
+ *            uvarint-prefixed error
+ *   kind     one byte: bodyGob or bodyRaw
+ *   body     bodyGob: the value, on a gob stream shared by the connection
+ *            bodyRaw: uvarint length, then the bytes
+ *
+ * *[]byte and *Buffer bodies take the raw path and skip gob's reflection
+ * altogether; anything else still goes through gob. On the server, raw
+ * request bodies are read into GetBuffer memory that is freed once the
+ * response has been written, so handlers must copy any of args they keep.
+ * On the client, a raw reply reuses the capacity of the slice the caller
+ * passed in.
+ */
+const (
+	bodyGob byte = iota
+	bodyRaw
+)
+
+type rawConn struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+	w   *bufio.Writer
+	dec *gob.Decoder
+	enc *gob.Encoder
+
+	// method names seen on this connection, so reading one does not allocate
+	methods map[string]string
+	scratch []byte
+	varint  [binary.MaxVarintLen64]byte
+}
+
+func newRawConn(conn io.ReadWriteCloser) *rawConn {
+	c := &rawConn{
+		rwc:     conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		methods: make(map[string]string),
+	}
+	c.dec = gob.NewDecoder(c.r)
+	c.enc = gob.NewEncoder(c.w)
+	return c
+}
+
+func (c *rawConn) writeUvarint(x uint64) error {
+	n := binary.PutUvarint(c.varint[:], x)
+	_, err := c.w.Write(c.varint[:n])
+	return err
+}
+
+func (c *rawConn) writeString(s string) error {
+	if err := c.writeUvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := c.w.WriteString(s)
+	return err
+}
+
+// rawBytes returns the payload of a body that takes the raw path.
+func rawBytes(body interface{}) ([]byte, bool) {
+	switch b := body.(type) {
+	case []byte:
+		return b, true
+	case *[]byte:
+		return *b, true
+	case Buffer:
+		return b, true
+	case *Buffer:
+		return *b, true
+	}
+	return nil, false
+}
+
+func (c *rawConn) writeBody(body interface{}) error {
+	b, ok := rawBytes(body)
+	if !ok {
+		if err := c.w.WriteByte(bodyGob); err != nil {
+			return err
+		}
+		return c.enc.Encode(body)
+	}
+	if err := c.w.WriteByte(bodyRaw); err != nil {
+		return err
+	}
+	if err := c.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := c.w.Write(b)
+	return err
+}
+
+var errTooLong = errors.New("codec: raw frame field too long")
+
+// maxRawString bounds method names and error strings, so a corrupt frame
+// cannot make the reader allocate without limit.
+const maxRawString = 1 << 16
+
+func (c *rawConn) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxRawString {
+		return nil, errTooLong
+	}
+	if uint64(cap(c.scratch)) < n {
+		c.scratch = make([]byte, n)
+	}
+	c.scratch = c.scratch[:n]
+	_, err = io.ReadFull(c.r, c.scratch)
+	return c.scratch, err
+}
+
+func (c *rawConn) readMethod() (string, error) {
+	b, err := c.readBytes()
+	if err != nil {
+		return "", err
+	}
+	if m, ok := c.methods[string(b)]; ok {
+		return m, nil
+	}
+	m := string(b)
+	c.methods[m] = m
+	return m, nil
+}
+
+func (c *rawConn) readString() (string, error) {
+	b, err := c.readBytes()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readBody decodes the next body into body. get supplies the memory for a
+// raw payload of n bytes; it is only called when body is *[]byte or *Buffer.
+func (c *rawConn) readBody(body interface{}, get func(old []byte, n int) []byte) error {
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if kind == bodyGob {
+		return c.dec.Decode(body)
+	}
+	if kind != bodyRaw {
+		return fmt.Errorf("codec: unknown raw body kind %d", kind)
+	}
+	n64, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if n64 > maxFrame {
+		return errTooLong
+	}
+	n := int(n64)
+	var dst *[]byte
+	switch b := body.(type) {
+	case nil:
+		_, err = c.r.Discard(n)
+		return err
+	case *[]byte:
+		dst = b
+	case *Buffer:
+		dst = (*[]byte)(b)
+	default:
+		c.r.Discard(n)
+		return fmt.Errorf("codec: raw body sent for %T", body)
+	}
+	*dst = get(*dst, n)
+	_, err = io.ReadFull(c.r, *dst)
+	return err
+}
+
+type rawServerCodec struct {
+	*rawConn
+	seq uint64 // of the request being read
+
+	mu      sync.Mutex
+	reqBufs map[uint64][]byte // raw request bodies, freed after the response
+	closed  bool
+}
+
+// NewRawServerCodec serves requests framed by the raw codec; see Buffer.
+func NewRawServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &rawServerCodec{rawConn: newRawConn(conn), reqBufs: make(map[uint64][]byte)}
+}
+
+func (c *rawServerCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	if r.ServiceMethod, err = c.readMethod(); err != nil {
+		return
+	}
+	r.Seq, err = binary.ReadUvarint(c.r)
+	c.seq = r.Seq
+	return
+}
+
+func (c *rawServerCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body, func(old []byte, n int) []byte {
+		b := GetBuffer(n)
+		c.mu.Lock()
+		c.reqBufs[c.seq] = b
+		c.mu.Unlock()
+		return b
+	})
+}
+
+func sameBuffer(a, b []byte) bool {
+	return cap(a) > 0 && cap(b) > 0 && &a[:cap(a)][cap(a)-1] == &b[:cap(b)][cap(b)-1]
+}
+
+func (c *rawServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	err := c.writeString(r.ServiceMethod)
+	if err == nil {
+		err = c.writeUvarint(r.Seq)
+	}
+	if err == nil {
+		err = c.writeString(r.Error)
+	}
+	if err == nil {
+		err = c.writeBody(body)
+	}
+	if err == nil {
+		err = c.w.Flush()
+	}
+
+	c.mu.Lock()
+	req, ok := c.reqBufs[r.Seq]
+	delete(c.reqBufs, r.Seq)
+	c.mu.Unlock()
+	if reply, isBuffer := body.(*Buffer); isBuffer && !(ok && sameBuffer(req, *reply)) {
+		PutBuffer(*reply)
+	}
+	if ok {
+		PutBuffer(req)
+	}
+
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+func (c *rawServerCodec) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+type rawClientCodec struct {
+	*rawConn
+}
+
+// NewRawClientCodec sends requests framed by the raw codec; see Buffer.
+func NewRawClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &rawClientCodec{newRawConn(conn)}
+}
+
+func (c *rawClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.writeString(r.ServiceMethod); err != nil {
+		return err
+	}
+	if err := c.writeUvarint(r.Seq); err != nil {
+		return err
+	}
+	if err := c.writeBody(body); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *rawClientCodec) ReadResponseHeader(r *rpc.Response) (err error) {
+	if r.ServiceMethod, err = c.readMethod(); err != nil {
+		return
+	}
+	if r.Seq, err = binary.ReadUvarint(c.r); err != nil {
+		return
+	}
+	r.Error, err = c.readString()
+	return
+}
+
+// reuse keeps the caller's reply slice when it is large enough.
+func reuse(old []byte, n int) []byte {
+	if cap(old) >= n {
+		return old[:n]
+	}
+	return make([]byte, n)
+}
+
+func (c *rawClientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body, reuse)
+}
+
+func (c *rawClientCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,116 @@
+/*
+ * Compares stored benchmark results (see results) between two runs,
+ * commits or Go versions.
+ *
+ * compare  [-results directory of stored runs]
+ *          [-alpha significance level]
+ *          [-threshold relative change that counts as a regression]
+ *          [-list] OLD NEW
+ *
+ * OLD and NEW each select runs: a commit or run ID prefix, go:VERSION, or
+ * latest. All runs a selector matches are grouped per benchmark and
+ * parameters, and each run counts as one sample: the median of its
+ * per-interval values. Every metric both sides have is tested with
+ * Mann-Whitney U over those runs and given a bootstrap 95% interval for the
+ * change in median; a significant change for the worse beyond -threshold is
+ * a REGRESSION, and makes compare exit 1.
+ *
+ * Few runs cannot show any change: 3 against 3 never give p below 0.1, so
+ * at the default -alpha 0.05 repeat runs (Repeat in a scenario) at least 4
+ * times a side. A metric with fewer is marked "too few runs for alpha"
+ * rather than unchanged, and compare prints how many runs it takes.
+ *
+ * Basic usage:
+ *   compare -list
+ *   compare 5d64043 ed369d1
+ *   compare go:go1.21.6 go:go1.22.0
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gorpc-tests/results"
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Fatal error ", err.Error())
+		os.Exit(2)
+	}
+}
+
+func list(runs []*results.Run) {
+	for _, r := range runs {
+		dirty := ""
+		if r.Dirty {
+			dirty = "+dirty"
+		}
+		var metrics []string
+		for name, s := range r.Metrics {
+			metrics = append(metrics, fmt.Sprintf("%s:%d", name, len(s.Values)))
+		}
+		fmt.Printf("%s  %.12s%s  %s  %s  %s\n", r.ID, r.Commit, dirty, r.GoVersion, r.Host,
+			strings.Join(metrics, " "))
+	}
+}
+
+func main() {
+	dir := flag.String("results", results.DefaultDir(), "directory of stored runs")
+	alpha := flag.Float64("alpha", 0.05, "significance level")
+	threshold := flag.Float64("threshold", 0.05, "relative change for the worse that counts as a regression")
+	listRuns := flag.Bool("list", false, "list the stored runs and exit")
+	flag.Parse()
+	if *alpha <= 0 || *alpha >= 1 {
+		fmt.Println("-alpha must be between 0 and 1")
+		os.Exit(2)
+	}
+
+	runs, err := results.Store{Dir: *dir}.Load()
+	checkError(err)
+	if *listRuns {
+		list(runs)
+		return
+	}
+	if flag.NArg() != 2 {
+		fmt.Println("Usage: ", os.Args[0], "[-results dir] [-alpha a] [-threshold t] [-list] OLD NEW")
+		os.Exit(2)
+	}
+	old, err := results.Select(runs, flag.Arg(0))
+	checkError(err)
+	new, err := results.Select(runs, flag.Arg(1))
+	checkError(err)
+
+	deltas := results.Compare(old, new, results.CompareOptions{Alpha: *alpha, Threshold: *threshold})
+	if len(deltas) == 0 {
+		fmt.Println("No benchmark configuration was run on both sides")
+		os.Exit(2)
+	}
+	fmt.Printf("old: %d run(s) of %s, new: %d run(s) of %s; each run is one sample, its median\n",
+		len(old), flag.Arg(0), len(new), flag.Arg(1))
+	results.PrintDeltas(os.Stdout, deltas)
+	regressions, tooFew := 0, 0
+	for _, d := range deltas {
+		if d.Regression {
+			regressions++
+		}
+		if d.Verdict == results.TooFewRuns {
+			tooFew++
+		}
+	}
+	if tooFew > 0 {
+		need := 1
+		for results.MinP(need, need) >= *alpha {
+			need++
+		}
+		fmt.Printf("%d metric(s) had too few runs to reach p < %g, which takes %d runs a side\n", tooFew, *alpha, need)
+	}
+	if regressions > 0 {
+		fmt.Printf("%d regression(s) beyond %.0f%% at p < %g\n", regressions, 100**threshold, *alpha)
+		os.Exit(1)
+	}
+}
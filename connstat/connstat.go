@@ -0,0 +1,165 @@
+/* Syscall accounting for RPC connections
+ *
+ * Conn wraps a net.Conn and counts Read and Write calls and bytes into a
+ * shared Counters. Each Read/Write on a TCP conn is one read(2)/write(2),
+ * plus an extra read that returned EAGAIN whenever the goroutine had to wait
+ * for data, so the counts are a close lower bound on what strace shows
+ * (see windowedThroughput/log.txt).
+ *
+ * Count the client side by dialing through Dial, and the server side by
+ * accepting through WrapListener. For a server in another process, register
+ * Service on it and ask it for its counters with Fetch.
+ *
+ * Basic usage:
+ *   var server, client connstat.Counters
+ *   go rpcServer.Accept(connstat.WrapListener(listener, &server))
+ *   c, err := connstat.Dial("tcp", addr, &client)
+ *   ... calls ...
+ *   connstat.Report(os.Stdout, client.Snapshot(), server.Snapshot(), calls)
+ */
+
+package connstat
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+
+	"gorpc-tests/profiling"
+)
+
+type Counters struct {
+	Reads, Writes           int64
+	BytesRead, BytesWritten int64
+}
+
+// Snapshot reads the counters atomically (each field on its own).
+func (c *Counters) Snapshot() Counters {
+	return Counters{
+		Reads:        atomic.LoadInt64(&c.Reads),
+		Writes:       atomic.LoadInt64(&c.Writes),
+		BytesRead:    atomic.LoadInt64(&c.BytesRead),
+		BytesWritten: atomic.LoadInt64(&c.BytesWritten),
+	}
+}
+
+func (c Counters) Sub(before Counters) Counters {
+	return Counters{
+		Reads:        c.Reads - before.Reads,
+		Writes:       c.Writes - before.Writes,
+		BytesRead:    c.BytesRead - before.BytesRead,
+		BytesWritten: c.BytesWritten - before.BytesWritten,
+	}
+}
+
+type Conn struct {
+	net.Conn
+	counters *Counters
+}
+
+func WrapConn(conn net.Conn, counters *Counters) net.Conn {
+	return &Conn{conn, counters}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.counters.Reads, 1)
+	atomic.AddInt64(&c.counters.BytesRead, int64(n))
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.counters.Writes, 1)
+	atomic.AddInt64(&c.counters.BytesWritten, int64(n))
+	return n, err
+}
+
+type listener struct {
+	net.Listener
+	counters *Counters
+}
+
+// WrapListener counts every connection it accepts into counters.
+func WrapListener(l net.Listener, counters *Counters) net.Listener {
+	return &listener{l, counters}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return WrapConn(conn, l.counters), nil
+}
+
+// DialConn dials addr and counts the connection into counters.
+func DialConn(network, addr string, counters *Counters) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return WrapConn(conn, counters), nil
+}
+
+// Dial is rpc.Dial over a counted connection.
+func Dial(network, addr string, counters *Counters) (*rpc.Client, error) {
+	conn, err := DialConn(network, addr, counters)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Side is one end's resource use, as sent by Service.
+type Side struct {
+	Conn   Counters
+	Allocs profiling.Allocs
+}
+
+func (s Side) Sub(before Side) Side {
+	return Side{s.Conn.Sub(before.Conn), s.Allocs.Sub(before.Allocs)}
+}
+
+// Service lets a client read a server's counters; register it as "Stats".
+type Service struct {
+	Counters *Counters
+}
+
+func (s *Service) Get(args int, reply *Side) error {
+	*reply = Side{s.Counters.Snapshot(), profiling.ReadAllocs()}
+	return nil
+}
+
+// Fetch asks a server running Service for its counters.
+func Fetch(c *rpc.Client) (Side, error) {
+	var side Side
+	err := c.Call("Stats.Get", 0, &side)
+	return side, err
+}
+
+func perCall(n int64, calls int64) float64 {
+	return float64(n) / float64(calls)
+}
+
+// Report prints syscalls per call for both ends.
+func Report(w io.Writer, client, server Counters, calls int64) {
+	if calls <= 0 {
+		return
+	}
+	fmt.Fprintf(w, "Syscalls/call: client %.2f reads %.2f writes, server %.2f reads %.2f writes\n",
+		perCall(client.Reads, calls), perCall(client.Writes, calls),
+		perCall(server.Reads, calls), perCall(server.Writes, calls))
+	fmt.Fprintf(w, "Bytes/syscall: client %.0f read %.0f written, server %.0f read %.0f written\n",
+		ratio(client.BytesRead, client.Reads), ratio(client.BytesWritten, client.Writes),
+		ratio(server.BytesRead, server.Reads), ratio(server.BytesWritten, server.Writes))
+}
+
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
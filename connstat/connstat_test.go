@@ -0,0 +1,68 @@
+package connstat
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+type Svc struct{}
+
+func (Svc) Echo(args []byte, reply *[]byte) error {
+	*reply = args
+	return nil
+}
+
+// Both ends count what crosses the connection, and agree on the bytes
+func TestCounts(t *testing.T) {
+	var client, server Counters
+	rs := rpc.NewServer()
+	rs.Register(Svc{})
+	rs.RegisterName("Stats", &Service{&server})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go rs.Accept(WrapListener(l, &server))
+	c, err := Dial("tcp", l.Addr().String(), &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	before := client.Snapshot()
+	for i := 0; i < 10; i++ {
+		var reply []byte
+		if err := c.Call("Svc.Echo", make([]byte, 1000), &reply); err != nil || len(reply) != 1000 {
+			t.Fatalf("Echo: %d bytes, %v", len(reply), err)
+		}
+	}
+	d := client.Snapshot().Sub(before)
+	if d.Writes < 10 || d.BytesWritten < 10*1000 || d.BytesRead < 10*1000 {
+		t.Errorf("10 echoes of 1000 bytes counted as %+v", d)
+	}
+	side, err := Fetch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server has read all the client wrote, up to the Stats.Get request
+	if side.Conn.BytesRead != client.Snapshot().BytesWritten {
+		t.Errorf("server read %d bytes, client wrote %d", side.Conn.BytesRead, client.Snapshot().BytesWritten)
+	}
+	if side.Allocs.Objects == 0 {
+		t.Error("server reported no allocations")
+	}
+	var out bytes.Buffer
+	Report(&out, d, side.Conn, 10)
+	if !strings.HasPrefix(out.String(), "Syscalls/call: client ") {
+		t.Errorf("Report printed %q", out.String())
+	}
+	out.Reset()
+	Report(&out, d, side.Conn, 0)
+	if out.Len() != 0 {
+		t.Errorf("Report of no calls printed %q", out.String())
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Side-by-side cost of the echo paths, for GC-bound large-blob RPCs.
+ *
+ * echobench  [-sizes payload sizes in bytes, comma separated]
+ *            [-calls calls per path and size]
+ *            [-window calls outstanding at once]
+ *            [-paths which of the paths below to run, comma separated]
+ *            [-cpuprofile/-memprofile/... see profiling]
+ *            [-results directory results are stored in, see results]
+ *
+ * Paths:
+ *   gob         Message.Echo over net/rpc's gob codec, with a fresh argument
+ *               slice per call, as in throughput
+ *   gob-copy    Arith.Echo's copying handler (without the sleep) over gob
+ *   raw         Blob.Echo over the raw codec: the reply aliases the request
+ *               buffer, both ends reuse their buffers
+ *   raw-pooled  Blob.EchoCopy over the raw codec: the reply is a copy in a
+ *               pooled buffer that the codec frees after writing it
+ *   compress    Message.Echo over the compress codec, which negotiates
+ *               snappy, zstd or deflate; the payloads are zeros, so this
+ *               is its best case
+ *
+ * Client and server share the process, so allocations and GC are both ends'.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorpc-tests/codec"
+	"gorpc-tests/connstat"
+	"gorpc-tests/profiling"
+	"gorpc-tests/results"
+)
+
+type DynArg struct {
+	A []byte
+}
+
+type Message int
+
+func (t *Message) Echo(args *DynArg, reply *DynArg) error {
+	reply.A = args.A
+	return nil
+}
+
+type Arith int
+
+// copies input byte-slice to reply, like windowedThroughput's Arith.Echo
+func (t *Arith) Echo(args *DynArg, reply *DynArg) error {
+	replyData := make([]byte, len(args.A))
+	copy(replyData, args.A)
+	reply.A = replyData
+	return nil
+}
+
+// echo handlers for the raw codec, which reads args into a pooled buffer
+type Blob int
+
+// replies with the request buffer itself; the codec frees it once written
+func (t *Blob) Echo(args *[]byte, reply *[]byte) error {
+	*reply = *args
+	return nil
+}
+
+// replies with a copy in a pooled buffer, which the codec frees once written
+func (t *Blob) EchoCopy(args *[]byte, reply *codec.Buffer) error {
+	b := codec.GetBuffer(len(*args))
+	copy(b, *args)
+	*reply = b
+	return nil
+}
+
+type path struct {
+	name   string
+	codec  string
+	method string
+	// call starts one call reusing slot i of the window, or allocating
+	call func(c *rpc.Client, method string, i int, done chan *rpc.Call)
+}
+
+var size int
+
+// per-window-slot buffers for the paths that reuse them
+var rawArgs, rawReplies [][]byte
+
+func gobCall(c *rpc.Client, method string, i int, done chan *rpc.Call) {
+	args := &DynArg{A: make([]byte, size)}
+	c.Go(method, args, new(DynArg), done)
+}
+
+func rawCall(c *rpc.Client, method string, i int, done chan *rpc.Call) {
+	c.Go(method, rawArgs[i], &rawReplies[i], done)
+}
+
+var paths = []path{
+	{"gob", "gob", "Message.Echo", gobCall},
+	{"gob-copy", "gob", "Arith.Echo", gobCall},
+	{"raw", "raw", "Blob.Echo", rawCall},
+	{"raw-pooled", "raw", "Blob.EchoCopy", rawCall},
+	{"compress", "compress", "Message.Echo", gobCall},
+}
+
+var serverConns, clientConns connstat.Counters
+
+// starts a server for every codec the paths use
+func startServers() map[string]string {
+	server := rpc.NewServer()
+	server.Register(new(Message))
+	server.Register(new(Arith))
+	server.Register(new(Blob))
+	addrs := make(map[string]string)
+	for _, p := range paths {
+		if _, ok := addrs[p.codec]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", "localhost:0")
+		checkError(err)
+		go codec.Accept(server, connstat.WrapListener(l, &serverConns), p.codec, codec.DefaultOptions())
+		addrs[p.codec] = l.Addr().String()
+	}
+	return addrs
+}
+
+type result struct {
+	elapsed time.Duration
+	runtime profiling.Delta
+	conns   connstat.Counters
+}
+
+// runs calls calls with window outstanding at a time
+func run(c *rpc.Client, p path, calls int, window int) result {
+	done := make(chan *rpc.Call, window)
+	//buffers for this size, allocated before timing starts
+	for i := 0; i < window; i++ {
+		rawArgs[i] = make([]byte, size)
+		rawReplies[i] = make([]byte, size)
+	}
+
+	runtimeBefore := profiling.Snapshot()
+	connsBefore := clientConns.Snapshot()
+	start := time.Now()
+	sent := 0
+	for ; sent < window && sent < calls; sent++ {
+		p.call(c, p.method, sent, done)
+	}
+	for received := 0; received < calls; received++ {
+		call := <-done
+		checkError(call.Error)
+		if sent < calls {
+			//the slot of the finished call is free again
+			i := received % window
+			if args, ok := call.Args.([]byte); ok {
+				i = indexOf(args)
+			}
+			p.call(c, p.method, i, done)
+			sent++
+		}
+	}
+	return result{
+		elapsed: time.Since(start),
+		runtime: profiling.Snapshot().Sub(runtimeBefore),
+		conns:   clientConns.Snapshot().Sub(connsBefore),
+	}
+}
+
+// finds the window slot a raw argument came from
+func indexOf(args []byte) int {
+	for i := range rawArgs {
+		if len(rawArgs[i]) > 0 && &rawArgs[i][0] == &args[0] {
+			return i
+		}
+	}
+	return 0
+}
+
+func parseSizes(s string) []int {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n <= 0 {
+			log.Fatalf("bad -sizes entry %q", f)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes
+}
+
+func selectPaths(s string) []path {
+	var selected []path
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, p := range paths {
+			if p.name == strings.TrimSpace(name) {
+				selected = append(selected, p)
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("unknown path %q", name)
+		}
+	}
+	return selected
+}
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Fatal error ", err.Error())
+		profiling.Exit(1)
+	}
+}
+
+func main() {
+	sizesFlag := flag.String("sizes", "1024,65536,1048576", "payload sizes in bytes, comma separated")
+	calls := flag.Int("calls", 2000, "calls per path and size")
+	window := flag.Int("window", 8, "calls outstanding at once")
+	pathsFlag := flag.String("paths", "gob,gob-copy,raw,raw-pooled", "paths to run, comma separated")
+	prof := profiling.AddFlags()
+	store := results.AddFlags()
+	flag.Parse()
+	checkError(codec.Check("raw"))
+	if *window < 1 || *calls < 1 {
+		log.Fatal("-window and -calls must be positive")
+	}
+
+	session := prof.Start()
+	defer session.Stop()
+
+	addrs := startServers()
+	selected := selectPaths(*pathsFlag)
+	rawArgs = make([][]byte, *window)
+	rawReplies = make([][]byte, *window)
+
+	stored := results.New("echobench")
+	fmt.Printf("%-10s %-10s %10s %10s %12s %12s %6s %12s %10s\n",
+		"size", "path", "calls/s", "MB/s", "allocs/call", "bytes/call", "GCs", "GC pause", "writes/call")
+	for _, n := range parseSizes(*sizesFlag) {
+		size = n
+		for _, p := range selected {
+			conn, err := connstat.DialConn("tcp", addrs[p.codec], &clientConns)
+			checkError(err)
+			c, err := codec.Client(p.codec, conn, codec.DefaultOptions())
+			checkError(err)
+			//one untimed call per slot dials gob's type information through
+			run(c, p, *window, *window)
+			r := run(c, p, *calls, *window)
+			c.Close()
+
+			secs := r.elapsed.Seconds()
+			fmt.Printf("%-10d %-10s %10.0f %10.1f %12.1f %12.0f %6d %12v %10.2f\n",
+				n, p.name, float64(*calls)/secs, float64(2*n**calls)/secs/1e6,
+				float64(r.runtime.Allocs.Objects)/float64(*calls),
+				float64(r.runtime.Allocs.Bytes)/float64(*calls),
+				r.runtime.NumGC, r.runtime.PauseTotal,
+				float64(r.conns.Writes)/float64(*calls))
+			name := fmt.Sprintf("%s/size=%d", p.name, n)
+			stored.Add(name+" throughput", "calls/s", true, float64(*calls)/secs)
+			stored.Add(name+" allocs", "allocs/call", false, float64(r.runtime.Allocs.Objects)/float64(*calls))
+			stored.Add(name+" alloc-bytes", "B/call", false, float64(r.runtime.Allocs.Bytes)/float64(*calls))
+		}
+	}
+	store.Save(stored)
+}
@@ -0,0 +1,229 @@
+/*
+ * Head-of-line blocking on multiplexed net/rpc connections.
+ *
+ * An rpc.Client sends every call over one connection: a small call issued
+ * while a large request is being written waits for the write, and its reply
+ * waits behind large replies. This runs a latency-sensitive stream of small
+ * calls next to a bulk stream of large ones, either on the same *rpc.Client
+ * (shared) or on a connection of its own (separate), and reports how much
+ * the small calls' latency grows over running alone, for every bulk size
+ * and bulk window.
+ *
+ * holblocking  [-bulksizes bulk payload sizes, comma separated, e.g. 64K,1M]
+ *              [-windows bulk calls in flight, comma separated]
+ *              [-small small payload size]
+ *              [-interval pause between small calls]
+ *              [-warmup, -duration per measurement]
+ *              [-modes shared,separate]
+ *              [-codec gob, batch or raw, on every connection]
+ *              [-cpuprofile/-memprofile/... see profiling]
+ *              [-results directory results are stored in, see results]
+ *
+ * Client and server share the process, like echobench.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorpc-tests/codec"
+	"gorpc-tests/measure"
+	"gorpc-tests/profiling"
+	"gorpc-tests/results"
+	"gorpc-tests/sizedist"
+)
+
+type Blob int
+
+// replies with the request itself; with the raw codec that is its buffer,
+// which the codec frees once the reply is written
+func (t *Blob) Echo(args *[]byte, reply *[]byte) error {
+	*reply = *args
+	return nil
+}
+
+var codecName string
+var codecOpts = codec.DefaultOptions()
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Fatal error ", err.Error())
+		profiling.Exit(1)
+	}
+}
+
+func startServer() string {
+	server := rpc.NewServer()
+	server.Register(new(Blob))
+	l, err := net.Listen("tcp", "localhost:0")
+	checkError(err)
+	go codec.Accept(server, l, codecName, codecOpts)
+	return l.Addr().String()
+}
+
+func dial(addr string) *rpc.Client {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	c, err := codec.Client(codecName, conn, codecOpts)
+	checkError(err)
+	return c
+}
+
+// bulk keeps window calls of size bytes in flight on c until stop is
+// closed, adding the bytes of every reply to counted.
+func bulk(c *rpc.Client, size, window int, stop chan struct{}, counted *int64) {
+	args := make([]byte, size)
+	done := make(chan *rpc.Call, window)
+	for i := 0; i < window; i++ {
+		c.Go("Blob.Echo", &args, new([]byte), done)
+	}
+	for outstanding := window; outstanding > 0; outstanding-- {
+		call := <-done
+		checkError(call.Error)
+		atomic.AddInt64(counted, int64(size))
+		select {
+		case <-stop:
+		default:
+			c.Go("Blob.Echo", &args, new([]byte), done)
+			outstanding++
+		}
+	}
+}
+
+// probe makes small calls one at a time for duration, pausing interval
+// between them, and records their latency.
+func probe(c *rpc.Client, size int, interval, duration time.Duration) *measure.Histogram {
+	args := make([]byte, size)
+	h := new(measure.Histogram)
+	end := time.Now().Add(duration)
+	for {
+		began := time.Now()
+		if began.After(end) {
+			return h
+		}
+		var reply []byte
+		checkError(c.Call("Blob.Echo", &args, &reply))
+		h.Record(time.Since(began))
+		time.Sleep(interval)
+	}
+}
+
+type cell struct {
+	mode         string
+	bulkSize     int
+	window       int
+	small        *measure.Histogram
+	bulkMBPerSec float64
+}
+
+// measureCell runs the small stream after warmup, next to a bulk stream
+// unless window is 0.
+func measureCell(addr, mode string, bulkSize, window, small int, interval, warmup, duration time.Duration) cell {
+	bulkClient := dial(addr)
+	defer bulkClient.Close()
+	smallClient := bulkClient
+	if mode == "separate" {
+		smallClient = dial(addr)
+		defer smallClient.Close()
+	}
+	stop := make(chan struct{})
+	var w sync.WaitGroup
+	var bulkBytes int64
+	if window > 0 {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			bulk(bulkClient, bulkSize, window, stop, &bulkBytes)
+		}()
+	}
+	// bulk bytes are counted over the same span as the small calls
+	time.Sleep(warmup)
+	before := atomic.LoadInt64(&bulkBytes)
+	h := probe(smallClient, small, interval, duration)
+	after := atomic.LoadInt64(&bulkBytes)
+	close(stop)
+	w.Wait()
+	// both directions, as echobench counts
+	return cell{mode, bulkSize, window, h, float64(2*(after-before)) / 1e6 / duration.Seconds()}
+}
+
+func parseList(s string, parse func(string) (int, error)) []int {
+	var vs []int
+	for _, f := range strings.Split(s, ",") {
+		v, err := parse(strings.TrimSpace(f))
+		checkError(err)
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func us(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func main() {
+	sizesFlag := flag.String("bulksizes", "4K,64K,1M", "bulk payload sizes, comma separated (K and M suffixes)")
+	windowsFlag := flag.String("windows", "1,4,16", "bulk calls in flight, comma separated")
+	smallFlag := flag.String("small", "64", "small (latency-sensitive) payload size")
+	interval := flag.Duration("interval", time.Millisecond, "pause between small calls")
+	warmup := flag.Duration("warmup", 200*time.Millisecond, "run before measuring, per measurement")
+	duration := flag.Duration("duration", 2*time.Second, "measure for this long, per measurement")
+	modesFlag := flag.String("modes", "shared,separate", "small calls on the bulk stream's connection (shared) and/or their own (separate)")
+	flag.StringVar(&codecName, "codec", "gob", fmt.Sprintf("codec on every connection, one of %v", codec.Names))
+	prof := profiling.AddFlags()
+	store := results.AddFlags()
+	flag.Parse()
+	checkError(codec.Check(codecName))
+	sess := prof.Start()
+	defer sess.Stop()
+
+	bulkSizes := parseList(*sizesFlag, sizedist.ParseSize)
+	windows := parseList(*windowsFlag, strconv.Atoi)
+	small, err := sizedist.ParseSize(*smallFlag)
+	checkError(err)
+	var modes []string
+	for _, m := range strings.Split(*modesFlag, ",") {
+		if m != "shared" && m != "separate" {
+			checkError(fmt.Errorf("unknown mode %q, want shared or separate", m))
+		}
+		modes = append(modes, m)
+	}
+
+	addr := startServer()
+	stored := results.New("holblocking")
+
+	alone := measureCell(addr, "alone", 0, 0, small, *interval, *warmup, *duration)
+	base50, base99 := alone.small.Percentile(0.5), alone.small.Percentile(0.99)
+	fmt.Printf("Small calls of %d bytes alone (%s): p50 %v, p99 %v\n\n", small, codecName, base50, base99)
+	stored.Add("alone small-p50", "µs", false, us(base50))
+	stored.Add("alone small-p99", "µs", false, us(base99))
+
+	fmt.Printf("%-9s %9s %6s %10s %12s %12s %8s %8s\n",
+		"mode", "bulk", "window", "bulk MB/s", "small p50", "small p99", "p50 x", "p99 x")
+	for _, mode := range modes {
+		for _, size := range bulkSizes {
+			for _, window := range windows {
+				c := measureCell(addr, mode, size, window, small, *interval, *warmup, *duration)
+				p50, p99 := c.small.Percentile(0.5), c.small.Percentile(0.99)
+				x50, x99 := float64(p50)/float64(base50), float64(p99)/float64(base99)
+				fmt.Printf("%-9s %9d %6d %10.1f %12v %12v %8.1f %8.1f\n",
+					mode, size, window, c.bulkMBPerSec, p50, p99, x50, x99)
+				name := fmt.Sprintf("%s bulk=%d window=%d", mode, size, window)
+				stored.Add(name+" small-p50", "µs", false, us(p50))
+				stored.Add(name+" small-p99", "µs", false, us(p99))
+				stored.Add(name+" inflation-p99", "x", false, x99)
+				stored.Add(name+" bulk", "MB/s", true, c.bulkMBPerSec)
+			}
+		}
+	}
+	store.Save(stored)
+}
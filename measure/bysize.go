@@ -0,0 +1,89 @@
+package measure
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// SizeBucket is the latency of every message up to Max bytes (and above
+// the previous bucket's Max).
+type SizeBucket struct {
+	Max     int
+	Bytes   int64
+	Latency Histogram
+}
+
+// Name labels the bucket, e.g. <=4KiB.
+func (b *SizeBucket) Name() string {
+	switch {
+	case b.Max >= 1<<30 && b.Max%(1<<30) == 0:
+		return fmt.Sprintf("<=%dGiB", b.Max>>30)
+	case b.Max >= 1<<20 && b.Max%(1<<20) == 0:
+		return fmt.Sprintf("<=%dMiB", b.Max>>20)
+	case b.Max >= 1<<10 && b.Max%(1<<10) == 0:
+		return fmt.Sprintf("<=%dKiB", b.Max>>10)
+	}
+	return fmt.Sprintf("<=%dB", b.Max)
+}
+
+// BySize keeps a latency histogram per message size, in buckets that grow
+// by powers of four from 64 bytes, so mixed sizes show which ones wait.
+// The zero value is ready to use; it is not safe for concurrent use.
+type BySize struct {
+	buckets map[int]*SizeBucket
+}
+
+func sizeBucketMax(size int) int {
+	max := 64
+	for max < size {
+		max *= 4
+	}
+	return max
+}
+
+func (s *BySize) bucket(max int) *SizeBucket {
+	if s.buckets == nil {
+		s.buckets = make(map[int]*SizeBucket)
+	}
+	b, ok := s.buckets[max]
+	if !ok {
+		b = &SizeBucket{Max: max}
+		s.buckets[max] = b
+	}
+	return b
+}
+
+// Record adds a message of size bytes that took d.
+func (s *BySize) Record(size int, d time.Duration) {
+	b := s.bucket(sizeBucketMax(size))
+	b.Bytes += int64(size)
+	b.Latency.Record(d)
+}
+
+func (s *BySize) Merge(o *BySize) {
+	for max, ob := range o.buckets {
+		b := s.bucket(max)
+		b.Bytes += ob.Bytes
+		b.Latency.Merge(&ob.Latency)
+	}
+}
+
+// Buckets returns the buckets that saw a message, smallest first.
+func (s *BySize) Buckets() []*SizeBucket {
+	var bs []*SizeBucket
+	for _, b := range s.buckets {
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].Max < bs[j].Max })
+	return bs
+}
+
+// Report prints one line per bucket.
+func (s *BySize) Report(w io.Writer) {
+	fmt.Fprintf(w, "Latency by message size:\n")
+	for _, b := range s.Buckets() {
+		fmt.Fprintf(w, "  %-9s %v\n", b.Name(), &b.Latency)
+	}
+}
@@ -0,0 +1,152 @@
+package measure
+
+import (
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+// 16 sub-buckets per power of two keeps every bucket within ~6% of its value
+const (
+	subBits    = 4
+	subBuckets = 1 << subBits
+	numBuckets = subBuckets * (64 - subBits + 1)
+)
+
+// Histogram records durations in log-linear buckets. The zero value is ready
+// to use; it is not safe for concurrent use.
+type Histogram struct {
+	counts   [numBuckets]int64
+	n        int64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+func bucketOf(d time.Duration) int {
+	v := uint64(d)
+	if d < 0 {
+		v = 0
+	}
+	if v < subBuckets {
+		return int(v)
+	}
+	e := bits.Len64(v) - subBits - 1
+	return subBuckets*(e+1) + int(v>>uint(e)) - subBuckets
+}
+
+func bucketLow(i int) time.Duration {
+	if i < subBuckets {
+		return time.Duration(i)
+	}
+	e := i/subBuckets - 1
+	m := uint64(i%subBuckets + subBuckets)
+	return time.Duration(m << uint(e))
+}
+
+// bucketMid is the value reported for everything that fell into bucket i
+func bucketMid(i int) time.Duration {
+	if i+1 >= numBuckets {
+		return bucketLow(i)
+	}
+	lo, hi := bucketLow(i), bucketLow(i+1)
+	return lo + (hi-lo)/2
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.counts[bucketOf(d)]++
+	h.n++
+	h.sum += d
+}
+
+// Merge adds every sample of o to h.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.n == 0 {
+		return
+	}
+	if h.n == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+}
+
+func (h *Histogram) Count() int64       { return h.n }
+func (h *Histogram) Min() time.Duration { return h.min }
+func (h *Histogram) Max() time.Duration { return h.max }
+
+func (h *Histogram) Mean() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.n)
+}
+
+// Percentile returns the value below which a fraction q (0..1) of the samples
+// fall.
+func (h *Histogram) Percentile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	if q >= 1 {
+		return h.max
+	}
+	rank := int64(q * float64(h.n))
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank {
+			d := bucketMid(i)
+			if d < h.min {
+				return h.min
+			}
+			if d > h.max {
+				return h.max
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+// CDFPoint says that a Fraction of the samples took at most Value.
+type CDFPoint struct {
+	Value    time.Duration
+	Fraction float64
+}
+
+// CDF returns one point per non-empty bucket.
+func (h *Histogram) CDF() []CDFPoint {
+	var points []CDFPoint
+	var seen int64
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		seen += c
+		v := bucketMid(i)
+		if v > h.max {
+			v = h.max
+		}
+		points = append(points, CDFPoint{v, float64(seen) / float64(h.n)})
+	}
+	return points
+}
+
+// String summarises the distribution on one line.
+func (h *Histogram) String() string {
+	return fmt.Sprintf("n=%d min=%v mean=%v p50=%v p90=%v p99=%v p99.9=%v max=%v",
+		h.n, h.min, h.Mean(), h.Percentile(0.5), h.Percentile(0.9),
+		h.Percentile(0.99), h.Percentile(0.999), h.max)
+}
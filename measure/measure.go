@@ -0,0 +1,293 @@
+/* Measurement windows for the benchmarks
+ *
+ * A Window separates a warm-up phase (connection ramp-up, gob type
+ * registration, goroutine start-up) from the steady-state phase that is
+ * actually measured. The warm-up is either a number of calls or a duration.
+ * The measured phase either runs for a fixed number of calls or for a fixed
+ * duration, and while it runs the window prints per-interval throughput so
+ * drift is visible.
+ *
+ * Basic usage:
+ *   win := measure.NewWindow(warmup, duration, totalCalls)
+ *   win.Begin()
+ *   for {
+ *       doCall()
+ *       if !win.Record(numBytes) { break }
+ *   }
+ *   res := win.Close()
+ */
+
+package measure
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	warming = iota
+	measuring
+	closed
+)
+
+// Warmup describes how long a benchmark runs before measurement starts.
+// Both limits have to be reached; zero values disable the warm-up.
+type Warmup struct {
+	Calls    int
+	Duration time.Duration
+}
+
+// String and Set make Warmup usable as a flag.Value. A plain integer is a
+// number of calls, anything else is parsed as a time.Duration.
+func (w *Warmup) String() string {
+	if w.Duration > 0 {
+		return w.Duration.String()
+	}
+	return strconv.Itoa(w.Calls)
+}
+
+func (w *Warmup) Set(s string) error {
+	if n, err := strconv.Atoi(s); err == nil {
+		w.Calls, w.Duration = n, 0
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("warmup must be a call count or a duration: %v", err)
+	}
+	w.Calls, w.Duration = 0, d
+	return nil
+}
+
+// Interval is the throughput seen during one reporting interval.
+type Interval struct {
+	Elapsed time.Duration // since the start of measurement
+	Calls   int64
+	Bytes   int64
+	Length  time.Duration
+}
+
+func (i Interval) CallsPerSec() float64 { return float64(i.Calls) / i.Length.Seconds() }
+func (i Interval) MBPerSec() float64    { return float64(i.Bytes) / 1e6 / i.Length.Seconds() }
+
+// Result summarises the measured phase of a run.
+type Result struct {
+	WarmupCalls int64
+	WarmupTime  time.Duration
+	Calls       int64
+	Bytes       int64
+	Skipped     int64 // calls that produced no result, e.g. timed out
+	Elapsed     time.Duration
+	Intervals   []Interval
+}
+
+func (r Result) CallsPerSec() float64 { return float64(r.Calls) / r.Elapsed.Seconds() }
+func (r Result) MBPerSec() float64    { return float64(r.Bytes) / 1e6 / r.Elapsed.Seconds() }
+
+// Window tracks a run through its warm-up and measurement phases. It is safe
+// for use by many goroutines.
+type Window struct {
+	// Interval between throughput reports; zero disables them
+	Interval time.Duration
+	// Out receives the interval reports
+	Out io.Writer
+
+	warmup   Warmup
+	duration time.Duration
+	target   int64
+
+	mu          sync.Mutex
+	state       int
+	began       time.Time
+	start       time.Time
+	end         time.Time
+	warmCalls   int64
+	calls       int64
+	bytes       int64
+	skipped     int64
+	lastCalls   int64
+	lastBytes   int64
+	lastTick    time.Time
+	intervals   []Interval
+	stopReports chan bool
+	reporting   sync.WaitGroup
+}
+
+// NewWindow returns a window that warms up for warmup and then measures
+// either for duration or, when duration is zero, for target calls.
+func NewWindow(warmup Warmup, duration time.Duration, target int) *Window {
+	return &Window{
+		Interval: time.Second,
+		Out:      os.Stdout,
+		warmup:   warmup,
+		duration: duration,
+		target:   int64(target),
+	}
+}
+
+// Begin starts the warm-up phase (or the measurement directly if there is no
+// warm-up).
+func (w *Window) Begin() {
+	w.mu.Lock()
+	w.began = time.Now()
+	if w.warmup.Calls <= 0 && w.warmup.Duration <= 0 {
+		w.startMeasuring(w.began)
+	}
+	w.mu.Unlock()
+
+	if w.Interval > 0 {
+		w.stopReports = make(chan bool)
+		w.reporting.Add(1)
+		go w.report()
+	}
+}
+
+// must hold w.mu
+func (w *Window) startMeasuring(now time.Time) {
+	w.state = measuring
+	w.start = now
+	w.lastTick = now
+}
+
+// Record notes one completed call carrying n bytes and reports whether the
+// caller should keep issuing calls.
+func (w *Window) Record(n int) bool {
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch w.state {
+	case warming:
+		w.warmedLocked(now)
+		return true
+	case measuring:
+		if w.duration > 0 && now.Sub(w.start) >= w.duration {
+			w.closeLocked(now)
+			return false
+		}
+		w.calls++
+		w.bytes += int64(n)
+		if w.duration <= 0 && w.calls+w.skipped >= w.target {
+			w.closeLocked(now)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// must hold w.mu; counts a warm-up call and ends the warm-up once it has
+// lasted long enough
+func (w *Window) warmedLocked(now time.Time) {
+	w.warmCalls++
+	if w.warmCalls >= int64(w.warmup.Calls) && now.Sub(w.began) >= w.warmup.Duration {
+		w.startMeasuring(now)
+	}
+}
+
+// Skip notes a call that produced no result (a timeout, say). It counts
+// towards the warm-up and the target number of calls, so a hung server
+// cannot keep a run going forever, but not towards throughput. It reports
+// whether the caller should keep issuing calls.
+func (w *Window) Skip() bool {
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch w.state {
+	case warming:
+		w.warmedLocked(now)
+		return true
+	case measuring:
+		if w.duration > 0 && now.Sub(w.start) >= w.duration {
+			w.closeLocked(now)
+			return false
+		}
+		w.skipped++
+		if w.duration <= 0 && w.calls+w.skipped >= w.target {
+			w.closeLocked(now)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Measuring reports whether calls completing now are being measured.
+func (w *Window) Measuring() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state == measuring
+}
+
+// must hold w.mu
+func (w *Window) closeLocked(now time.Time) {
+	if w.state == closed {
+		return
+	}
+	if w.state == warming {
+		w.startMeasuring(now)
+	}
+	w.state = closed
+	w.end = now
+}
+
+// Close ends the measurement (if it has not ended already) and returns the
+// result.
+func (w *Window) Close() Result {
+	w.mu.Lock()
+	w.closeLocked(time.Now())
+	w.mu.Unlock()
+
+	if w.stopReports != nil {
+		close(w.stopReports)
+		w.reporting.Wait()
+		w.stopReports = nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Result{
+		WarmupCalls: w.warmCalls,
+		WarmupTime:  w.start.Sub(w.began),
+		Calls:       w.calls,
+		Bytes:       w.bytes,
+		Skipped:     w.skipped,
+		Elapsed:     w.end.Sub(w.start),
+		Intervals:   w.intervals,
+	}
+}
+
+func (w *Window) report() {
+	defer w.reporting.Done()
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopReports:
+			return
+		case now := <-ticker.C:
+			w.mu.Lock()
+			if w.state != measuring {
+				w.mu.Unlock()
+				continue
+			}
+			iv := Interval{
+				Elapsed: now.Sub(w.start),
+				Calls:   w.calls - w.lastCalls,
+				Bytes:   w.bytes - w.lastBytes,
+				Length:  now.Sub(w.lastTick),
+			}
+			w.lastCalls, w.lastBytes, w.lastTick = w.calls, w.bytes, now
+			w.intervals = append(w.intervals, iv)
+			w.mu.Unlock()
+
+			fmt.Fprintf(w.Out, "  [%6.1fs] %10.0f calls/s %10.3f MB/s\n",
+				iv.Elapsed.Seconds(), iv.CallsPerSec(), iv.MBPerSec())
+		}
+	}
+}
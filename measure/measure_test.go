@@ -0,0 +1,168 @@
+package measure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarmupFlag(t *testing.T) {
+	var w Warmup
+	if err := w.Set("1000"); err != nil || w.Calls != 1000 || w.Duration != 0 {
+		t.Errorf("Set(1000): %+v, %v", w, err)
+	}
+	if err := w.Set("2s"); err != nil || w.Calls != 0 || w.Duration != 2*time.Second {
+		t.Errorf("Set(2s): %+v, %v", w, err)
+	}
+	if w.String() != "2s" {
+		t.Errorf("String() = %q after Set(2s)", w.String())
+	}
+	if err := w.Set("soon"); err == nil {
+		t.Error("Set(soon) accepted")
+	}
+}
+
+func newWindow(warmup Warmup, target int) *Window {
+	w := NewWindow(warmup, 0, target)
+	w.Interval = 0
+	w.Begin()
+	return w
+}
+
+// Warm-up calls are not measured, and the window closes at the target
+func TestWindowCalls(t *testing.T) {
+	w := newWindow(Warmup{Calls: 3}, 5)
+	for i := 0; i < 3; i++ {
+		if !w.Record(100) {
+			t.Fatalf("warm-up call %d stopped the run", i)
+		}
+	}
+	if !w.Measuring() {
+		t.Fatal("not measuring after 3 warm-up calls")
+	}
+	for i := 1; i <= 5; i++ {
+		if more := w.Record(10); more != (i < 5) {
+			t.Fatalf("measured call %d: Record returned %v", i, more)
+		}
+	}
+	if w.Record(10) {
+		t.Error("Record after the target kept the run going")
+	}
+	res := w.Close()
+	if res.WarmupCalls != 3 || res.Calls != 5 || res.Bytes != 50 {
+		t.Errorf("got %+v, want 3 warm-up calls and 5 measured of 50 bytes", res)
+	}
+}
+
+// Skipped calls count towards the warm-up and the target, not throughput
+func TestWindowSkip(t *testing.T) {
+	w := newWindow(Warmup{Calls: 2}, 4)
+	w.Skip()
+	w.Skip()
+	if !w.Measuring() {
+		t.Fatal("skipped calls did not end the warm-up")
+	}
+	w.Record(1)
+	w.Skip()
+	w.Record(1)
+	if w.Skip() {
+		t.Error("the run went on past its target")
+	}
+	res := w.Close()
+	if res.Calls != 2 || res.Skipped != 2 || res.Bytes != 2 {
+		t.Errorf("got %+v, want 2 measured and 2 skipped calls", res)
+	}
+}
+
+// A duration-bound window stops the first call completing after it
+func TestWindowDuration(t *testing.T) {
+	w := NewWindow(Warmup{}, 20*time.Millisecond, 0)
+	w.Interval = 5 * time.Millisecond
+	w.Out = testWriter{t}
+	w.Begin()
+	calls := 0
+	for w.Record(1) {
+		calls++
+		time.Sleep(time.Millisecond)
+	}
+	res := w.Close()
+	if res.Calls != int64(calls) || res.Elapsed < 20*time.Millisecond {
+		t.Errorf("got %+v after %d calls, want them measured over at least 20ms", res, calls)
+	}
+	if len(res.Intervals) == 0 {
+		t.Error("no intervals reported")
+	}
+}
+
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(b []byte) (int, error) {
+	w.t.Log(string(b))
+	return len(b), nil
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	if h.Count() != 1000 || h.Min() != time.Microsecond || h.Max() != time.Millisecond {
+		t.Fatalf("count %d min %v max %v", h.Count(), h.Min(), h.Max())
+	}
+	if mean := h.Mean(); mean != 500500*time.Nanosecond {
+		t.Errorf("mean %v, want 500.5µs", mean)
+	}
+	// buckets are within ~6% of their values
+	for _, c := range []struct {
+		q    float64
+		want time.Duration
+	}{{0.5, 500 * time.Microsecond}, {0.9, 900 * time.Microsecond}, {0.99, 990 * time.Microsecond}} {
+		got := h.Percentile(c.q)
+		if diff := got - c.want; diff < -c.want/16 || diff > c.want/16 {
+			t.Errorf("p%v = %v, want about %v", c.q*100, got, c.want)
+		}
+	}
+	if h.Percentile(1) != time.Millisecond {
+		t.Errorf("p100 = %v, want the max", h.Percentile(1))
+	}
+	cdf := h.CDF()
+	if last := cdf[len(cdf)-1]; last.Fraction != 1 || last.Value > h.Max() {
+		t.Errorf("CDF ends at %+v", last)
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	var a, b, empty Histogram
+	a.Record(5 * time.Millisecond)
+	b.Record(time.Millisecond)
+	b.Record(9 * time.Millisecond)
+	a.Merge(&b)
+	a.Merge(&empty)
+	if a.Count() != 3 || a.Min() != time.Millisecond || a.Max() != 9*time.Millisecond || a.Mean() != 5*time.Millisecond {
+		t.Errorf("merged: %v", &a)
+	}
+}
+
+func TestBySize(t *testing.T) {
+	var s, o BySize
+	s.Record(10, time.Millisecond)
+	s.Record(64, time.Millisecond)
+	s.Record(65, 2*time.Millisecond)
+	o.Record(1<<20, 10*time.Millisecond)
+	s.Merge(&o)
+	var names []string
+	for _, b := range s.Buckets() {
+		names = append(names, b.Name())
+	}
+	want := []string{"<=64B", "<=256B", "<=1MiB"}
+	if len(names) != len(want) {
+		t.Fatalf("buckets %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("buckets %v, want %v", names, want)
+		}
+	}
+	if b := s.Buckets()[0]; b.Latency.Count() != 2 || b.Bytes != 74 {
+		t.Errorf("<=64B holds %d messages of %d bytes, want 2 of 74", b.Latency.Count(), b.Bytes)
+	}
+}
@@ -4,6 +4,14 @@
   * go install gorpc-tests/paxos
   * ./start.sh # starts acceptors
   * time paxos -prop # starts and times proposer
+  * time paxos -prop -timeout=1s # gives up if an acceptor stops answering
+  * time paxos -prop -cpuprofile=prop.prof # also -memprofile, -blockprofile,
+  *                                        # -mutexprofile, -trace and -pprof
+  * go test gorpc-tests/paxos # checks the acceptor rules
+  * go test -bench . gorpc-tests/paxos # times a round against in-process
+  *                                    # acceptors, per codec
+  * CODEC=compress ./start.sh; paxos -prop -codec=compress # any codec.Names
+  *                                                        # codec, both ends
   *
   * To change the number of machines involved change the F constant below
   * and update start.sh to start up 2F acceptors 
@@ -29,6 +37,10 @@ import (
     "io/ioutil"
     "time"
     "os"
+    "gorpc-tests/codec"
+    "gorpc-tests/rpcctx"
+    "gorpc-tests/profiling"
+    "gorpc-tests/results"
 )
 
 const (
@@ -45,7 +57,17 @@ var portNumber int
 // array of client connections (the proposer's connections to acceptors)
 var clients [NACCEPTORS]*rpc.Client
 
-var startIter int = -1
+// bounds every proposer call when -timeout is set
+var tracker *rpcctx.Tracker
+
+// the codec acceptors serve and the proposer dials with
+var codecName = "gob"
+
+// profiling for this process
+var session *profiling.Session
+
+// where the run's numbers are stored
+var store *results.Flags
 
 type Value int64
 
@@ -123,7 +145,7 @@ func maxNumber(n1, n2 Number) Number {
     return n1
 }
 
-func (a AcceptorState) reset(newIter int) {
+func (a *AcceptorState) reset(newIter int) {
     a.V_a = nil;
     a.N_a = Number{newIter, 0};
     a.N_l = Number{newIter, 0};
@@ -145,7 +167,12 @@ func acceptorRun(ln net.Listener) {
         if err != nil {
             continue
         }
-        rpc.ServeConn(c)
+        sc, err := codec.NewServer(codecName, c, codec.DefaultOptions())
+        if err != nil {
+            c.Close()
+            continue
+        }
+        rpc.ServeCodec(sc)
     }
 }
 
@@ -154,7 +181,12 @@ func proposerInit() {
     // we assume clients are connected on sequential ports, starting at PORTBASE
     for i := 0; i < NACCEPTORS; i++ {
         p := PORTBASE + i
-        c, err := rpc.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p))
+        conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p))
+        if err != nil {
+            fmt.Println(err)
+            return
+        }
+        c, err := codec.Client(codecName, conn, codec.DefaultOptions())
         if err != nil {
             fmt.Println(err)
             return
@@ -181,12 +213,8 @@ func accepted(n *Number) bool {
         for i := 0; i < NACCEPTORS; i++ {
             clients[i].Go("Acceptor.Decided", pstate.V_o, nil, nil);
         }
-        // start next iteration
+        // the next proposal is for the next iteration
         pstate.N_p.IterN++
-        if (pstate.N_p.IterN - startIter) >= MAX_ITER {
-            os.Exit(0)
-        }
-        go propose()
         return true
     }
     return false
@@ -213,13 +241,7 @@ func prepared(nv *NV) bool {
             pstate.V_o = chooseVal()
         }
         pstate.A = 0
-        // so we can run MAX_ITER iterations even if we start at a nonzero
-        // iteration number 
-        if startIter == -1 {
-            startIter = pstate.N_o.IterN
-        }
         pstate.N_p = maxNumber(pstate.N_p, pstate.N_o)
-        go sendAccepts()
         return true
     }
     return false
@@ -228,14 +250,27 @@ func prepared(nv *NV) bool {
 func sendAndRecv(msg string, args interface{}, newReply func()(interface{}), handler func(reply interface{})(bool)) {
     var calls []*rpc.Call
     for i := 0; i < F+1; i++ {
-        call := clients[i].Go(msg, args, newReply(), nil)
+        var call *rpc.Call
+        if tracker != nil {
+            call = tracker.Go(clients[i], msg, args, newReply(), nil)
+        } else {
+            call = clients[i].Go(msg, args, newReply(), nil)
+        }
         calls = append(calls, call)
     }
 
-    for _, call := range calls {
+    for i, call := range calls {
         <-call.Done
+        if rpcctx.IsTimeout(call.Error) {
+            // every one of the F+1 replies is needed, so the round cannot finish
+            fmt.Printf("%s to acceptor %d timed out in iteration %d\n", msg, i, pstate.N_p.IterN)
+            tracker.Report(os.Stdout)
+            profiling.Exit(1)
+        }
         if call.Error != nil {
-            log.Fatal("message error")
+            // log is discarded unless DEBUG, and log.Fatal skips the profiles
+            fmt.Printf("%s to acceptor %d failed: %v\n", msg, i, call.Error)
+            profiling.Exit(1)
         }
         if handler(call.Reply) {
             break
@@ -252,7 +287,8 @@ func sendAndRecv(msg string, args interface{}, newReply func()(interface{}), han
         select {
         case <- calls[i].Done:
             if calls[i].Error != nil {
-                log.Fatal("message error");
+                fmt.Printf("%s to acceptor %d failed: %v\n", msg, i, calls[i].Error)
+                profiling.Exit(1)
             }
             reply := calls[i].Reply
             if handler(reply) {
@@ -265,6 +301,8 @@ func sendAndRecv(msg string, args interface{}, newReply func()(interface{}), han
 
 }
 
+// propose runs one iteration: prepare and accept on F+1 acceptors, then
+// tell them all the decided value
 func propose() {
     log.Printf("starting proposal\n")
     // only 1 proposer so no uniqueifier
@@ -277,6 +315,23 @@ func propose() {
     handler := func (reply interface{}) bool { return prepared(reply.(*NV)) }
 
     sendAndRecv("Acceptor.Prepare", &pstate.N_p, constructor, handler)
+    sendAccepts()
+}
+
+// proposeAll runs MAX_ITER iterations back to back and reports their rate
+func proposeAll() {
+    before := profiling.Snapshot()
+    for i := 0; i < MAX_ITER; i++ {
+        propose()
+    }
+    delta := profiling.Snapshot().Sub(before)
+    delta.Report(os.Stdout, MAX_ITER)
+    run := results.New("paxos")
+    run.Param("F", F)
+    run.Param("codec", codecName)
+    run.Add("decisions", "decisions/s", true, MAX_ITER/delta.Elapsed.Seconds())
+    run.AddRuntime(delta, MAX_ITER)
+    store.Save(run)
 }
 
 func main() {
@@ -287,21 +342,34 @@ func main() {
 
     boolP := flag.Bool("prop", false, "run as proposer")
     portP := flag.Int("p", 9000, "port number")
+    timeout := flag.Duration("timeout", 0, "proposer gives up if an acceptor takes longer than this (0 waits forever)")
+    flag.StringVar(&codecName, "codec", "gob", fmt.Sprintf("codec acceptors serve and the proposer dials with, one of %v", codec.Names))
+    prof := profiling.AddFlags()
+    store = results.AddFlags()
     flag.Parse()
+    if err := codec.Check(codecName); err != nil {
+        fmt.Println(err)
+        profiling.Exit(1)
+    }
+    session = prof.Start()
+    session.StopOnInterrupt()
+
+    if *timeout > 0 {
+        tracker = rpcctx.NewTracker(*timeout)
+    }
 
     portNumber = *portP
 
     ln := acceptorInit()
     if ln == nil {
-        os.Exit(1)
+        profiling.Exit(1)
     }
 
     if *boolP {
         go acceptorRun(ln)
         proposerInit()
-        go propose()
-        // don't exit
-        <-make(chan int)
+        proposeAll()
+        session.Stop()
     } else {
         acceptorRun(ln)
     }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"testing"
+
+	"gorpc-tests/codec"
+)
+
+func TestMain(m *testing.M) {
+	if !DEBUG {
+		// as in main, every message is logged
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// Points every proposer client at one in-process acceptor server and resets
+// the protocol state. The acceptors share astate, so a round costs what it
+// does across processes, minus the network.
+func startRounds(t testing.TB, codecName string) {
+	server := rpc.NewServer()
+	server.Register(new(Acceptor))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go codec.Accept(server, l, codecName, codec.DefaultOptions())
+	astate = AcceptorState{}
+	pstate = ProposerState{}
+	for i := 0; i < NACCEPTORS; i++ {
+		c, err := codec.Dial("tcp", l.Addr().String(), codecName, codec.DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		clients[i] = c
+	}
+}
+
+// One Paxos iteration: prepare and accept to F+1 acceptors, then decided
+func BenchmarkRound(b *testing.B) {
+	for _, codecName := range codec.Names {
+		b.Run("codec="+codecName, func(b *testing.B) {
+			startRounds(b, codecName)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				propose()
+			}
+		})
+	}
+}
+
+func resetAcceptor() {
+	astate = AcceptorState{}
+}
+
+func prepare(n Number) NV {
+	var reply NV
+	new(Acceptor).Prepare(&n, &reply)
+	return reply
+}
+
+func accept(n Number, v Value) Number {
+	var reply Number
+	new(Acceptor).Accept(&NV{n, &v}, &reply)
+	return reply
+}
+
+// A prepare only ever raises the acceptor's promise
+func TestPreparePromise(t *testing.T) {
+	resetAcceptor()
+	prepare(Number{0, 2})
+	prepare(Number{0, 1})
+	if astate.N_l != (Number{0, 2}) {
+		t.Errorf("promise %v after preparing 2 then 1, want {0 2}", astate.N_l)
+	}
+}
+
+// A prepare answers with the highest proposal accepted so far
+func TestPrepareReportsAccepted(t *testing.T) {
+	resetAcceptor()
+	accept(Number{0, 3}, 42)
+	reply := prepare(Number{0, 4})
+	if reply.N != (Number{0, 3}) || reply.V == nil || *reply.V != 42 {
+		t.Errorf("prepare replied %v, want {0 3} with value 42", reply)
+	}
+}
+
+// An accept below the promise is refused and changes nothing; one at the
+// promise is taken
+func TestAcceptRule(t *testing.T) {
+	resetAcceptor()
+	prepare(Number{0, 5})
+	if n := accept(Number{0, 4}, 7); n == (Number{0, 4}) {
+		t.Error("accepted a proposal below the promise")
+	}
+	if astate.V_a != nil {
+		t.Errorf("refused accept stored value %d", *astate.V_a)
+	}
+	if n := accept(Number{0, 5}, 8); n != (Number{0, 5}) {
+		t.Errorf("accept at the promise replied %v, want {0 5}", n)
+	}
+	if astate.V_a == nil || *astate.V_a != 8 {
+		t.Error("accepted value not stored")
+	}
+}
+
+// A prepare for a later iteration forgets the previous iteration's value
+func TestNewIteration(t *testing.T) {
+	resetAcceptor()
+	accept(Number{0, 1}, 9)
+	reply := prepare(Number{1, 1})
+	if reply.V != nil {
+		t.Errorf("iteration 1 prepare reported iteration 0's value %d", *reply.V)
+	}
+	if reply.N.IterN != 1 {
+		t.Errorf("iteration 1 prepare reported number %v", reply.N)
+	}
+}
+
+// A full round over RPC decides the proposer's value on the acceptors, with
+// the stock codec and with compression negotiated underneath the Acceptor
+func TestRound(t *testing.T) {
+	for _, codecName := range []string{"gob", "compress"} {
+		t.Run(codecName, func(t *testing.T) {
+			startRounds(t, codecName)
+			propose()
+			if pstate.V_o == nil || astate.V_a == nil || *astate.V_a != *pstate.V_o {
+				t.Error("acceptors did not accept the proposed value")
+			}
+		})
+	}
+}
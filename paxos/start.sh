@@ -1,4 +1,4 @@
 for P in {9001..9010}
 do
-    paxos -p=$P &
-done
\ No newline at end of file
+    paxos -p=$P -codec=${CODEC:-gob} &
+done
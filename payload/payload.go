@@ -0,0 +1,265 @@
+/* Payload generators
+ *
+ * What a benchmark sends matters as much as how much of it: zeros compress
+ * to nothing, random bytes not at all, and Snappy's win over raw blocks
+ * depends entirely on which of the two the data resembles. Every generator
+ * fills an exact number of bytes and, except random, is deterministic, so
+ * two runs send the same bytes:
+ *
+ *   random   crypto/rand bytes, incompressible
+ *   zeros    all zero bytes
+ *   pattern  byte(i), as windowedThroughput always sent
+ *   text     English-like prose, words drawn with Zipf frequencies
+ *   gob      a gob stream of nested records (cut at the size asked for)
+ *   json     the same records as JSON lines
+ *   file:F   the contents of file F, repeated to length
+ *
+ * Ratio and DeflateRatio report how well a payload compresses, for the
+ * results of a run.
+ *
+ * Basic usage:
+ *   flag.StringVar(&kind, "payload", "zeros", payload.Usage)
+ *   data, err := payload.Generate(kind, 4096)
+ *   run.Add("payload-ratio", "snappy/raw", false, payload.Ratio(data))
+ */
+
+package payload
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"strings"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// Kinds are the generators Generate takes, besides file:F.
+var Kinds = []string{"random", "zeros", "pattern", "text", "gob", "json"}
+
+// Usage describes -payload for a flag.
+var Usage = fmt.Sprintf("payload content: one of %v, or file:F", Kinds)
+
+// Check reports whether kind names a generator, so a bad flag fails before
+// a run starts.
+func Check(kind string) error {
+	if strings.HasPrefix(kind, "file:") {
+		return nil
+	}
+	for _, k := range Kinds {
+		if k == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown payload %q, want one of %v or file:F", kind, Kinds)
+}
+
+// Generate returns n bytes of the given kind.
+func Generate(kind string, n int) ([]byte, error) {
+	if err := Check(kind); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	switch {
+	case kind == "random":
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+	case kind == "zeros":
+	case kind == "pattern":
+		for i := range b {
+			b[i] = byte(i)
+		}
+	case kind == "text":
+		fill(b, text)
+	case kind == "gob":
+		fill(b, gobRecords)
+	case kind == "json":
+		fill(b, jsonRecords)
+	case strings.HasPrefix(kind, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(kind, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 && n > 0 {
+			return nil, fmt.Errorf("payload %s: empty file", kind)
+		}
+		for i := 0; i < n; i += len(data) {
+			copy(b[i:], data)
+		}
+	}
+	return b, nil
+}
+
+// A generator starts writing a payload to w and returns the function that
+// writes its next piece.
+type generator func(w *bytes.Buffer, rng *mrand.Rand) func()
+
+// fill writes what start's generator produces into b until it is full. It
+// is seeded the same way every time, so the bytes only depend on len(b).
+func fill(b []byte, start generator) {
+	var w bytes.Buffer
+	next := start(&w, mrand.New(mrand.NewSource(1)))
+	for w.Len() < len(b) {
+		next()
+	}
+	copy(b, w.Bytes())
+}
+
+func capitalize(s string) string {
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+var words = strings.Fields(`the of and to a in that it is was he for on are as
+with his they at be this from have or by one had not but what all were when we
+there can an your which their said if do will each about how up out them then
+she many some so these would other into has more her two like him see time
+could no make than first been its who now people my made over did down only
+way find use may water long little very after words called just where most
+know get through back much before go good new write our used me man too any
+day same right look think also around another came come work three word must
+because does part even place well such here take why things help put years
+different away again off went old number great tell men say small every found
+still between name should home big give air line set own under read last
+never us left end along while might next sound below saw something thought
+both few those always looked show large often together asked house world going
+want school important until form food keep children feet land side without boy
+once animals life enough took sometimes four head above kind began almost live
+page got earth need far hand high year mother light parts country father let
+night following picture being study second eyes soon times story boys since
+white days ever paper hard near sentence better best across during today
+others however sure means knew whale ship sea captain`)
+
+// text writes English-like prose a sentence at a time: Zipf-distributed
+// words, so a few are very common, as in real text.
+func text(w *bytes.Buffer, rng *mrand.Rand) func() {
+	zipf := mrand.NewZipf(rng, 1.1, 2, uint64(len(words)-1))
+	return func() { sentence(w, rng, zipf) }
+}
+
+func sentence(w *bytes.Buffer, rng *mrand.Rand, zipf *mrand.Zipf) {
+	n := 4 + rng.Intn(14)
+	for i := 0; i < n; i++ {
+		word := words[zipf.Uint64()]
+		if i == 0 {
+			word = capitalize(word)
+		} else {
+			w.WriteByte(' ')
+		}
+		w.WriteString(word)
+		if i < n-1 && rng.Intn(10) == 0 {
+			w.WriteByte(',')
+		}
+	}
+	w.WriteString(".")
+	if rng.Intn(5) == 0 {
+		w.WriteString("\n\n")
+	} else {
+		w.WriteByte(' ')
+	}
+}
+
+// Record is the structured payload: a typical API object with nested
+// structs and slices. Attributes are a slice rather than a map so gob
+// writes them in the same order every time.
+type Record struct {
+	ID      int64
+	Name    string
+	Active  bool
+	Score   float64
+	Tags    []string
+	Attrs   []Attr
+	Owner   Person
+	Items   []Item
+	Created int64 // Unix seconds
+}
+
+type Person struct {
+	Name  string
+	Email string
+	Age   int
+}
+
+type Attr struct {
+	Key, Value string
+}
+
+type Item struct {
+	SKU   string
+	Qty   int
+	Price float64
+}
+
+func word(rng *mrand.Rand) string {
+	return words[rng.Intn(len(words))]
+}
+
+func newRecord(rng *mrand.Rand) *Record {
+	r := &Record{
+		ID:      rng.Int63n(1 << 40),
+		Name:    word(rng) + " " + word(rng),
+		Active:  rng.Intn(2) == 0,
+		Score:   float64(rng.Intn(100000)) / 100,
+		Created: 1.4e9 + rng.Int63n(3e8),
+	}
+	for i := rng.Intn(5); i >= 0; i-- {
+		r.Tags = append(r.Tags, word(rng))
+	}
+	for i := rng.Intn(4); i >= 0; i-- {
+		r.Attrs = append(r.Attrs, Attr{word(rng), word(rng)})
+	}
+	name := word(rng)
+	r.Owner = Person{Name: capitalize(name), Email: name + "@example.com", Age: 18 + rng.Intn(60)}
+	for i := rng.Intn(6); i >= 0; i-- {
+		r.Items = append(r.Items, Item{
+			SKU:   fmt.Sprintf("%s-%05d", strings.ToUpper(word(rng)), rng.Intn(100000)),
+			Qty:   1 + rng.Intn(20),
+			Price: float64(rng.Intn(100000)) / 100,
+		})
+	}
+	return r
+}
+
+// gobRecords writes one gob stream, so the type is sent once, as on an RPC
+// connection.
+func gobRecords(w *bytes.Buffer, rng *mrand.Rand) func() {
+	enc := gob.NewEncoder(w)
+	return func() { enc.Encode(newRecord(rng)) }
+}
+
+// jsonRecords writes one record per line.
+func jsonRecords(w *bytes.Buffer, rng *mrand.Rand) func() {
+	enc := json.NewEncoder(w)
+	return func() { enc.Encode(newRecord(rng)) }
+}
+
+// Ratio is the size of b encoded with Snappy over its own size: near 0 for
+// zeros, about 1 for random bytes.
+func Ratio(b []byte) float64 {
+	if len(b) == 0 {
+		return 1
+	}
+	enc, err := snappy.Encode(nil, b)
+	if err != nil {
+		return 1
+	}
+	return float64(len(enc)) / float64(len(b))
+}
+
+// DeflateRatio is Ratio for DEFLATE at its fastest level, a second opinion
+// that does not depend on the snappy package.
+func DeflateRatio(b []byte) float64 {
+	if len(b) == 0 {
+		return 1
+	}
+	var out bytes.Buffer
+	zw, _ := flate.NewWriter(&out, flate.BestSpeed)
+	zw.Write(b)
+	zw.Close()
+	return float64(out.Len()) / float64(len(b))
+}
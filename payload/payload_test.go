@@ -0,0 +1,96 @@
+package payload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Every kind fills exactly the bytes asked for, and all but random the same
+// bytes every time
+func TestGenerate(t *testing.T) {
+	for _, kind := range Kinds {
+		for _, n := range []int{0, 1, 1000, 100000} {
+			a, err := Generate(kind, n)
+			if err != nil {
+				t.Fatalf("%s: %v", kind, err)
+			}
+			if len(a) != n {
+				t.Errorf("%s: %d bytes, want %d", kind, len(a), n)
+			}
+			b, _ := Generate(kind, n)
+			if kind != "random" && !bytes.Equal(a, b) {
+				t.Errorf("%s: two payloads of %d bytes differ", kind, n)
+			}
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	b, _ := Generate("pattern", 300)
+	for i, c := range b {
+		if c != byte(i) {
+			t.Fatalf("byte %d is %d", i, c)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p")
+	if err := ioutil.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Generate("file:"+path, 7)
+	if err != nil || string(b) != "abcabca" {
+		t.Errorf("file payload %q, %v, want abcabca", b, err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty")
+	ioutil.WriteFile(empty, nil, 0644)
+	if _, err := Generate("file:"+empty, 1); err == nil {
+		t.Error("an empty file filled a payload")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check("file:anything"); err != nil {
+		t.Error(err)
+	}
+	if err := Check("noise"); err == nil {
+		t.Error("Check(noise) accepted")
+	}
+	if _, err := Generate("noise", 10); err == nil {
+		t.Error("Generate(noise) accepted")
+	}
+}
+
+// The kinds compress as the package doc says they do
+func TestDeflateRatio(t *testing.T) {
+	ratio := func(kind string) float64 {
+		b, err := Generate(kind, 64<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return DeflateRatio(b)
+	}
+	if r := ratio("zeros"); r > 0.01 {
+		t.Errorf("zeros: ratio %.3f", r)
+	}
+	if r := ratio("random"); r < 0.99 {
+		t.Errorf("random: ratio %.3f", r)
+	}
+	if r := ratio("text"); r < 0.2 || r > 0.6 {
+		t.Errorf("text: ratio %.3f, want prose-like", r)
+	}
+	if DeflateRatio(nil) != 1 || Ratio(nil) != 1 {
+		t.Error("an empty payload does not have ratio 1")
+	}
+}
+
+func TestText(t *testing.T) {
+	b, _ := Generate("text", 4096)
+	if words := strings.Fields(string(b)); len(words) < 400 {
+		t.Errorf("%d words in 4KB of text", len(words))
+	}
+}
@@ -0,0 +1,299 @@
+/* Profiling for the benchmarks
+ *
+ * AddFlags registers the same profiling flags on every benchmark:
+ *
+ *   -cpuprofile file    CPU profile for the whole run
+ *   -memprofile file    heap profile written at the end
+ *   -blockprofile file  blocking profile (records every blocking event)
+ *   -mutexprofile file  mutex contention profile (records every event)
+ *   -trace file         execution trace
+ *   -pprof addr         serve net/http/pprof on addr while running
+ *
+ * and Start/Stop turn them on and write the files; Exit stops the running
+ * session before exiting, so error paths keep their profiles too.
+ * Independently of the flags, Snapshot and Delta summarise GC pauses,
+ * allocations per call and goroutine counts over the measured part of a run. Allocations come from
+ * runtime/metrics, so ReadAllocs is cheap enough to call around single calls.
+ *
+ * Basic usage:
+ *   prof := profiling.AddFlags()
+ *   flag.Parse()
+ *   sess := prof.Start()
+ *   defer sess.Stop()
+ *   before := profiling.Snapshot()
+ *   ... run ...
+ *   profiling.Snapshot().Sub(before).Report(os.Stdout, calls)
+ */
+
+package profiling
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Flags struct {
+	CPUProfile   string
+	MemProfile   string
+	BlockProfile string
+	MutexProfile string
+	Trace        string
+	HTTPAddr     string
+}
+
+// AddFlags registers the profiling flags on flag.CommandLine.
+func AddFlags() *Flags {
+	f := new(Flags)
+	flag.StringVar(&f.CPUProfile, "cpuprofile", "", "write a CPU profile to this file")
+	flag.StringVar(&f.MemProfile, "memprofile", "", "write a heap profile to this file at the end")
+	flag.StringVar(&f.BlockProfile, "blockprofile", "", "write a blocking profile to this file at the end")
+	flag.StringVar(&f.MutexProfile, "mutexprofile", "", "write a mutex contention profile to this file at the end")
+	flag.StringVar(&f.Trace, "trace", "", "write an execution trace to this file")
+	flag.StringVar(&f.HTTPAddr, "pprof", "", "serve net/http/pprof on this address (e.g. localhost:6060)")
+	return f
+}
+
+type Session struct {
+	flags    *Flags
+	cpu, tr  *os.File
+	stopOnce sync.Once
+}
+
+// the session Start began, for Exit
+var running struct {
+	sync.Mutex
+	s *Session
+}
+
+// Start turns on everything the flags asked for. Failing to create a
+// profile file is fatal, like any other bad flag.
+func (f *Flags) Start() *Session {
+	s := &Session{flags: f}
+	running.Lock()
+	running.s = s
+	running.Unlock()
+	if f.CPUProfile != "" {
+		s.cpu = create(f.CPUProfile)
+		if err := pprof.StartCPUProfile(s.cpu); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if f.Trace != "" {
+		s.tr = create(f.Trace)
+		if err := trace.Start(s.tr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if f.BlockProfile != "" {
+		runtime.SetBlockProfileRate(1)
+	}
+	if f.MutexProfile != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+	if f.HTTPAddr != "" {
+		go func() {
+			// log output is often discarded, so say it on stderr
+			if err := http.ListenAndServe(f.HTTPAddr, nil); err != nil {
+				fmt.Fprintln(os.Stderr, "pprof server:", err)
+			}
+		}()
+	}
+	return s
+}
+
+func create(name string) *os.File {
+	file, err := os.Create(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return file
+}
+
+func writeProfile(name, file string) {
+	out := create(file)
+	defer out.Close()
+	if err := pprof.Lookup(name).WriteTo(out, 0); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Stop ends the CPU profile and trace and writes the other profiles. It is
+// safe to call more than once, e.g. deferred and before an os.Exit.
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() {
+		if s.cpu != nil {
+			pprof.StopCPUProfile()
+			s.cpu.Close()
+		}
+		if s.tr != nil {
+			trace.Stop()
+			s.tr.Close()
+		}
+		if s.flags.MemProfile != "" {
+			runtime.GC()
+			writeProfile("heap", s.flags.MemProfile)
+		}
+		if s.flags.BlockProfile != "" {
+			writeProfile("block", s.flags.BlockProfile)
+		}
+		if s.flags.MutexProfile != "" {
+			writeProfile("mutex", s.flags.MutexProfile)
+		}
+	})
+}
+
+// StopOnInterrupt writes the profiles and exits when the process is
+// interrupted, for servers that otherwise never return.
+func (s *Session) StopOnInterrupt() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		s.Stop()
+		os.Exit(0)
+	}()
+}
+
+// Exit stops the running session, if any, writing its profiles, and exits
+// with code. A deferred Stop does not run on os.Exit or log.Fatal.
+func Exit(code int) {
+	running.Lock()
+	s := running.s
+	running.Unlock()
+	if s != nil {
+		s.Stop()
+	}
+	os.Exit(code)
+}
+
+// Allocs is the process's heap allocation so far.
+type Allocs struct {
+	Bytes, Objects uint64
+}
+
+var allocMetrics = []string{"/gc/heap/allocs:bytes", "/gc/heap/allocs:objects"}
+
+func ReadAllocs() Allocs {
+	samples := make([]metrics.Sample, len(allocMetrics))
+	for i, name := range allocMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	return Allocs{samples[0].Value.Uint64(), samples[1].Value.Uint64()}
+}
+
+func (a Allocs) Sub(before Allocs) Allocs {
+	return Allocs{a.Bytes - before.Bytes, a.Objects - before.Objects}
+}
+
+// Report prints allocation per call; who says whose allocations they are.
+func (a Allocs) Report(w io.Writer, who string, calls int64) {
+	if calls > 0 {
+		fmt.Fprintf(w, "Allocations (%s): %.1f allocs/call, %.0f bytes/call (%d calls)\n",
+			who, float64(a.Objects)/float64(calls), float64(a.Bytes)/float64(calls), calls)
+	} else {
+		fmt.Fprintf(w, "Allocations (%s): %d allocs, %d bytes\n", who, a.Objects, a.Bytes)
+	}
+}
+
+// RuntimeStats is a point-in-time reading of the runtime.
+type RuntimeStats struct {
+	When       time.Time
+	Mem        runtime.MemStats
+	Allocs     Allocs
+	Goroutines int
+}
+
+func Snapshot() RuntimeStats {
+	s := RuntimeStats{When: time.Now(), Goroutines: runtime.NumGoroutine()}
+	runtime.ReadMemStats(&s.Mem)
+	s.Allocs = ReadAllocs()
+	return s
+}
+
+// Delta is what happened in the runtime between two snapshots.
+type Delta struct {
+	Elapsed          time.Duration
+	NumGC            uint32
+	PauseTotal       time.Duration
+	Pauses           []time.Duration // of the last (up to 256) GCs in the interval
+	Allocs           Allocs
+	GoroutinesBefore int
+	GoroutinesAfter  int
+}
+
+// Sub returns the change from before to s.
+func (s RuntimeStats) Sub(before RuntimeStats) Delta {
+	d := Delta{
+		Elapsed:          s.When.Sub(before.When),
+		NumGC:            s.Mem.NumGC - before.Mem.NumGC,
+		PauseTotal:       time.Duration(s.Mem.PauseTotalNs - before.Mem.PauseTotalNs),
+		Allocs:           s.Allocs.Sub(before.Allocs),
+		GoroutinesBefore: before.Goroutines,
+		GoroutinesAfter:  s.Goroutines,
+	}
+	n := int(d.NumGC)
+	if n > len(s.Mem.PauseNs) {
+		n = len(s.Mem.PauseNs)
+	}
+	// PauseNs is a ring buffer indexed by (NumGC+255)%256
+	for i := 0; i < n; i++ {
+		idx := (int(s.Mem.NumGC) - 1 - i + len(s.Mem.PauseNs)) % len(s.Mem.PauseNs)
+		d.Pauses = append(d.Pauses, time.Duration(s.Mem.PauseNs[idx]))
+	}
+	return d
+}
+
+func (d Delta) MaxPause() time.Duration {
+	var max time.Duration
+	for _, p := range d.Pauses {
+		if p > max {
+			max = p
+		}
+	}
+	return max
+}
+
+// PausePercentile is taken over the recorded Pauses.
+func (d Delta) PausePercentile(q float64) time.Duration {
+	if len(d.Pauses) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), d.Pauses...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Report prints the summary, with the process's allocations divided over
+// calls.
+func (d Delta) Report(w io.Writer, calls int64) {
+	d.ReportAs(w, "process", calls)
+}
+
+// ReportAs is Report with the allocations attributed to who, e.g. to say a
+// client and server share the process.
+func (d Delta) ReportAs(w io.Writer, who string, calls int64) {
+	fmt.Fprintf(w, "GC: %d cycles, %v total pause (%.3f%% of %v), p50 %v, max %v\n",
+		d.NumGC, d.PauseTotal, 100*d.PauseTotal.Seconds()/d.Elapsed.Seconds(), d.Elapsed,
+		d.PausePercentile(0.5), d.MaxPause())
+	d.Allocs.Report(w, who, calls)
+	fmt.Fprintf(w, "Goroutines: %d before, %d after\n", d.GoroutinesBefore, d.GoroutinesAfter)
+}
@@ -0,0 +1,40 @@
+package profiling
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var sink []byte
+
+func TestDelta(t *testing.T) {
+	before := Snapshot()
+	for i := 0; i < 1000; i++ {
+		sink = make([]byte, 1024)
+	}
+	runtime.GC()
+	d := Snapshot().Sub(before)
+	if d.Allocs.Objects < 1000 || d.Allocs.Bytes < 1000*1024 {
+		t.Errorf("%d allocations of %d bytes, want at least 1000 of 1KiB", d.Allocs.Objects, d.Allocs.Bytes)
+	}
+	if d.NumGC == 0 || len(d.Pauses) != int(d.NumGC) || d.Elapsed <= 0 {
+		t.Errorf("%d GCs, %d pauses over %v", d.NumGC, len(d.Pauses), d.Elapsed)
+	}
+	var out strings.Builder
+	d.ReportAs(&out, "client and server", 1000)
+	if !strings.Contains(out.String(), "Allocations (client and server):") {
+		t.Errorf("reported\n%s", out.String())
+	}
+}
+
+func TestPauses(t *testing.T) {
+	d := Delta{Pauses: []time.Duration{3, 1, 4, 1, 5}}
+	if d.MaxPause() != 5 || d.PausePercentile(0.5) != 3 || d.PausePercentile(1) != 5 {
+		t.Errorf("max %v, p50 %v, p100 %v", d.MaxPause(), d.PausePercentile(0.5), d.PausePercentile(1))
+	}
+	if (Delta{}).PausePercentile(0.5) != 0 {
+		t.Error("a pause without GCs")
+	}
+}
@@ -0,0 +1,356 @@
+/* Replicated blocks with quorum reads and hash-based repair
+ *
+ * Replicas keeps every block on R of a set of servers, each running a
+ * Store. Put sends a block to all R and succeeds once a majority has it.
+ * Get asks all R and returns as soon as Quorum of them (a majority by
+ * default) hand back copies with the same hash that match their data, so
+ * one slow or dead replica costs a read nothing. The other replies are
+ * still collected: a copy that is missing, fails its own hash or differs
+ * from the majority's is divergent and is overwritten with the majority's
+ * copy in the background. A replica that does not answer (down, or slower
+ * than Timeout) is counted as degraded, not repaired.
+ *
+ * Chunk has DataChunk's fields, so the DFS server and client can send
+ * either as the other.
+ *
+ * Basic usage:
+ *   server:  rpcServer.RegisterName("Blocks", replica.NewStore())
+ *   client:  r, err := replica.New(clients, replica.Config{R: 3})
+ *            err = r.Put("block-1", data)
+ *            data, err = r.Get("block-1")
+ *            r.Wait(); fmt.Println(r.Stats())
+ */
+
+package replica
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Chunk struct {
+	Chunk, Hash []byte
+}
+
+// Hash is what a Chunk carries: the MD5 of its data, as DFS uses.
+func Hash(data []byte) []byte {
+	sum := md5.Sum(data)
+	return sum[:]
+}
+
+func (c *Chunk) valid() bool {
+	return bytes.Equal(Hash(c.Chunk), c.Hash)
+}
+
+type PutArgs struct {
+	Key   string
+	Block Chunk
+}
+
+var ErrBadHash = errors.New("replica: block does not match its hash")
+var ErrTimeout = errors.New("replica: no answer in time")
+
+// Store is the server side: blocks in memory, by key.
+type Store struct {
+	mu     sync.Mutex
+	blocks map[string]Chunk
+	rng    *rand.Rand
+	// Diverge is the fraction of blocks stored altered, hash and all, as if
+	// the replica had missed a write and kept an older version
+	Diverge float64
+}
+
+func NewStore() *Store {
+	return &Store{blocks: make(map[string]Chunk), rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (s *Store) Put(args PutArgs, reply *int) error {
+	if !args.Block.valid() {
+		return ErrBadHash
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	block := args.Block
+	if s.Diverge > 0 && len(block.Chunk) > 0 && s.rng.Float64() < s.Diverge {
+		data := append([]byte(nil), block.Chunk...)
+		data[s.rng.Intn(len(data))] ^= 0xff
+		block = Chunk{data, Hash(data)}
+	}
+	s.blocks[args.Key] = block
+	*reply = len(block.Chunk)
+	return nil
+}
+
+func (s *Store) Get(key string, reply *Chunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	block, ok := s.blocks[key]
+	if !ok {
+		return fmt.Errorf("replica: no block %q", key)
+	}
+	*reply = block
+	return nil
+}
+
+// Caller is a connection to a Store: *rpc.Client, or a *resilient.Client
+// to survive servers that restart.
+type Caller interface {
+	Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call
+}
+
+type Config struct {
+	R       int           // copies of every block
+	Quorum  int           // agreeing copies a read needs; 0 is a majority of R
+	Timeout time.Duration // a replica slower than this counts as down; 0 waits
+	Service string        // name the Store is registered under; "" is "Blocks"
+}
+
+type Stats struct {
+	Reads, Writes int64
+	Failed        int64 // reads without a quorum, writes without a majority
+	Degraded      int64 // reads and writes a replica did not answer
+	Divergent     int64 // copies missing, corrupt or unlike the majority's
+	Repaired      int64
+	RepairFailed  int64
+	Unrepairable  int64 // divergent copies of blocks without a majority
+}
+
+func (s Stats) Sub(o Stats) Stats {
+	return Stats{s.Reads - o.Reads, s.Writes - o.Writes, s.Failed - o.Failed, s.Degraded - o.Degraded,
+		s.Divergent - o.Divergent, s.Repaired - o.Repaired, s.RepairFailed - o.RepairFailed,
+		s.Unrepairable - o.Unrepairable}
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d reads, %d writes, %d failed, %d degraded, %d divergent copies, %d repaired (%d failed, %d without a majority)",
+		s.Reads, s.Writes, s.Failed, s.Degraded, s.Divergent, s.Repaired, s.RepairFailed, s.Unrepairable)
+}
+
+type Replicas struct {
+	servers []Caller
+	cfg     Config
+	repairs sync.WaitGroup
+	stats   Stats // updated atomically
+}
+
+func New(servers []Caller, cfg Config) (*Replicas, error) {
+	if cfg.R < 1 || cfg.R > len(servers) {
+		return nil, fmt.Errorf("replica: R=%d with %d servers", cfg.R, len(servers))
+	}
+	if cfg.Quorum == 0 {
+		cfg.Quorum = cfg.R/2 + 1
+	}
+	if cfg.Quorum < 1 || cfg.Quorum > cfg.R {
+		return nil, fmt.Errorf("replica: quorum %d of R=%d", cfg.Quorum, cfg.R)
+	}
+	if cfg.Service == "" {
+		cfg.Service = "Blocks"
+	}
+	return &Replicas{servers: servers, cfg: cfg}, nil
+}
+
+// place picks key's R servers: consecutive ones from a hash of the key.
+func (r *Replicas) place(key string) []int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	first := int(h.Sum32() % uint32(len(r.servers)))
+	placed := make([]int, r.cfg.R)
+	for i := range placed {
+		placed[i] = (first + i) % len(r.servers)
+	}
+	return placed
+}
+
+type reply struct {
+	server int
+	chunk  Chunk
+	err    error
+}
+
+// call runs a Store method on server i, giving up after Timeout.
+func (r *Replicas) call(i int, method string, args, result interface{}) error {
+	call := r.servers[i].Go(r.cfg.Service+"."+method, args, result, make(chan *rpc.Call, 1))
+	if r.cfg.Timeout <= 0 {
+		<-call.Done
+		return call.Error
+	}
+	timer := time.NewTimer(r.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// answered reports whether the replica answered, even if with an error
+func answered(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return err == nil || ok
+}
+
+func (r *Replicas) Put(key string, data []byte) error {
+	atomic.AddInt64(&r.stats.Writes, 1)
+	args := PutArgs{key, Chunk{data, Hash(data)}}
+	placed := r.place(key)
+	replies := make(chan error, len(placed))
+	for _, i := range placed {
+		go func(i int) {
+			var n int
+			replies <- r.call(i, "Put", args, &n)
+		}(i)
+	}
+	majority := r.cfg.R/2 + 1
+	acks, missing := 0, 0
+	var last error
+	for n := 1; n <= len(placed); n++ {
+		err := <-replies
+		if err == nil {
+			acks++
+		} else {
+			missing++
+			last = err
+		}
+		if acks == majority {
+			// the rest only decide whether the write was degraded
+			r.repairs.Add(1)
+			go func(rest, missing int) {
+				defer r.repairs.Done()
+				for ; rest > 0; rest-- {
+					if <-replies != nil {
+						missing++
+					}
+				}
+				if missing > 0 {
+					atomic.AddInt64(&r.stats.Degraded, 1)
+				}
+			}(len(placed)-n, missing)
+			return nil
+		}
+	}
+	atomic.AddInt64(&r.stats.Failed, 1)
+	atomic.AddInt64(&r.stats.Degraded, 1)
+	return fmt.Errorf("replica: %q on %d of %d servers, want %d: %v", key, acks, len(placed), majority, last)
+}
+
+// tally counts a read's replies by the hash of valid copies.
+type tally struct {
+	replies []reply
+	votes   map[string]int
+	copies  map[string]Chunk
+}
+
+func (t *tally) add(rep reply) {
+	t.replies = append(t.replies, rep)
+	if rep.err == nil && rep.chunk.valid() {
+		h := string(rep.chunk.Hash)
+		t.votes[h]++
+		t.copies[h] = rep.chunk
+	}
+}
+
+// leader is the copy most replicas agree on, and how many do.
+func (t *tally) leader() (Chunk, int) {
+	var best Chunk
+	most := 0
+	for h, n := range t.votes {
+		if n > most {
+			best, most = t.copies[h], n
+		}
+	}
+	return best, most
+}
+
+func (r *Replicas) Get(key string) ([]byte, error) {
+	atomic.AddInt64(&r.stats.Reads, 1)
+	placed := r.place(key)
+	replies := make(chan reply, len(placed))
+	for _, i := range placed {
+		go func(i int) {
+			var c Chunk
+			err := r.call(i, "Get", key, &c)
+			replies <- reply{i, c, err}
+		}(i)
+	}
+	t := &tally{votes: make(map[string]int), copies: make(map[string]Chunk)}
+	for n := 1; n <= len(placed); n++ {
+		t.add(<-replies)
+		if block, votes := t.leader(); votes >= r.cfg.Quorum {
+			r.repairs.Add(1)
+			go func(rest int) {
+				defer r.repairs.Done()
+				for ; rest > 0; rest-- {
+					t.add(<-replies)
+				}
+				r.repair(key, t)
+			}(len(placed) - n)
+			return block.Chunk, nil
+		}
+	}
+	atomic.AddInt64(&r.stats.Failed, 1)
+	r.repair(key, t)
+	_, votes := t.leader()
+	return nil, fmt.Errorf("replica: %q: %d of %d copies agree, want %d", key, votes, len(placed), r.cfg.Quorum)
+}
+
+// repair overwrites the divergent copies of a read with the majority's,
+// once every replica has replied or timed out.
+func (r *Replicas) repair(key string, t *tally) {
+	block, votes := t.leader()
+	degraded := false
+	var divergent []int
+	for _, rep := range t.replies {
+		switch {
+		case !answered(rep.err):
+			degraded = true
+		case rep.err != nil || !rep.chunk.valid() || !bytes.Equal(rep.chunk.Hash, block.Hash):
+			divergent = append(divergent, rep.server)
+		}
+	}
+	if degraded {
+		atomic.AddInt64(&r.stats.Degraded, 1)
+	}
+	if len(divergent) == 0 {
+		return
+	}
+	atomic.AddInt64(&r.stats.Divergent, int64(len(divergent)))
+	if votes <= r.cfg.R/2 {
+		atomic.AddInt64(&r.stats.Unrepairable, int64(len(divergent)))
+		return
+	}
+	for _, i := range divergent {
+		var n int
+		if err := r.call(i, "Put", PutArgs{key, block}, &n); err != nil {
+			atomic.AddInt64(&r.stats.RepairFailed, 1)
+		} else {
+			atomic.AddInt64(&r.stats.Repaired, 1)
+		}
+	}
+}
+
+// Wait waits for the replies and repairs still outstanding.
+func (r *Replicas) Wait() {
+	r.repairs.Wait()
+}
+
+func (r *Replicas) Stats() Stats {
+	return Stats{
+		Reads:        atomic.LoadInt64(&r.stats.Reads),
+		Writes:       atomic.LoadInt64(&r.stats.Writes),
+		Failed:       atomic.LoadInt64(&r.stats.Failed),
+		Degraded:     atomic.LoadInt64(&r.stats.Degraded),
+		Divergent:    atomic.LoadInt64(&r.stats.Divergent),
+		Repaired:     atomic.LoadInt64(&r.stats.Repaired),
+		RepairFailed: atomic.LoadInt64(&r.stats.RepairFailed),
+		Unrepairable: atomic.LoadInt64(&r.stats.Unrepairable),
+	}
+}
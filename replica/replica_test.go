@@ -0,0 +1,140 @@
+package replica
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// serve runs each store behind its own rpc.Server over an in-memory
+// connection and returns the clients.
+func serve(t *testing.T, stores ...*Store) []*rpc.Client {
+	var clients []*rpc.Client
+	for _, store := range stores {
+		server := rpc.NewServer()
+		server.RegisterName("Blocks", store)
+		cconn, sconn := net.Pipe()
+		go server.ServeConn(sconn)
+		client := rpc.NewClient(cconn)
+		t.Cleanup(func() { client.Close() })
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func callers(clients []*rpc.Client) []Caller {
+	var cs []Caller
+	for _, c := range clients {
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// silent never answers, like a replica that hangs
+type silent struct{}
+
+func (silent) Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	return &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+}
+
+// Three replicas, one keeping every block altered: reads still return what
+// was written, the altered copy is repaired, and losing a second server
+// leaves reads without a quorum
+func TestReplicated(t *testing.T) {
+	diverging := NewStore()
+	diverging.Diverge = 1
+	clients := serve(t, NewStore(), diverging, NewStore())
+	r, err := New(callers(clients), Config{R: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("a block, three times over")
+	if err := r.Put("block", data); err != nil {
+		t.Fatal(err)
+	}
+	r.Wait()
+	for i := 0; i < 2; i++ {
+		block, err := r.Get("block")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block, data) {
+			t.Fatalf("read %q, wrote %q", block, data)
+		}
+		r.Wait()
+	}
+	// the repair Put was altered again by the diverging store
+	if st := r.Stats(); st.Divergent != 2 || st.Repaired != 2 {
+		t.Errorf("want 2 divergent copies repaired, got %v", st)
+	}
+	clients[0].Close()
+	if _, err := r.Get("block"); err == nil {
+		t.Error("a read with one good copy of three succeeded")
+	}
+}
+
+// A replica that never answers costs a read nothing once Timeout passes,
+// and is counted as degraded rather than repaired
+func TestSilentReplica(t *testing.T) {
+	clients := serve(t, NewStore(), NewStore())
+	servers := append(callers(clients), silent{})
+	r, err := New(servers, Config{R: 3, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("two of three")
+	if err := r.Put("block", data); err != nil {
+		t.Fatal(err)
+	}
+	block, err := r.Get("block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, data) {
+		t.Errorf("read %q, wrote %q", block, data)
+	}
+	r.Wait()
+	if st := r.Stats(); st.Degraded != 2 || st.Divergent != 0 || st.Failed != 0 {
+		t.Errorf("want the write and the read degraded, nothing else, got %v", st)
+	}
+}
+
+// A write without a majority fails, and so does a read of it
+func TestNoMajority(t *testing.T) {
+	clients := serve(t, NewStore())
+	r, err := New([]Caller{clients[0], silent{}, silent{}}, Config{R: 3, Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put("block", []byte("one copy")); err == nil {
+		t.Error("a write that reached one of three servers succeeded")
+	}
+	if _, err := r.Get("block"); err == nil {
+		t.Error("a read of one copy of three succeeded")
+	}
+	r.Wait()
+	if st := r.Stats(); st.Failed != 2 {
+		t.Errorf("want 2 failed, got %v", st)
+	}
+}
+
+// A Store refuses a block whose hash does not match its data
+func TestStoreChecksHash(t *testing.T) {
+	var n int
+	data := []byte("block")
+	err := NewStore().Put(PutArgs{"k", Chunk{data, Hash([]byte("other"))}}, &n)
+	if err != ErrBadHash {
+		t.Errorf("mismatched hash: got %v, want %v", err, ErrBadHash)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	servers := []Caller{silent{}, silent{}}
+	for _, cfg := range []Config{{R: 0}, {R: 3}, {R: 2, Quorum: 3}} {
+		if _, err := New(servers, cfg); err == nil {
+			t.Errorf("%+v with 2 servers accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/*
+ * Renders stored benchmark results (see results) as one self-contained HTML
+ * page of SVG charts, to share without the raw numbers:
+ *
+ *   throughput vs window size       windowedThroughput runs, by -ws
+ *   throughput vs message length    windowedThroughput (-ml) and throughput runs
+ *   latency CDFs                    the latest runs that recorded latency
+ *   snappy vs raw by file type      dfs client runs, by -file or -payload
+ *   Paxos decisions/sec vs F        paxos proposer runs
+ *
+ * Runs with the same parameters are pooled and plotted at their median.
+ * The page needs no scripts or external resources.
+ *
+ * report  [-results directory of stored runs]
+ *         [-runs selector, as for compare (default: every run)]
+ *         [-cdfs how many latency CDFs to draw]
+ *         [-o output file]
+ *
+ * Basic usage:
+ *   report -o report.html
+ *   report -runs 5d64043 -o 5d64043.html
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorpc-tests/results"
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Fatal error ", err.Error())
+		os.Exit(1)
+	}
+}
+
+// param returns a run's parameter, or the flag's default when the run left
+// it unset.
+func param(r *results.Run, name, dflt string) string {
+	if v, ok := r.Params[name]; ok {
+		return v
+	}
+	return dflt
+}
+
+// positional returns argument i of a run, or "" when it had fewer.
+func positional(r *results.Run, i int) string {
+	args := strings.Fields(r.Params["args"])
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// sweepParams are run lengths and bookkeeping, not part of what a series
+// measures, so they do not split series.
+var sweepParams = map[string]bool{
+	"nm": true, "warmup": true, "duration": true, "calls": true, "args": true,
+	"results": true, "cpuprofile": true, "memprofile": true, "blockprofile": true,
+	"mutexprofile": true, "trace": true, "pprof": true, "timeout": true,
+}
+
+// label names a run's series by the parameters it set, other than x.
+func label(r *results.Run, x string) string {
+	var parts []string
+	for name, v := range r.Params {
+		if name != x && !sweepParams[name] {
+			parts = append(parts, name+"="+v)
+		}
+	}
+	sort.Strings(parts)
+	if len(parts) == 0 {
+		return "defaults"
+	}
+	return strings.Join(parts, " ")
+}
+
+// pooled gathers metric samples by series and x value.
+type pooled map[string]map[float64][]float64
+
+func (p pooled) add(name string, x float64, values []float64) {
+	if p[name] == nil {
+		p[name] = make(map[float64][]float64)
+	}
+	p[name][x] = append(p[name][x], values...)
+}
+
+func (p pooled) series() []series {
+	var names []string
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ss []series
+	for _, name := range names {
+		s := series{Name: name}
+		for x, values := range p[name] {
+			s.Points = append(s.Points, point{x, results.Median(values)})
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func metric(r *results.Run, name string) []float64 {
+	if s, ok := r.Metrics[name]; ok {
+		return s.Values
+	}
+	return nil
+}
+
+func throughputVsWindow(runs []*results.Run) string {
+	p := make(pooled)
+	for _, r := range runs {
+		if r.Benchmark != "windowedThroughput" {
+			continue
+		}
+		ws, err := strconv.ParseFloat(param(r, "ws", "1"), 64)
+		if err != nil || len(metric(r, "throughput")) == 0 {
+			continue
+		}
+		p.add(label(r, "ws"), ws, metric(r, "throughput"))
+	}
+	return lineChart("Throughput vs window size", "window size (outstanding messages)", "messages/s", true, p.series())
+}
+
+func throughputVsLength(runs []*results.Run) string {
+	p := make(pooled)
+	for _, r := range runs {
+		var x string
+		var name string
+		switch r.Benchmark {
+		case "windowedThroughput":
+			x, name = param(r, "ml", "100"), "windowed "+label(r, "ml")
+		case "throughput":
+			x = positional(r, 3)
+			if x == "" {
+				x = param(r, "size", "1024")
+			}
+			name = fmt.Sprintf("throughput clients=%s servers=%s %s", positional(r, 0), positional(r, 1), label(r, ""))
+		default:
+			continue
+		}
+		length, err := strconv.ParseFloat(x, 64)
+		if err != nil || len(metric(r, "bandwidth")) == 0 {
+			continue
+		}
+		p.add(name, length, metric(r, "bandwidth"))
+	}
+	return lineChart("Throughput vs message length", "message length (bytes)", "MB/s", true, p.series())
+}
+
+func latencyCDFs(runs []*results.Run, max int) string {
+	var ss []series
+	for i := len(runs) - 1; i >= 0 && len(ss) < max; i-- {
+		r := runs[i]
+		cdf := r.CDFs["latency"]
+		if len(cdf) == 0 {
+			continue
+		}
+		s := series{Name: fmt.Sprintf("%s %s", r.Benchmark, r.Time.Format("01-02 15:04"))}
+		for _, p := range cdf {
+			s.Points = append(s.Points, point{float64(p.Value) / float64(time.Microsecond), p.Fraction})
+		}
+		ss = append(ss, s)
+	}
+	return lineChart("Latency CDFs (latest runs)", "latency (µs)", "fraction of calls", true, ss)
+}
+
+func snappyByFile(runs []*results.Run) string {
+	byFile := make(map[string]map[bool][]float64)
+	for _, r := range runs {
+		if r.Benchmark != "dfs" {
+			continue
+		}
+		file := filepath.Base(param(r, "file", "moby.txt"))
+		if kind := param(r, "payload", ""); kind != "" {
+			file = kind
+		}
+		isSnappy := param(r, "snappy", "false") == "true"
+		if byFile[file] == nil {
+			byFile[file] = make(map[bool][]float64)
+		}
+		byFile[file][isSnappy] = append(byFile[file][isSnappy], metric(r, "throughput")...)
+	}
+	var files []string
+	for file := range byFile {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var values [][]float64
+	for _, file := range files {
+		row := make([]float64, 2)
+		for i, isSnappy := range []bool{false, true} {
+			row[i] = math.NaN()
+			if v := byFile[file][isSnappy]; len(v) > 0 {
+				row[i] = results.Median(v)
+			}
+		}
+		values = append(values, row)
+	}
+	return barChart("Snappy vs raw blocks by file", "blocks/s", files, []string{"raw", "snappy"}, values)
+}
+
+func paxosByF(runs []*results.Run) string {
+	p := make(pooled)
+	for _, r := range runs {
+		if r.Benchmark != "paxos" {
+			continue
+		}
+		f, err := strconv.ParseFloat(param(r, "F", ""), 64)
+		if err != nil {
+			continue
+		}
+		p.add(label(r, "F"), f, metric(r, "decisions"))
+	}
+	return lineChart("Paxos decisions/sec vs F", "F (2F+1 acceptors)", "decisions/s", false, p.series())
+}
+
+func runTable(runs []*results.Run) string {
+	var b strings.Builder
+	b.WriteString("<table><tr><th>run</th><th>commit</th><th>go</th><th>host</th><th>parameters</th></tr>\n")
+	for _, r := range runs {
+		commit := r.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if r.Dirty {
+			commit += "+dirty"
+		}
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(r.ID), html.EscapeString(commit), html.EscapeString(r.GoVersion),
+			html.EscapeString(r.Host), html.EscapeString(label(r, "")))
+	}
+	b.WriteString("</table>\n")
+	return b.String()
+}
+
+const style = `body { font-family: sans-serif; margin: 2em; color: #222; }
+svg { display: block; margin: 1em 0 2em; }
+table { border-collapse: collapse; font-size: 12px; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }`
+
+func main() {
+	dir := flag.String("results", results.DefaultDir(), "directory of stored runs")
+	selector := flag.String("runs", "", "only runs matching this selector (commit or ID prefix, go:VERSION, latest)")
+	cdfs := flag.Int("cdfs", 6, "latency CDFs to draw, newest first")
+	out := flag.String("o", "report.html", "output file")
+	flag.Parse()
+
+	runs, err := results.Store{Dir: *dir}.Load()
+	checkError(err)
+	if *selector != "" {
+		runs, err = results.Select(runs, *selector)
+		checkError(err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>gorpc-tests results</title><style>%s</style></head><body>\n", style)
+	fmt.Fprintf(&b, "<h1>gorpc-tests results</h1>\n<p>%d run(s) from %s, generated %s.</p>\n",
+		len(runs), html.EscapeString(*dir), time.Now().Format("2006-01-02 15:04"))
+	for _, chart := range []string{
+		throughputVsWindow(runs),
+		throughputVsLength(runs),
+		latencyCDFs(runs, *cdfs),
+		snappyByFile(runs),
+		paxosByF(runs),
+	} {
+		b.WriteString(chart)
+		b.WriteString("\n")
+	}
+	b.WriteString("<h2>Runs</h2>\n")
+	b.WriteString(runTable(runs))
+	b.WriteString("</body></html>\n")
+
+	checkError(ioutil.WriteFile(*out, []byte(b.String()), 0644))
+	fmt.Printf("Wrote %s (%d runs)\n", *out, len(runs))
+}
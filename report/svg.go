@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Chart geometry, in SVG user units
+const (
+	chartW  = 640
+	chartH  = 360
+	marginL = 70
+	marginR = 170 // room for the legend
+	marginT = 30
+	marginB = 50
+	plotW   = chartW - marginL - marginR
+	plotH   = chartH - marginT - marginB
+)
+
+var palette = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+type point struct {
+	X, Y float64
+}
+
+type series struct {
+	Name   string
+	Points []point
+}
+
+// axis maps data values onto a pixel range, linearly or by log10.
+type axis struct {
+	min, max float64
+	log      bool
+	from, to float64 // pixels
+}
+
+func (a axis) pos(v float64) float64 {
+	lo, hi := a.min, a.max
+	if a.log {
+		v, lo, hi = math.Log10(v), math.Log10(lo), math.Log10(hi)
+	}
+	if hi == lo {
+		return (a.from + a.to) / 2
+	}
+	return a.from + (v-lo)/(hi-lo)*(a.to-a.from)
+}
+
+// ticks picks about five round values across a linear axis, or the powers
+// of ten (and their halves when there are few) across a log one.
+func (a axis) ticks() []float64 {
+	var ticks []float64
+	if a.log {
+		for e := math.Floor(math.Log10(a.min)); e <= math.Ceil(math.Log10(a.max)); e++ {
+			for _, m := range []float64{1, 2, 5} {
+				v := m * math.Pow(10, e)
+				if v >= a.min && v <= a.max {
+					ticks = append(ticks, v)
+				}
+			}
+		}
+		return ticks
+	}
+	span := a.max - a.min
+	if span <= 0 {
+		return []float64{a.min}
+	}
+	step := math.Pow(10, math.Floor(math.Log10(span/5)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if span/(step*m) <= 6 {
+			step *= m
+			break
+		}
+	}
+	for v := math.Ceil(a.min/step) * step; v <= a.max+step/1e6; v += step {
+		ticks = append(ticks, v)
+	}
+	return ticks
+}
+
+func formatTick(v float64) string {
+	switch {
+	case v == 0:
+		return "0"
+	case math.Abs(v) >= 1e9:
+		return fmt.Sprintf("%gG", v/1e9)
+	case math.Abs(v) >= 1e6:
+		return fmt.Sprintf("%gM", v/1e6)
+	case math.Abs(v) >= 1e4:
+		return fmt.Sprintf("%gk", v/1e3)
+	}
+	return fmt.Sprintf("%g", math.Round(v*1000)/1000)
+}
+
+func svgStart(b *strings.Builder, title string) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+		chartW, chartH, chartW, chartH)
+	fmt.Fprintf(b, `<text x="%d" y="18" font-size="14" font-weight="bold">%s</text>`, marginL, html.EscapeString(title))
+}
+
+func drawAxes(b *strings.Builder, x, y axis, xlabel, ylabel string) {
+	fmt.Fprintf(b, `<rect x="%d" y="%d" width="%d" height="%d" fill="none" stroke="#999"/>`, marginL, marginT, plotW, plotH)
+	for _, t := range x.ticks() {
+		px := x.pos(t)
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#eee"/>`, px, marginT, px, marginT+plotH)
+		fmt.Fprintf(b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`, px, marginT+plotH+14, formatTick(t))
+	}
+	for _, t := range y.ticks() {
+		py := y.pos(t)
+		fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, marginL, py, marginL+plotW, py)
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, marginL-4, py+4, formatTick(t))
+	}
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`, marginL+plotW/2, chartH-12, html.EscapeString(xlabel))
+	fmt.Fprintf(b, `<text x="14" y="%d" text-anchor="middle" transform="rotate(-90 14 %d)">%s</text>`,
+		marginT+plotH/2, marginT+plotH/2, html.EscapeString(ylabel))
+}
+
+func drawLegend(b *strings.Builder, names []string) {
+	for i, name := range names {
+		y := marginT + 6 + 16*i
+		fmt.Fprintf(b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, marginL+plotW+10, y, palette[i%len(palette)])
+		fmt.Fprintf(b, `<text x="%d" y="%d">%s</text>`, marginL+plotW+24, y+9, html.EscapeString(name))
+	}
+}
+
+// lineChart plots each series as a line with markers. With logX the x axis
+// is log10, for parameters swept in powers.
+func lineChart(title, xlabel, ylabel string, logX bool, ss []series) string {
+	xa := axis{min: math.Inf(1), max: math.Inf(-1), log: logX, from: marginL, to: marginL + plotW}
+	ya := axis{min: 0, max: math.Inf(-1), from: marginT + plotH, to: marginT}
+	for _, s := range ss {
+		for _, p := range s.Points {
+			if logX && p.X <= 0 {
+				continue
+			}
+			xa.min, xa.max = math.Min(xa.min, p.X), math.Max(xa.max, p.X)
+			ya.max = math.Max(ya.max, p.Y)
+		}
+	}
+	var b strings.Builder
+	svgStart(&b, title)
+	if math.IsInf(xa.min, 0) {
+		b.WriteString(`<text x="60" y="60">no data</text></svg>`)
+		return b.String()
+	}
+	if ya.max <= 0 {
+		ya.max = 1
+	}
+	ya.max *= 1.05
+	drawAxes(&b, xa, ya, xlabel, ylabel)
+	var names []string
+	for i, s := range ss {
+		color := palette[i%len(palette)]
+		sort.Slice(s.Points, func(a, c int) bool { return s.Points[a].X < s.Points[c].X })
+		var path []string
+		for _, p := range s.Points {
+			if logX && p.X <= 0 {
+				continue
+			}
+			path = append(path, fmt.Sprintf("%.1f,%.1f", xa.pos(p.X), ya.pos(p.Y)))
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s: %g, %.4g</title></circle>`,
+				xa.pos(p.X), ya.pos(p.Y), color, html.EscapeString(s.Name), p.X, p.Y)
+		}
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, strings.Join(path, " "), color)
+		names = append(names, s.Name)
+	}
+	drawLegend(&b, names)
+	b.WriteString("</svg>")
+	return b.String()
+}
+
+// barChart draws one cluster of bars per group, one bar per series; a NaN
+// value leaves its bar out.
+func barChart(title, ylabel string, groups, seriesNames []string, values [][]float64) string {
+	var b strings.Builder
+	svgStart(&b, title)
+	ya := axis{min: 0, max: 0, from: marginT + plotH, to: marginT}
+	for _, row := range values {
+		for _, v := range row {
+			if !math.IsNaN(v) {
+				ya.max = math.Max(ya.max, v)
+			}
+		}
+	}
+	if len(groups) == 0 || ya.max == 0 {
+		b.WriteString(`<text x="60" y="60">no data</text></svg>`)
+		return b.String()
+	}
+	ya.max *= 1.05
+	xa := axis{min: 0, max: 1, from: marginL, to: marginL + plotW}
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="none" stroke="#999"/>`, marginL, marginT, plotW, plotH)
+	for _, t := range ya.ticks() {
+		py := ya.pos(t)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, marginL, py, marginL+plotW, py)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, marginL-4, py+4, formatTick(t))
+	}
+	fmt.Fprintf(&b, `<text x="14" y="%d" text-anchor="middle" transform="rotate(-90 14 %d)">%s</text>`,
+		marginT+plotH/2, marginT+plotH/2, html.EscapeString(ylabel))
+	groupW := float64(plotW) / float64(len(groups))
+	barW := groupW * 0.8 / float64(len(seriesNames))
+	for g, group := range groups {
+		left := xa.from + groupW*float64(g) + groupW*0.1
+		for s := range seriesNames {
+			v := values[g][s]
+			if math.IsNaN(v) {
+				continue
+			}
+			top := ya.pos(v)
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s, %s: %.4g</title></rect>`,
+				left+barW*float64(s), top, barW-1, ya.from-top, palette[s%len(palette)],
+				html.EscapeString(group), html.EscapeString(seriesNames[s]), v)
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`,
+			left+groupW*0.4, marginT+plotH+14, html.EscapeString(group))
+	}
+	drawLegend(&b, seriesNames)
+	b.WriteString("</svg>")
+	return b.String()
+}
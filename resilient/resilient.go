@@ -0,0 +1,231 @@
+/* Reconnecting net/rpc client
+ *
+ * Client wraps an *rpc.Client and survives the server going away: when a call
+ * fails because the connection broke (rpc.ErrShutdown, EOF, a network error)
+ * the connection is thrown away and redialed with exponential backoff and
+ * jitter. Calls to methods the Policy marks idempotent (Echo, GetBlock, ...)
+ * are retried on the new connection; other calls return the error but still
+ * get a fresh connection next time. Errors returned by the service itself
+ * (rpc.ServerError) are never retried.
+ *
+ * Basic usage:
+ *   c := resilient.New("tcp", "localhost:1337", resilient.DefaultPolicy("DFS.GetBlock"))
+ *   err := c.Call("DFS.GetBlock", blockSize, &reply)
+ *   fmt.Println(c.Stats())
+ */
+
+package resilient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Policy struct {
+	// retries per call after the first attempt
+	MaxRetries int
+	// backoff before retry n is drawn from [d/2, d] with d = BaseDelay*2^n capped at MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// methods that are safe to send twice
+	Idempotent map[string]bool
+	// makes every connection; nil means rpc.Dial
+	Dial func(network, addr string) (*rpc.Client, error)
+}
+
+// DefaultPolicy retries the given methods up to 10 times, backing off from
+// 10ms to 2s.
+func DefaultPolicy(idempotent ...string) Policy {
+	p := Policy{
+		MaxRetries: 10,
+		BaseDelay:  10 * time.Millisecond,
+		MaxDelay:   2 * time.Second,
+		Idempotent: make(map[string]bool),
+	}
+	for _, m := range idempotent {
+		p.Idempotent[m] = true
+	}
+	return p
+}
+
+func (p Policy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Stats counts what it took to keep the client alive.
+type Stats struct {
+	Calls    int64 // calls made through the client
+	Retries  int64 // extra attempts after a broken connection
+	Redials  int64 // successful reconnects
+	Failures int64 // calls that gave up
+}
+
+// Add folds the counts of another client into s.
+func (s *Stats) Add(o Stats) {
+	s.Calls += o.Calls
+	s.Retries += o.Retries
+	s.Redials += o.Redials
+	s.Failures += o.Failures
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("calls %d, retries %d, redials %d, failed %d", s.Calls, s.Retries, s.Redials, s.Failures)
+}
+
+type Client struct {
+	network, addr string
+	policy        Policy
+
+	mu     sync.Mutex
+	client *rpc.Client
+	gen    int
+	closed bool
+
+	calls, retries, redials, failures int64
+}
+
+// New returns a client that dials addr on its first call, so a server that is
+// down at that moment costs retries rather than an error.
+func New(network, addr string, policy Policy) *Client {
+	return &Client{network: network, addr: addr, policy: policy}
+}
+
+// Dial connects to addr once; later reconnects happen on demand.
+func Dial(network, addr string, policy Policy) (*Client, error) {
+	c := New(network, addr, policy)
+	if _, _, err := c.current(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// IsConnError reports whether err means the connection, not the call, failed.
+func IsConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		return false
+	}
+	var ne net.Error
+	return err == rpc.ErrShutdown || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &ne)
+}
+
+// returns the live connection, dialing one if there is none
+func (c *Client) current() (*rpc.Client, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, c.gen, rpc.ErrShutdown
+	}
+	if c.client != nil {
+		return c.client, c.gen, nil
+	}
+	dial := c.policy.Dial
+	if dial == nil {
+		dial = rpc.Dial
+	}
+	client, err := dial(c.network, c.addr)
+	if err != nil {
+		return nil, c.gen, err
+	}
+	if c.gen > 0 {
+		atomic.AddInt64(&c.redials, 1)
+	}
+	c.gen++
+	c.client = client
+	return client, c.gen, nil
+}
+
+// drops connection generation gen unless someone already replaced it
+func (c *Client) broken(gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil && c.gen == gen {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+func (c *Client) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	atomic.AddInt64(&c.calls, 1)
+	for attempt := 0; ; attempt++ {
+		client, gen, err := c.current()
+		if err == nil {
+			err = client.Call(serviceMethod, args, reply)
+			if IsConnError(err) {
+				c.broken(gen)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if c.isClosed() || !IsConnError(err) || !c.policy.Idempotent[serviceMethod] || attempt >= c.policy.MaxRetries {
+			atomic.AddInt64(&c.failures, 1)
+			return err
+		}
+		atomic.AddInt64(&c.retries, 1)
+		time.Sleep(c.policy.backoff(attempt))
+	}
+}
+
+// Go behaves like (*rpc.Client).Go, with the retries of Call.
+func (c *Client) Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 10)
+	} else if cap(done) == 0 {
+		panic("resilient: done channel is unbuffered")
+	}
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	go func() {
+		call.Error = c.Call(serviceMethod, args, reply)
+		done <- call
+	}()
+	return call
+}
+
+func (c *Client) Stats() Stats {
+	return Stats{
+		Calls:    atomic.LoadInt64(&c.calls),
+		Retries:  atomic.LoadInt64(&c.retries),
+		Redials:  atomic.LoadInt64(&c.redials),
+		Failures: atomic.LoadInt64(&c.failures),
+	}
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return rpc.ErrShutdown
+	}
+	c.closed = true
+	if c.client != nil {
+		return c.client.Close()
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package resilient
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Svc struct{}
+
+func (Svc) Echo(args *int, reply *int) error {
+	*reply = *args
+	return nil
+}
+
+func (Svc) Put(args *int, reply *int) error {
+	return nil
+}
+
+func (Svc) Fail(args *int, reply *int) error {
+	return errors.New("refused")
+}
+
+// breaker serves Svc and can cut the client's current connection, as a
+// server restart would.
+type breaker struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func serve(t *testing.T) *breaker {
+	server := rpc.NewServer()
+	server.Register(Svc{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Accept(l)
+	return &breaker{addr: l.Addr().String()}
+}
+
+func (b *breaker) dial(network, addr string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	return rpc.NewClient(conn), nil
+}
+
+func (b *breaker) cut() {
+	b.mu.Lock()
+	b.conn.Close()
+	b.mu.Unlock()
+}
+
+func policy(b *breaker) Policy {
+	p := DefaultPolicy("Svc.Echo")
+	p.BaseDelay, p.MaxDelay = time.Millisecond, 4*time.Millisecond
+	p.Dial = b.dial
+	return p
+}
+
+func TestIsConnError(t *testing.T) {
+	for err, want := range map[error]bool{
+		nil:                        false,
+		rpc.ServerError("refused"): false,
+		errors.New("other"):        false,
+		rpc.ErrShutdown:            true,
+		io.EOF:                     true,
+		io.ErrUnexpectedEOF:        true,
+		&net.OpError{Op: "dial"}:   true,
+	} {
+		if got := IsConnError(err); got != want {
+			t.Errorf("IsConnError(%v) = %v", err, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	for attempt, d := range []time.Duration{10, 20, 40, 80, 100, 100} {
+		d *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if got := p.backoff(attempt); got < d/2 || got > d {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", attempt, got, d/2, d)
+			}
+		}
+	}
+}
+
+// An idempotent call is retried on a new connection when the old one
+// breaks
+func TestRedial(t *testing.T) {
+	b := serve(t)
+	c, err := Dial("tcp", b.addr, policy(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		b.cut()
+		var reply int
+		if err := c.Call("Svc.Echo", &i, &reply); err != nil || reply != i {
+			t.Fatalf("Echo(%d) after a cut = %d, %v", i, reply, err)
+		}
+	}
+	if s := c.Stats(); s.Calls != 3 || s.Retries != 3 || s.Redials != 3 || s.Failures != 0 {
+		t.Errorf("got %v, want 3 calls, each retried once on a redialed connection", s)
+	}
+}
+
+// Other calls fail on a broken connection but get a fresh one next time,
+// and errors of the service itself are never retried
+func TestNotRetried(t *testing.T) {
+	b := serve(t)
+	c, err := Dial("tcp", b.addr, policy(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b.cut()
+	if err := c.Call("Svc.Put", new(int), new(int)); !IsConnError(err) {
+		t.Errorf("Put on a cut connection returned %v", err)
+	}
+	if err := c.Call("Svc.Put", new(int), new(int)); err != nil {
+		t.Errorf("Put on the next connection: %v", err)
+	}
+	if err := c.Call("Svc.Fail", new(int), new(int)); err == nil || IsConnError(err) {
+		t.Errorf("Fail returned %v", err)
+	}
+	if s := c.Stats(); s.Retries != 0 || s.Failures != 2 || s.Redials != 1 {
+		t.Errorf("got %v, want 2 failures, no retries, one redial", s)
+	}
+}
+
+// A client made with New dials on its first call and gives up after
+// MaxRetries when nothing listens
+func TestServerDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	p := DefaultPolicy("Svc.Echo")
+	p.MaxRetries, p.BaseDelay, p.MaxDelay = 2, time.Millisecond, time.Millisecond
+	c := New("tcp", addr, p)
+	if err := c.Call("Svc.Echo", new(int), new(int)); err == nil {
+		t.Fatal("Echo reached a closed port")
+	}
+	if s := c.Stats(); s.Retries != 2 || s.Failures != 1 {
+		t.Errorf("got %v, want 2 retries and a failure", s)
+	}
+	if _, err := Dial("tcp", addr, p); err == nil {
+		t.Error("Dial reached a closed port")
+	}
+}
+
+func TestClose(t *testing.T) {
+	b := serve(t)
+	c, err := Dial("tcp", b.addr, policy(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("Svc.Echo", new(int), new(int)); err != rpc.ErrShutdown {
+		t.Errorf("Echo after Close returned %v", err)
+	}
+	if err := c.Close(); err != rpc.ErrShutdown {
+		t.Errorf("second Close returned %v", err)
+	}
+	var total Stats
+	total.Add(c.Stats())
+	total.Add(c.Stats())
+	if total.Calls != 2 || total.Failures != 2 {
+		t.Errorf("Add: %v", total)
+	}
+}
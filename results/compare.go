@@ -0,0 +1,146 @@
+package results
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ignoredParams do not change what a run measures, so runs differing only
+// in them are compared with each other.
+var ignoredParams = map[string]bool{
+	"results": true, "cpuprofile": true, "memprofile": true, "blockprofile": true,
+	"mutexprofile": true, "trace": true, "pprof": true,
+}
+
+// Key identifies what a run measured: its benchmark and parameters.
+func (r *Run) Key() string {
+	var params []string
+	for name, value := range r.Params {
+		if !ignoredParams[name] {
+			params = append(params, name+"="+value)
+		}
+	}
+	sort.Strings(params)
+	return r.Benchmark + " " + strings.Join(params, " ")
+}
+
+type CompareOptions struct {
+	Alpha     float64 // significance level, e.g. 0.05
+	Threshold float64 // relative change that counts as a regression, e.g. 0.05
+}
+
+// TooFewRuns is the verdict on a metric with too few runs on a side for any
+// change to reach significance at the chosen alpha.
+const TooFewRuns = "too few runs for alpha"
+
+// Delta is one metric of one benchmark configuration in both sets of runs.
+type Delta struct {
+	Key        string
+	Metric     string
+	Unit       string
+	Old, New   []float64 // one median per run
+	Change     float64   // median(New)/median(Old) - 1
+	Lo, Hi     float64   // 95% bootstrap interval of Change
+	P          float64
+	Regression bool
+	Verdict    string
+}
+
+// Compare tests each metric of every configuration present in both old and
+// new for a change. The samples compared are one per run, the median of
+// that run's values: the intervals of one run share its machine state and
+// warm-up, so they are not independent observations, and testing them
+// would find a "significant" change between any two runs.
+func Compare(old, new []*Run, opts CompareOptions) []Delta {
+	pool := func(runs []*Run) map[string]map[string]*Sample {
+		byKey := make(map[string]map[string]*Sample)
+		for _, r := range runs {
+			metrics, ok := byKey[r.Key()]
+			if !ok {
+				metrics = make(map[string]*Sample)
+				byKey[r.Key()] = metrics
+			}
+			for name, s := range r.Metrics {
+				p, ok := metrics[name]
+				if !ok {
+					p = &Sample{Unit: s.Unit, HigherIsBetter: s.HigherIsBetter}
+					metrics[name] = p
+				}
+				if len(s.Values) > 0 {
+					p.Values = append(p.Values, Median(s.Values))
+				}
+			}
+		}
+		return byKey
+	}
+	oldByKey, newByKey := pool(old), pool(new)
+
+	var deltas []Delta
+	for key, oldMetrics := range oldByKey {
+		newMetrics, ok := newByKey[key]
+		if !ok {
+			continue
+		}
+		for name, o := range oldMetrics {
+			n, ok := newMetrics[name]
+			if !ok {
+				continue
+			}
+			d := Delta{Key: key, Metric: name, Unit: o.Unit, Old: o.Values, New: n.Values}
+			d.Change = Median(n.Values)/Median(o.Values) - 1
+			d.Lo, d.Hi = BootstrapChange(o.Values, n.Values, 0.95, 2000)
+			d.P = MannWhitney(o.Values, n.Values)
+			worse := d.Change < 0 == o.HigherIsBetter
+			switch {
+			case math.IsNaN(d.Change) || math.IsInf(d.Change, 0):
+				d.Verdict = "?"
+			case MinP(len(o.Values), len(n.Values)) >= opts.Alpha:
+				// not "~": no change could have been significant
+				d.Verdict = TooFewRuns
+			case d.P >= opts.Alpha:
+				d.Verdict = "~"
+			case worse && math.Abs(d.Change) > opts.Threshold:
+				d.Verdict = "REGRESSION"
+				d.Regression = true
+			case worse:
+				d.Verdict = "worse"
+			default:
+				d.Verdict = "better"
+			}
+			deltas = append(deltas, d)
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		if deltas[i].Key != deltas[j].Key {
+			return deltas[i].Key < deltas[j].Key
+		}
+		return deltas[i].Metric < deltas[j].Metric
+	})
+	return deltas
+}
+
+// PrintDeltas writes deltas as a table per configuration; n counts runs.
+func PrintDeltas(w io.Writer, deltas []Delta) {
+	var tw *tabwriter.Writer
+	key := ""
+	for i, d := range deltas {
+		if i == 0 || d.Key != key {
+			if tw != nil {
+				tw.Flush()
+			}
+			key = d.Key
+			fmt.Fprintf(w, "%s\n", key)
+			tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		}
+		fmt.Fprintf(tw, "  %s (%s)\t%.4g (runs=%d)\t%.4g (runs=%d)\t%+.1f%%\t[%+.1f%%, %+.1f%%]\tp=%.3f\t%s\t\n",
+			d.Metric, d.Unit, Median(d.Old), len(d.Old), Median(d.New), len(d.New),
+			100*d.Change, 100*d.Lo, 100*d.Hi, d.P, d.Verdict)
+	}
+	if tw != nil {
+		tw.Flush()
+	}
+}
@@ -0,0 +1,335 @@
+/* Benchmark result store
+ *
+ * Every benchmark run is saved as one JSON file in a results directory,
+ * tagged with the git commit it was built from, the Go version, the host and
+ * every flag and argument it was given. Metrics are kept as samples (one per
+ * reporting interval) for plotting; compare reduces each run to its median
+ * and tests the runs of two commits or Go versions against each other, so
+ * a comparison needs several runs a side.
+ *
+ * The directory is -results, defaulting to $GORPC_RESULTS or
+ * ~/.gorpc-tests/results; -results=- turns storing off.
+ *
+ * Basic usage:
+ *   store := results.AddFlags()
+ *   flag.Parse()
+ *   ... run ...
+ *   run := results.New("throughput")
+ *   run.AddResult(res)
+ *   store.Save(run)
+ */
+
+package results
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"gorpc-tests/measure"
+	"gorpc-tests/payload"
+	"gorpc-tests/profiling"
+)
+
+// Sample is every observation of one metric in a run.
+type Sample struct {
+	Unit           string
+	HigherIsBetter bool
+	Values         []float64
+}
+
+type Run struct {
+	ID        string
+	Benchmark string
+	Time      time.Time
+	Commit    string
+	Dirty     bool // built from a tree with uncommitted changes
+	GoVersion string
+	GOOS      string
+	GOARCH    string
+	NumCPU    int
+	Host      string
+	Scenario  string `json:",omitempty"` // from $GORPC_SCENARIO, set by runscenario
+	Params    map[string]string
+	Metrics   map[string]*Sample
+	CDFs      map[string][]measure.CDFPoint `json:",omitempty"`
+}
+
+// New starts a run of benchmark, recording the environment, the flags set
+// on the command line and the arguments; call it after flag.Parse. Flags
+// left at their defaults are not recorded, so runs from before and after a
+// flag was added still compare.
+func New(benchmark string) *Run {
+	r := &Run{
+		Benchmark: benchmark,
+		Time:      time.Now(),
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+		Params:    make(map[string]string),
+		Metrics:   make(map[string]*Sample),
+	}
+	r.Host, _ = os.Hostname()
+	r.Scenario = os.Getenv("GORPC_SCENARIO")
+	r.Commit, r.Dirty = commit()
+	flag.Visit(func(f *flag.Flag) {
+		r.Params[f.Name] = f.Value.String()
+	})
+	if flag.NArg() > 0 {
+		r.Params["args"] = strings.Join(flag.Args(), " ")
+	}
+	return r
+}
+
+// commit is the revision the binary was built from: GORPC_COMMIT if set,
+// else the VCS stamp of a module build, else what git says about the
+// working directory.
+func commit() (string, bool) {
+	if c := os.Getenv("GORPC_COMMIT"); c != "" {
+		return c, false
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var rev string
+		var dirty bool
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				rev = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if rev != "" {
+			return rev, dirty
+		}
+	}
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "unknown", false
+	}
+	status, _ := exec.Command("git", "status", "--porcelain", "--untracked-files=no").Output()
+	return strings.TrimSpace(string(out)), len(strings.TrimSpace(string(status))) > 0
+}
+
+// Param records a parameter the flags do not show, e.g. a derived one.
+func (r *Run) Param(name string, value interface{}) {
+	r.Params[name] = fmt.Sprint(value)
+}
+
+// Add appends observations of a metric.
+func (r *Run) Add(metric, unit string, higherIsBetter bool, values ...float64) {
+	s, ok := r.Metrics[metric]
+	if !ok {
+		s = &Sample{Unit: unit, HigherIsBetter: higherIsBetter}
+		r.Metrics[metric] = s
+	}
+	s.Values = append(s.Values, values...)
+}
+
+// AddResult records throughput, one sample per reporting interval (or one
+// for the whole run when it had no intervals).
+func (r *Run) AddResult(res measure.Result) {
+	if len(res.Intervals) == 0 {
+		if res.Elapsed > 0 {
+			r.Add("throughput", "calls/s", true, res.CallsPerSec())
+			r.Add("bandwidth", "MB/s", true, res.MBPerSec())
+		}
+		return
+	}
+	for _, iv := range res.Intervals {
+		if iv.Length <= 0 {
+			continue
+		}
+		r.Add("throughput", "calls/s", true, iv.CallsPerSec())
+		r.Add("bandwidth", "MB/s", true, iv.MBPerSec())
+	}
+}
+
+// AddLatency records the distribution of h for plotting, and its median and
+// 99th percentile as metrics.
+func (r *Run) AddLatency(h *measure.Histogram) {
+	r.addLatency("", h)
+}
+
+// AddLatencyBySize records AddLatency's numbers for every size bucket, as
+// "latency <=4KiB" and "latency-p99 <=4KiB".
+func (r *Run) AddLatencyBySize(s *measure.BySize) {
+	for _, b := range s.Buckets() {
+		r.addLatency(" "+b.Name(), &b.Latency)
+	}
+}
+
+func (r *Run) addLatency(suffix string, h *measure.Histogram) {
+	if h.Count() == 0 {
+		return
+	}
+	if r.CDFs == nil {
+		r.CDFs = make(map[string][]measure.CDFPoint)
+	}
+	r.CDFs["latency"+suffix] = h.CDF()
+	r.Add("latency-p50"+suffix, "µs", false, float64(h.Percentile(0.5))/1e3)
+	r.Add("latency-p99"+suffix, "µs", false, float64(h.Percentile(0.99))/1e3)
+}
+
+// AddRuntime records allocation and GC cost per call.
+func (r *Run) AddRuntime(d profiling.Delta, calls int64) {
+	if calls <= 0 {
+		return
+	}
+	r.Add("allocs", "allocs/call", false, float64(d.Allocs.Objects)/float64(calls))
+	r.Add("alloc-bytes", "B/call", false, float64(d.Allocs.Bytes)/float64(calls))
+	if d.Elapsed > 0 {
+		r.Add("gc-pause", "%", false, 100*d.PauseTotal.Seconds()/d.Elapsed.Seconds())
+	}
+}
+
+// AddPayload records how well a run's message content compresses, with
+// Snappy and with DEFLATE, since that changes what a codec or Snappy gains.
+func (r *Run) AddPayload(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	r.Add("payload-ratio", "snappy/raw", false, payload.Ratio(b))
+	r.Add("payload-deflate-ratio", "deflate/raw", false, payload.DeflateRatio(b))
+}
+
+type Flags struct {
+	Dir string
+}
+
+// AddFlags registers -results on flag.CommandLine.
+func AddFlags() *Flags {
+	f := new(Flags)
+	flag.StringVar(&f.Dir, "results", DefaultDir(), "store results as JSON in this directory (- to not store)")
+	return f
+}
+
+// DefaultDir is $GORPC_RESULTS, else ~/.gorpc-tests/results.
+func DefaultDir() string {
+	if d := os.Getenv("GORPC_RESULTS"); d != "" {
+		return d
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "results"
+	}
+	return filepath.Join(home, ".gorpc-tests", "results")
+}
+
+// Save stores r unless storing is off. A benchmark's numbers are worth more
+// than its record, so failing to store only prints a warning.
+func (f *Flags) Save(r *Run) {
+	if f == nil || f.Dir == "-" || f.Dir == "" {
+		return
+	}
+	path, err := Store{f.Dir}.Save(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "results: not stored:", err)
+		return
+	}
+	fmt.Printf("Results stored as %s (%s)\n", r.ID, path)
+}
+
+// Store is a directory of runs, one JSON file each.
+type Store struct {
+	Dir string
+}
+
+func shortCommit(c string) string {
+	if len(c) > 12 {
+		return c[:12]
+	}
+	return c
+}
+
+// Save writes r, giving it an ID if it has none, and returns its path.
+func (s Store) Save(r *Run) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", err
+	}
+	if r.ID == "" {
+		name := strings.NewReplacer("/", "_", " ", "_").Replace(r.Benchmark)
+		r.ID = fmt.Sprintf("%s%03d-%s-%s", r.Time.UTC().Format("20060102T150405"),
+			r.Time.Nanosecond()/1e6, name, shortCommit(r.Commit))
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.Dir, r.ID+".json")
+	return path, ioutil.WriteFile(path, data, 0644)
+}
+
+// Load reads every run, oldest first.
+func (s Store) Load() ([]*Run, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var runs []*Run
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		r := new(Run)
+		if err := json.Unmarshal(data, r); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		runs = append(runs, r)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Time.Before(runs[j].Time) })
+	return runs, nil
+}
+
+var ErrNoRuns = errors.New("no runs match")
+
+// Select picks runs by
+//
+//	go:VERSION     every run built with that Go version, e.g. go:go1.22.1
+//	COMMIT prefix  every run of that commit
+//	ID prefix      the matching run(s)
+//	latest         the newest run
+func Select(runs []*Run, sel string) ([]*Run, error) {
+	var picked []*Run
+	switch {
+	case sel == "latest":
+		if len(runs) > 0 {
+			picked = runs[len(runs)-1:]
+		}
+	case strings.HasPrefix(sel, "go:"):
+		for _, r := range runs {
+			if r.GoVersion == strings.TrimPrefix(sel, "go:") {
+				picked = append(picked, r)
+			}
+		}
+	default:
+		for _, r := range runs {
+			if strings.HasPrefix(r.Commit, sel) {
+				picked = append(picked, r)
+			}
+		}
+		if picked == nil {
+			for _, r := range runs {
+				if strings.HasPrefix(r.ID, sel) {
+					picked = append(picked, r)
+				}
+			}
+		}
+	}
+	if picked == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNoRuns, sel)
+	}
+	return picked, nil
+}
@@ -0,0 +1,198 @@
+package results
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"gorpc-tests/measure"
+)
+
+func run(benchmark, commit string, at time.Time, params map[string]string) *Run {
+	return &Run{Benchmark: benchmark, Commit: commit, Time: at, GoVersion: "go1.22",
+		Params: params, Metrics: make(map[string]*Sample)}
+}
+
+func TestAddResult(t *testing.T) {
+	r := run("throughput", "", time.Now(), nil)
+	r.AddResult(measure.Result{Calls: 100, Bytes: 1e6, Elapsed: time.Second})
+	if s := r.Metrics["throughput"]; len(s.Values) != 1 || s.Values[0] != 100 || !s.HigherIsBetter {
+		t.Errorf("without intervals: %+v", s)
+	}
+	r = run("throughput", "", time.Now(), nil)
+	r.AddResult(measure.Result{Intervals: []measure.Interval{
+		{Calls: 10, Length: time.Second}, {Calls: 0, Length: 0}, {Calls: 40, Length: 2 * time.Second},
+	}})
+	if s := r.Metrics["throughput"]; len(s.Values) != 2 || s.Values[0] != 10 || s.Values[1] != 20 {
+		t.Errorf("with intervals: %+v", s)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	r := run("throughput", "", time.Now(), nil)
+	var h measure.Histogram
+	r.AddLatency(&h)
+	if len(r.Metrics) != 0 {
+		t.Errorf("an empty histogram recorded %v", r.Metrics)
+	}
+	h.Record(time.Millisecond)
+	r.AddLatency(&h)
+	if s := r.Metrics["latency-p50"]; s == nil || s.Values[0] != 1000 || s.HigherIsBetter {
+		t.Errorf("latency-p50 %+v, want 1000µs", s)
+	}
+	if len(r.CDFs["latency"]) == 0 {
+		t.Error("no CDF recorded")
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := Store{t.TempDir()}
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	older := run("throughput", "0123456789abcdef", base, map[string]string{"n": "1"})
+	newer := run("throughput", "fedcba9876543210", base.Add(time.Hour), map[string]string{"n": "1"})
+	newer.Add("throughput", "calls/s", true, 1, 2, 3)
+	for _, r := range []*Run{newer, older} {
+		if _, err := store.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.HasSuffix(older.ID, "-throughput-0123456789ab") {
+		t.Errorf("ID %q", older.ID)
+	}
+	runs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].ID != older.ID || runs[1].ID != newer.ID {
+		t.Fatalf("loaded %d runs, not oldest first", len(runs))
+	}
+	if s := runs[1].Metrics["throughput"]; s == nil || len(s.Values) != 3 || s.Unit != "calls/s" {
+		t.Errorf("metric came back as %+v", s)
+	}
+	for sel, want := range map[string]*Run{"latest": newer, "fedcba": newer, "go:go1.22": older, older.ID[:20]: older} {
+		picked, err := Select(runs, sel)
+		if err != nil || picked[0].ID != want.ID {
+			t.Errorf("Select(%q) = %v, %v", sel, picked, err)
+		}
+	}
+	if _, err := Select(runs, "go:go1.1"); !errors.Is(err, ErrNoRuns) {
+		t.Errorf("Select of nothing: %v", err)
+	}
+}
+
+// Profile flags do not change what a run measures; other flags do
+func TestKey(t *testing.T) {
+	now := time.Now()
+	a := run("b", "", now, map[string]string{"n": "1", "cpuprofile": "a.prof"})
+	b := run("b", "", now, map[string]string{"n": "1"})
+	c := run("b", "", now, map[string]string{"n": "2"})
+	if a.Key() != b.Key() || a.Key() == c.Key() {
+		t.Errorf("keys %q, %q, %q", a.Key(), b.Key(), c.Key())
+	}
+}
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	// runs of 10 intervals each, about base calls/s
+	runs := func(n int, base float64) []*Run {
+		var rs []*Run
+		for j := 0; j < n; j++ {
+			r := run("b", "", now, map[string]string{})
+			for i := 0; i < 10; i++ {
+				r.Add("throughput", "calls/s", true, base+float64(i+j))
+				r.Add("latency-p50", "µs", false, 100+float64(i))
+			}
+			rs = append(rs, r)
+		}
+		return rs
+	}
+	other := run("other", "", now, map[string]string{})
+	other.Add("throughput", "calls/s", true, 1)
+	opts := CompareOptions{Alpha: 0.05, Threshold: 0.05}
+	deltas := Compare(append(runs(5, 1000), other), runs(5, 800), opts)
+	if len(deltas) != 2 {
+		t.Fatalf("%d deltas, want the 2 metrics of the shared configuration", len(deltas))
+	}
+	lat, tp := deltas[0], deltas[1]
+	if len(tp.Old) != 5 || len(tp.New) != 5 {
+		t.Errorf("%d and %d samples, want one per run", len(tp.Old), len(tp.New))
+	}
+	if tp.Metric != "throughput" || !tp.Regression || tp.Verdict != "REGRESSION" || tp.Hi >= 0 {
+		t.Errorf("throughput down 20%%: %+v", tp)
+	}
+	if lat.Verdict != "~" || lat.Change != 0 {
+		t.Errorf("unchanged latency: %+v", lat)
+	}
+	var out strings.Builder
+	PrintDeltas(&out, deltas)
+	if !strings.Contains(out.String(), "REGRESSION") {
+		t.Errorf("printed\n%s", out.String())
+	}
+	// the intervals of one run are not samples of their own, and 3 runs a
+	// side can never reach p < 0.05
+	for _, n := range []int{1, 3} {
+		if d := Compare(runs(n, 1000), runs(n, 800), opts); d[1].Verdict != TooFewRuns {
+			t.Errorf("%d runs a side: %+v", n, d[1])
+		}
+	}
+	if d := Compare(runs(4, 1000), runs(4, 800), opts); d[1].Verdict != "REGRESSION" {
+		t.Errorf("4 runs a side: %+v", d[1])
+	}
+}
+
+func TestMinP(t *testing.T) {
+	for _, c := range []struct {
+		n1, n2 int
+		want   float64
+	}{{3, 3, 0.1}, {4, 4, 2.0 / 70}, {2, 3, 0.2}, {0, 5, 1}, {1, 1, 1}} {
+		if p := MinP(c.n1, c.n2); math.Abs(p-c.want) > 1e-9 {
+			t.Errorf("MinP(%d, %d) = %v, want %v", c.n1, c.n2, p, c.want)
+		}
+	}
+}
+
+func TestMedian(t *testing.T) {
+	if Median([]float64{3, 1, 2}) != 2 || Median([]float64{4, 1, 3, 2}) != 2.5 || !math.IsNaN(Median(nil)) {
+		t.Error("wrong median")
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	for _, c := range []struct {
+		a, b []float64
+		want float64
+	}{
+		// 1 of the 20 orders of 3 and 3 is this extreme, each way
+		{[]float64{1, 2, 3}, []float64{4, 5, 6}, 0.1},
+		{[]float64{4, 5, 6}, []float64{1, 2, 3}, 0.1},
+		{[]float64{1, 2}, []float64{4, 5, 6}, 0.2},
+		{[]float64{}, []float64{4, 5, 6}, 1},
+		{[]float64{1, 1, 1}, []float64{1, 1, 1}, 1},
+	} {
+		if p := MannWhitney(c.a, c.b); math.Abs(p-c.want) > 1e-9 {
+			t.Errorf("MannWhitney(%v, %v) = %v, want %v", c.a, c.b, p, c.want)
+		}
+	}
+	var a, b []float64
+	for i := 0; i < 40; i++ {
+		a = append(a, float64(i))
+		b = append(b, float64(i)+20)
+	}
+	if p := MannWhitney(a, b); p > 0.001 {
+		t.Errorf("normal approximation: p = %v for a shift of half the range", p)
+	}
+}
+
+func TestBootstrapChange(t *testing.T) {
+	a := []float64{100, 101, 99, 100, 102, 98}
+	b := []float64{110, 111, 109, 110, 112, 108}
+	lo, hi := BootstrapChange(a, b, 0.95, 2000)
+	if lo > 0.1 || hi < 0.1 || lo <= 0 {
+		t.Errorf("interval [%v, %v], want it around +10%%", lo, hi)
+	}
+	if lo2, hi2 := BootstrapChange(a, b, 0.95, 2000); lo2 != lo || hi2 != hi {
+		t.Error("the interval changed between calls")
+	}
+}
@@ -0,0 +1,166 @@
+package results
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+func Median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+// exactLimit bounds the sample sizes for which MannWhitney counts the exact
+// distribution of U rather than using the normal approximation.
+const exactLimit = 25
+
+// MannWhitney returns the two-sided p-value of the Mann-Whitney U test that
+// a and b come from the same distribution. Small samples without ties get
+// the exact distribution; the rest the normal approximation with tie
+// correction. An empty sample reports 1.
+func MannWhitney(a, b []float64) float64 {
+	n1, n2 := len(a), len(b)
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	type obs struct {
+		v     float64
+		fromA bool
+	}
+	all := make([]obs, 0, n1+n2)
+	for _, v := range a {
+		all = append(all, obs{v, true})
+	}
+	for _, v := range b {
+		all = append(all, obs{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// ranks from 1, ties sharing their average rank
+	var rankA, tieTerm float64
+	ties := false
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankA += rank
+			}
+		}
+		if t := float64(j - i); t > 1 {
+			ties = true
+			tieTerm += t*t*t - t
+		}
+		i = j
+	}
+	u := rankA - float64(n1*(n1+1))/2
+
+	if !ties && n1 <= exactLimit && n2 <= exactLimit {
+		return exactP(n1, n2, int(u))
+	}
+	n := float64(n1 + n2)
+	mean := float64(n1*n2) / 2
+	variance := float64(n1*n2) / 12 * ((n + 1) - tieTerm/(n*(n-1)))
+	if variance == 0 {
+		return 1
+	}
+	z := math.Abs(u-mean) - 0.5 // continuity correction
+	if z < 0 {
+		z = 0
+	}
+	return math.Min(1, math.Erfc(z/math.Sqrt(2*variance)))
+}
+
+// MinP is the smallest p-value MannWhitney can give samples of n1 and n2:
+// the two orders that separate them completely, out of all C(n1+n2, n1).
+// No change is significant at an alpha up to MinP, however large it is; 3
+// runs against 3 give 0.1, so alpha 0.05 takes 4 a side.
+func MinP(n1, n2 int) float64 {
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	p := 2.0
+	for i := 1; i <= n1; i++ {
+		p *= float64(i) / float64(n2+i)
+	}
+	return math.Min(1, p)
+}
+
+// exactP counts the arrangements of n1 a's and n2 b's by U, the number of
+// (a, b) pairs with a above b: the largest element is an a, adding n2, or
+// a b, adding nothing.
+func exactP(n1, n2, u int) float64 {
+	counts := make([][][]float64, n1+1)
+	for i := range counts {
+		counts[i] = make([][]float64, n2+1)
+		for j := range counts[i] {
+			counts[i][j] = make([]float64, i*j+1)
+			if i == 0 || j == 0 {
+				counts[i][j][0] = 1
+				continue
+			}
+			for k := range counts[i][j] {
+				if k >= j && k-j < len(counts[i-1][j]) {
+					counts[i][j][k] += counts[i-1][j][k-j]
+				}
+				if k < len(counts[i][j-1]) {
+					counts[i][j][k] += counts[i][j-1][k]
+				}
+			}
+		}
+	}
+	dist := counts[n1][n2]
+	var total, below, above float64
+	for k, c := range dist {
+		total += c
+		if k <= u {
+			below += c
+		}
+		if k >= u {
+			above += c
+		}
+	}
+	return math.Min(1, 2*math.Min(below, above)/total)
+}
+
+// BootstrapChange is a confidence interval for median(b)/median(a) - 1 from
+// resampling both samples; level is e.g. 0.95. The seed is fixed so the
+// same results always give the same interval.
+func BootstrapChange(a, b []float64, level float64, iterations int) (lo, hi float64) {
+	if len(a) == 0 || len(b) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	rng := rand.New(rand.NewSource(1))
+	resample := func(xs, into []float64) []float64 {
+		for i := range into {
+			into[i] = xs[rng.Intn(len(xs))]
+		}
+		return into
+	}
+	ra, rb := make([]float64, len(a)), make([]float64, len(b))
+	changes := make([]float64, 0, iterations)
+	for i := 0; i < iterations; i++ {
+		ma := Median(resample(a, ra))
+		if ma == 0 {
+			continue
+		}
+		changes = append(changes, Median(resample(b, rb))/ma-1)
+	}
+	if len(changes) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	sort.Float64s(changes)
+	tail := (1 - level) / 2
+	return changes[int(tail*float64(len(changes)))], changes[int((1-tail)*float64(len(changes)-1))]
+}
@@ -0,0 +1,196 @@
+/* Deadlines and cancellation for net/rpc calls
+ *
+ * net/rpc has no notion of a deadline: c.Call blocks until the server
+ * replies, forever if it hangs. Call and Go here wait on a context instead
+ * and give up with ctx.Err() once it is done.
+ *
+ * net/rpc cannot take a request back, so a call that timed out still holds
+ * its slot on the connection and its reply is still decoded into reply when
+ * (if) it arrives. Callers must not reuse reply after a timeout.
+ *
+ * A Tracker applies one per-call timeout to every call, and counts how many
+ * calls completed, how long they took, and how many timed out (per method and
+ * per second of the run).
+ *
+ * Basic usage:
+ *   t := rpcctx.NewTracker(500 * time.Millisecond)
+ *   err := t.Call(client, "Arith.Echo", args, &reply)
+ *   if rpcctx.IsTimeout(err) { ... }
+ *   t.Report(os.Stdout)
+ */
+
+package rpcctx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"gorpc-tests/measure"
+)
+
+// Goer is satisfied by *rpc.Client and every wrapper around it.
+type Goer interface {
+	Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call
+}
+
+// Call makes a call and waits for its reply or for ctx to be done.
+func Call(ctx context.Context, c Goer, serviceMethod string, args interface{}, reply interface{}) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	call := c.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Go starts a call whose result is delivered on done, either the reply or
+// ctx.Err() if ctx is done first.
+func Go(ctx context.Context, c Goer, serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 10)
+	} else if cap(done) == 0 {
+		panic("rpcctx: done channel is unbuffered")
+	}
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	inner := c.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	go func() {
+		select {
+		case <-inner.Done:
+			call.Error = inner.Error
+		case <-ctx.Done():
+			call.Error = ctx.Err()
+		}
+		done <- call
+	}()
+	return call
+}
+
+// IsTimeout reports whether err came from a deadline rather than the call.
+func IsTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+type Tracker struct {
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	calls    int64
+	timeouts int64
+	latency  measure.Histogram
+	byMethod map[string]int64
+	bySecond []int64
+}
+
+// NewTracker gives every call made through it the given timeout; zero means
+// no deadline, only accounting.
+func NewTracker(timeout time.Duration) *Tracker {
+	return &Tracker{Timeout: timeout, start: time.Now(), byMethod: make(map[string]int64)}
+}
+
+func (t *Tracker) context() (context.Context, context.CancelFunc) {
+	if t.Timeout > 0 {
+		return context.WithTimeout(context.Background(), t.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (t *Tracker) record(serviceMethod string, began time.Time, err error) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls++
+	if IsTimeout(err) {
+		t.timeouts++
+		t.byMethod[serviceMethod]++
+		sec := int(now.Sub(t.start) / time.Second)
+		for len(t.bySecond) <= sec {
+			t.bySecond = append(t.bySecond, 0)
+		}
+		t.bySecond[sec]++
+		return
+	}
+	t.latency.Record(now.Sub(began))
+}
+
+func (t *Tracker) Call(c Goer, serviceMethod string, args interface{}, reply interface{}) error {
+	ctx, cancel := t.context()
+	defer cancel()
+	began := time.Now()
+	err := Call(ctx, c, serviceMethod, args, reply)
+	t.record(serviceMethod, began, err)
+	return err
+}
+
+func (t *Tracker) Go(c Goer, serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	ctx, cancel := t.context()
+	began := time.Now()
+	if done == nil {
+		done = make(chan *rpc.Call, 10)
+	} else if cap(done) == 0 {
+		panic("rpcctx: done channel is unbuffered")
+	}
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	inner := Go(ctx, c, serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	go func() {
+		<-inner.Done
+		cancel()
+		t.record(serviceMethod, began, inner.Error)
+		call.Error = inner.Error
+		done <- call
+	}()
+	return call
+}
+
+func (t *Tracker) Timeouts() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timeouts
+}
+
+// Latency returns a copy of the latency histogram of the calls that completed.
+func (t *Tracker) Latency() *measure.Histogram {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.latency
+	return &h
+}
+
+// Report prints the call count, the latency of completed calls and where the
+// timeouts happened.
+func (t *Tracker) Report(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(w, "Calls: %d, timed out: %d (timeout %v)\n", t.calls, t.timeouts, t.Timeout)
+	fmt.Fprintf(w, "Latency of completed calls: %v\n", &t.latency)
+	if t.timeouts == 0 {
+		return
+	}
+	var methods []string
+	for m := range t.byMethod {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		fmt.Fprintf(w, "  timeouts in %s: %d\n", m, t.byMethod[m])
+	}
+	fmt.Fprintf(w, "  timeouts per second of the run:")
+	for sec, n := range t.bySecond {
+		if n > 0 {
+			fmt.Fprintf(w, " [%ds]=%d", sec, n)
+		}
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,111 @@
+package rpcctx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// server answers every call after delay, or never when delay is negative
+type server struct {
+	delay time.Duration
+	calls int64
+}
+
+func (s *server) Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	atomic.AddInt64(&s.calls, 1)
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	if s.delay >= 0 {
+		time.AfterFunc(s.delay, func() { done <- call })
+	}
+	return call
+}
+
+func TestCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Call(ctx, &server{delay: 0}, "S.M", nil, nil); err != nil {
+		t.Errorf("a prompt call returned %v", err)
+	}
+	if err := Call(ctx, &server{delay: -1}, "S.M", nil, nil); !IsTimeout(err) {
+		t.Errorf("a hung call returned %v", err)
+	}
+	// an expired context does not send the call at all
+	s := &server{}
+	if err := Call(ctx, s, "S.M", nil, nil); !IsTimeout(err) || s.calls != 0 {
+		t.Errorf("after the deadline: %v, %d calls sent", err, s.calls)
+	}
+	cancelled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	if err := Call(cancelled, &server{}, "S.M", nil, nil); err != context.Canceled || IsTimeout(err) {
+		t.Errorf("cancelled: %v", err)
+	}
+}
+
+func TestGo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan *rpc.Call, 2)
+	Go(ctx, &server{delay: 0}, "S.Fast", nil, nil, done)
+	Go(ctx, &server{delay: -1}, "S.Hung", nil, nil, done)
+	for i := 0; i < 2; i++ {
+		call := <-done
+		switch call.ServiceMethod {
+		case "S.Fast":
+			if call.Error != nil {
+				t.Errorf("prompt call: %v", call.Error)
+			}
+		case "S.Hung":
+			if !IsTimeout(call.Error) {
+				t.Errorf("hung call: %v", call.Error)
+			}
+		}
+	}
+}
+
+// A Tracker times out slow calls, counts them per method and keeps the
+// latency of the others
+func TestTracker(t *testing.T) {
+	tr := NewTracker(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := tr.Call(&server{delay: time.Millisecond}, "S.Fast", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.Call(&server{delay: -1}, "S.Hung", nil, nil); !IsTimeout(err) {
+		t.Errorf("hung Call returned %v", err)
+	}
+	call := <-tr.Go(&server{delay: -1}, "S.Hung", nil, nil, nil).Done
+	if !IsTimeout(call.Error) {
+		t.Errorf("hung Go returned %v", call.Error)
+	}
+	if tr.Timeouts() != 2 {
+		t.Errorf("%d timeouts, want 2", tr.Timeouts())
+	}
+	if lat := tr.Latency(); lat.Count() != 3 || lat.Min() < time.Millisecond {
+		t.Errorf("latency of the completed calls: %v", lat)
+	}
+	var out bytes.Buffer
+	tr.Report(&out)
+	for _, want := range []string{"Calls: 5, timed out: 2", "timeouts in S.Hung: 2", "[0s]=2"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// With no timeout a Tracker only counts
+func TestTrackerNoTimeout(t *testing.T) {
+	tr := NewTracker(0)
+	if err := tr.Call(&server{delay: 30 * time.Millisecond}, "S.Slow", nil, nil); err != nil {
+		t.Errorf("slow call with no timeout returned %v", err)
+	}
+	if IsTimeout(errors.New("timeout")) {
+		t.Error("IsTimeout matched an unrelated error")
+	}
+}
@@ -0,0 +1,213 @@
+/* Pooled net/rpc client
+ *
+ * A Pool holds several *rpc.Client connections to each of several servers
+ * and spreads calls across the servers with a pluggable balancing policy:
+ *
+ *   rr     round-robin over servers
+ *   least  server with the fewest outstanding calls
+ *   p2c    power of two choices: the less loaded of two random servers
+ *
+ * Within a server, calls rotate over its connections. Pool exposes the same
+ * Call/Go API as *rpc.Client, so benchmarks can take a Caller and run on
+ * either.
+ *
+ * Basic usage:
+ *   p, err := rpcpool.Dial("tcp", []string{"localhost:4000", "localhost:4001"}, 2, rpcpool.PowerOfTwo)
+ *   err = p.Call("Message.Echo", args, &reply)
+ */
+
+package rpcpool
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+)
+
+// Caller is the part of *rpc.Client the benchmarks use.
+type Caller interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+	Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call
+	Close() error
+}
+
+type Policy int
+
+const (
+	RoundRobin Policy = iota
+	LeastOutstanding
+	PowerOfTwo
+)
+
+var policyNames = []string{"rr", "least", "p2c"}
+
+func (p Policy) String() string {
+	if int(p) < len(policyNames) {
+		return policyNames[p]
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy accepts the names printed by Policy.String.
+func ParsePolicy(s string) (Policy, error) {
+	for i, name := range policyNames {
+		if s == name {
+			return Policy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown balancing policy %q (want rr, least or p2c)", s)
+}
+
+type backend struct {
+	addr        string
+	conns       []*rpc.Client
+	next        uint32
+	outstanding int64
+	calls       int64
+}
+
+func (b *backend) conn() *rpc.Client {
+	i := atomic.AddUint32(&b.next, 1)
+	return b.conns[int(i)%len(b.conns)]
+}
+
+// BackendStats is a snapshot of one server's load.
+type BackendStats struct {
+	Addr        string
+	Calls       int64
+	Outstanding int64
+}
+
+type Pool struct {
+	policy   Policy
+	backends []*backend
+	next     uint32
+	closeMu  sync.Mutex
+	closed   bool
+}
+
+// Dial opens connsPerServer connections to every address.
+func Dial(network string, addrs []string, connsPerServer int, policy Policy) (*Pool, error) {
+	dial := func(addr string) (*rpc.Client, error) { return rpc.Dial(network, addr) }
+	return DialWith(dial, addrs, connsPerServer, policy)
+}
+
+// DialWith is Dial with the connections made by dial.
+func DialWith(dial func(addr string) (*rpc.Client, error), addrs []string, connsPerServer int, policy Policy) (*Pool, error) {
+	if len(addrs) == 0 || connsPerServer < 1 {
+		return nil, errors.New("rpcpool: need at least one address and one connection per server")
+	}
+	p := &Pool{policy: policy}
+	for _, addr := range addrs {
+		// in the pool before dialing, so Close reaches a half-dialed backend
+		b := &backend{addr: addr}
+		p.backends = append(p.backends, b)
+		for i := 0; i < connsPerServer; i++ {
+			c, err := dial(addr)
+			if err != nil {
+				p.Close()
+				return nil, err
+			}
+			b.conns = append(b.conns, c)
+		}
+	}
+	return p, nil
+}
+
+func (p *Pool) pick() *backend {
+	bs := p.backends
+	if len(bs) == 1 {
+		return bs[0]
+	}
+	switch p.policy {
+	case LeastOutstanding:
+		// start the scan at a rotating offset so ties do not all land on bs[0]
+		start := int(atomic.AddUint32(&p.next, 1))
+		best := bs[start%len(bs)]
+		for i := 1; i < len(bs); i++ {
+			b := bs[(start+i)%len(bs)]
+			if atomic.LoadInt64(&b.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = b
+			}
+		}
+		return best
+	case PowerOfTwo:
+		i := rand.Intn(len(bs))
+		j := rand.Intn(len(bs) - 1)
+		if j >= i {
+			j++
+		}
+		if atomic.LoadInt64(&bs[j].outstanding) < atomic.LoadInt64(&bs[i].outstanding) {
+			return bs[j]
+		}
+		return bs[i]
+	}
+	i := atomic.AddUint32(&p.next, 1)
+	return bs[int(i)%len(bs)]
+}
+
+func (p *Pool) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	b := p.pick()
+	atomic.AddInt64(&b.outstanding, 1)
+	atomic.AddInt64(&b.calls, 1)
+	err := b.conn().Call(serviceMethod, args, reply)
+	atomic.AddInt64(&b.outstanding, -1)
+	return err
+}
+
+// Go behaves like (*rpc.Client).Go. The returned Call is the one delivered on
+// done once the chosen server has replied.
+func (p *Pool) Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 10)
+	} else if cap(done) == 0 {
+		panic("rpcpool: done channel is unbuffered")
+	}
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+
+	b := p.pick()
+	atomic.AddInt64(&b.outstanding, 1)
+	atomic.AddInt64(&b.calls, 1)
+	inner := b.conn().Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	go func() {
+		<-inner.Done
+		atomic.AddInt64(&b.outstanding, -1)
+		call.Error = inner.Error
+		done <- call
+	}()
+	return call
+}
+
+// Stats returns the load seen by every server so far.
+func (p *Pool) Stats() []BackendStats {
+	var stats []BackendStats
+	for _, b := range p.backends {
+		stats = append(stats, BackendStats{
+			Addr:        b.addr,
+			Calls:       atomic.LoadInt64(&b.calls),
+			Outstanding: atomic.LoadInt64(&b.outstanding),
+		})
+	}
+	return stats
+}
+
+func (p *Pool) Close() error {
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	if p.closed {
+		return rpc.ErrShutdown
+	}
+	p.closed = true
+	var firstErr error
+	for _, b := range p.backends {
+		for _, c := range b.conns {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,185 @@
+package rpcpool
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+type Svc struct {
+	release chan struct{}
+}
+
+func (s *Svc) Echo(args *int, reply *int) error {
+	*reply = *args
+	return nil
+}
+
+// Wait holds the call until release is closed
+func (s *Svc) Wait(args *int, reply *int) error {
+	<-s.release
+	return nil
+}
+
+// servers starts n servers on loopback ports; closing release lets their
+// Wait calls return.
+func servers(t *testing.T, n int) (addrs []string, release chan struct{}) {
+	release = make(chan struct{})
+	for i := 0; i < n; i++ {
+		server := rpc.NewServer()
+		server.Register(&Svc{release})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go server.Accept(l)
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs, release
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{RoundRobin, LeastOutstanding, PowerOfTwo} {
+		if got, err := ParsePolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParsePolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := ParsePolicy("random"); err == nil {
+		t.Error("ParsePolicy(random) accepted")
+	}
+}
+
+// Round robin gives every server the same share of calls
+func TestRoundRobin(t *testing.T) {
+	addrs, _ := servers(t, 3)
+	p, err := Dial("tcp", addrs, 2, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for i := 0; i < 30; i++ {
+		var reply int
+		if err := p.Call("Svc.Echo", &i, &reply); err != nil || reply != i {
+			t.Fatalf("Echo(%d) = %d, %v", i, reply, err)
+		}
+	}
+	for _, s := range p.Stats() {
+		if s.Calls != 10 || s.Outstanding != 0 {
+			t.Errorf("%s: %d calls, %d outstanding, want 10 and 0", s.Addr, s.Calls, s.Outstanding)
+		}
+	}
+}
+
+// least and p2c steer calls away from a server that is holding one
+func TestAvoidsLoaded(t *testing.T) {
+	for _, policy := range []Policy{LeastOutstanding, PowerOfTwo} {
+		addrs, release := servers(t, 2)
+		p, err := Dial("tcp", addrs, 1, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var zero int
+		held := p.Go("Svc.Wait", &zero, new(int), nil)
+		for i := 0; i < 10; i++ {
+			if err := p.Call("Svc.Echo", &i, new(int)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats := p.Stats()
+		if stats[0].Calls+stats[1].Calls != 11 || (stats[0].Calls != 1 && stats[1].Calls != 1) {
+			t.Errorf("%v: calls split %d/%d with one server holding a call", policy, stats[0].Calls, stats[1].Calls)
+		}
+		close(release)
+		<-held.Done
+		p.Close()
+	}
+}
+
+func TestGo(t *testing.T) {
+	addrs, _ := servers(t, 2)
+	p, err := Dial("tcp", addrs, 1, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	done := make(chan *rpc.Call, 10)
+	for i := 0; i < 10; i++ {
+		i := i
+		p.Go("Svc.Echo", &i, new(int), done)
+	}
+	for i := 0; i < 10; i++ {
+		call := <-done
+		if call.Error != nil || *call.Reply.(*int) != *call.Args.(*int) {
+			t.Errorf("Echo(%d) = %d, %v", *call.Args.(*int), *call.Reply.(*int), call.Error)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Go with an unbuffered done channel did not panic")
+		}
+	}()
+	p.Go("Svc.Echo", new(int), new(int), make(chan *rpc.Call))
+}
+
+// closeCounter records that its connection was closed
+type closeCounter struct {
+	net.Conn
+	mu     *sync.Mutex
+	closed *int
+}
+
+func (c closeCounter) Close() error {
+	c.mu.Lock()
+	*c.closed++
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// A dial that fails part way closes the connections already made
+func TestDialWithFails(t *testing.T) {
+	addrs, _ := servers(t, 2)
+	var mu sync.Mutex
+	dialed, closed := 0, 0
+	dial := func(addr string) (*rpc.Client, error) {
+		if dialed == 3 {
+			return nil, errors.New("refused")
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		dialed++
+		return rpc.NewClient(closeCounter{conn, &mu, &closed}), nil
+	}
+	if _, err := DialWith(dial, addrs, 2, RoundRobin); err == nil {
+		t.Fatal("DialWith succeeded with a failing dial")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if closed != 3 {
+		t.Errorf("%d of 3 dialed connections closed", closed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	addrs, _ := servers(t, 1)
+	p, err := Dial("tcp", addrs, 1, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != rpc.ErrShutdown {
+		t.Errorf("second Close returned %v", err)
+	}
+	if err := p.Call("Svc.Echo", new(int), new(int)); err != rpc.ErrShutdown {
+		t.Errorf("Call after Close returned %v", err)
+	}
+	if _, err := Dial("tcp", nil, 1, RoundRobin); err == nil {
+		t.Error("Dial with no addresses succeeded")
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * Runs the scenario files (see scenario) it is given, one after another:
+ * starts the servers, waits until they listen, runs the clients, injects
+ * the faults on schedule and stops the servers when the clients are done.
+ * Every run is stored (see results) tagged with the scenario's name.
+ *
+ * runscenario  [-bin directory of the installed binaries (default: PATH)]
+ *              [-results directory results are stored in]
+ *              [-dry-run print the commands and faults without running them]
+ *              scenario.json...
+ *
+ * Basic usage:
+ *   go install gorpc-tests/...
+ *   runscenario scenarios/windowed-batch.json
+ *   runscenario -dry-run scenarios/*.json
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gorpc-tests/scenario"
+)
+
+// Longest a server may take to start listening
+const readyTimeout = 10 * time.Second
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Fatal error ", err.Error())
+		os.Exit(1)
+	}
+}
+
+type runner struct {
+	bin     string
+	results string
+	dryRun  bool
+}
+
+func (r *runner) binary(name string) (string, error) {
+	if r.bin != "" {
+		return filepath.Join(r.bin, name), nil
+	}
+	return exec.LookPath(name)
+}
+
+func (r *runner) command(s *scenario.Scenario, binary string, p scenario.Proc) *exec.Cmd {
+	cmd := exec.Command(binary, p.Args...)
+	cmd.Dir = s.Dir
+	cmd.Env = append(os.Environ(), "GORPC_SCENARIO="+s.Name)
+	if r.results != "" {
+		cmd.Env = append(cmd.Env, "GORPC_RESULTS="+r.results)
+	}
+	return cmd
+}
+
+// server is a server process that faults may kill and restart.
+type server struct {
+	proc scenario.Proc
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{} // closed when cmd exits
+	shut bool          // the run is over; a pending restart must not start it
+}
+
+func (r *runner) start(s *scenario.Scenario, binary string, srv *server) error {
+	cmd := r.command(s, binary, srv.proc)
+	// servers' chatter would bury the clients' results
+	cmd.Stdout, cmd.Stderr = nil, os.Stderr
+	srv.mu.Lock()
+	if srv.shut {
+		srv.mu.Unlock()
+		return fmt.Errorf("%s: the run is over", srv.proc.Name)
+	}
+	if err := cmd.Start(); err != nil {
+		srv.mu.Unlock()
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	srv.cmd, srv.done = cmd, done
+	srv.mu.Unlock()
+	return waitListening(srv.proc.Addr, done)
+}
+
+// waitListening dials addr until it answers, the process exits or
+// readyTimeout passes.
+func waitListening(addr string, exited chan struct{}) error {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("server for %s exited before listening", addr)
+		default:
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not listening after %v", addr, readyTimeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (srv *server) signal(sig syscall.Signal) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.cmd != nil && srv.cmd.Process != nil {
+		srv.cmd.Process.Signal(sig)
+	}
+}
+
+func (srv *server) stop() {
+	srv.signal(syscall.SIGCONT)
+	srv.signal(syscall.SIGKILL)
+	srv.mu.Lock()
+	done := srv.done
+	srv.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// inject applies f to srv, logging what it did.
+func (r *runner) inject(s *scenario.Scenario, binary string, srv *server, f scenario.Fault) {
+	fmt.Printf("[%s] fault: %s %s\n", s.Name, f.Action, srv.proc.Name)
+	switch f.Action {
+	case scenario.Kill:
+		srv.stop()
+	case scenario.Restart:
+		srv.stop()
+		time.Sleep(time.Duration(f.For))
+		if err := r.start(s, binary, srv); err != nil {
+			fmt.Printf("[%s] fault: restarting %s: %v\n", s.Name, srv.proc.Name, err)
+			return
+		}
+		fmt.Printf("[%s] fault: %s back\n", s.Name, srv.proc.Name)
+	case scenario.Stall:
+		srv.signal(syscall.SIGSTOP)
+		time.Sleep(time.Duration(f.For))
+		srv.signal(syscall.SIGCONT)
+		fmt.Printf("[%s] fault: %s resumed\n", s.Name, srv.proc.Name)
+	}
+}
+
+func printPlan(s *scenario.Scenario, binary string, plan *scenario.Plan) {
+	fmt.Printf("[%s] %s, in %s, %d time(s)\n", s.Name, s.Description, plan.Dir, s.Repeat)
+	for _, p := range plan.Servers {
+		fmt.Printf("  server %s: %s %s\n", p.Name, binary, strings.Join(p.Args, " "))
+	}
+	for _, p := range plan.Clients {
+		fmt.Printf("  client %s: %s %s\n", p.Name, binary, strings.Join(p.Args, " "))
+	}
+	for _, f := range plan.Faults {
+		fmt.Printf("  fault at %v: %s %s", f.At, f.Action, plan.Servers[f.Server].Name)
+		if f.For > 0 {
+			fmt.Printf(" for %v", f.For)
+		}
+		fmt.Println()
+	}
+}
+
+// run executes a scenario once and returns whether every client succeeded.
+func (r *runner) run(s *scenario.Scenario, binary string, plan *scenario.Plan) bool {
+	servers := make([]*server, len(plan.Servers))
+	defer func() {
+		for _, srv := range servers {
+			if srv != nil {
+				srv.mu.Lock()
+				srv.shut = true
+				srv.mu.Unlock()
+				srv.stop()
+			}
+		}
+	}()
+	for i, p := range plan.Servers {
+		servers[i] = &server{proc: p}
+		if err := r.start(s, binary, servers[i]); err != nil {
+			fmt.Printf("[%s] starting %s: %v\n", s.Name, p.Name, err)
+			return false
+		}
+	}
+
+	finished := make(chan struct{})
+	for _, f := range plan.Faults {
+		timer := time.AfterFunc(time.Duration(f.At), func(f scenario.Fault) func() {
+			return func() {
+				select {
+				case <-finished:
+				default:
+					r.inject(s, binary, servers[f.Server], f)
+				}
+			}
+		}(f))
+		defer timer.Stop()
+	}
+
+	ok := true
+	var mu sync.Mutex
+	var w sync.WaitGroup
+	for _, p := range plan.Clients {
+		cmd := r.command(s, binary, p)
+		// one client writes straight through; several are prefixed
+		if len(plan.Clients) == 1 {
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		} else {
+			cmd.Stdout = &prefixWriter{prefix: p.Name + ": ", w: os.Stdout}
+			cmd.Stderr = &prefixWriter{prefix: p.Name + ": ", w: os.Stderr}
+		}
+		w.Add(1)
+		go func(p scenario.Proc) {
+			defer w.Done()
+			if err := cmd.Run(); err != nil {
+				fmt.Printf("[%s] %s: %v\n", s.Name, p.Name, err)
+				mu.Lock()
+				ok = false
+				mu.Unlock()
+			}
+		}(p)
+	}
+	w.Wait()
+	close(finished)
+	return ok
+}
+
+// prefixWriter prefixes every line written to w.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	mu     sync.Mutex
+	line   []byte
+}
+
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.line = append(pw.line, b...)
+	for {
+		i := bytes.IndexByte(pw.line, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		fmt.Fprintf(pw.w, "%s%s", pw.prefix, pw.line[:i+1])
+		pw.line = pw.line[i+1:]
+	}
+}
+
+func main() {
+	var r runner
+	flag.StringVar(&r.bin, "bin", "", "directory of the installed binaries (default: look them up in PATH)")
+	flag.StringVar(&r.results, "results", "", "store results in this directory (default: as the binaries do)")
+	flag.BoolVar(&r.dryRun, "dry-run", false, "print what each scenario would run without running it")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Println("Usage: ", os.Args[0], "[-bin dir] [-results dir] [-dry-run] scenario.json...")
+		os.Exit(2)
+	}
+
+	// every file is checked before anything runs
+	var scenarios []*scenario.Scenario
+	for _, path := range flag.Args() {
+		s, err := scenario.Load(path)
+		checkError(err)
+		scenarios = append(scenarios, s)
+	}
+
+	failed := 0
+	for _, s := range scenarios {
+		plan := s.Plan()
+		binary, err := r.binary(plan.Binary)
+		if err != nil && !r.dryRun {
+			checkError(err)
+		}
+		if binary == "" {
+			binary = plan.Binary
+		}
+		printPlan(s, binary, plan)
+		if r.dryRun {
+			continue
+		}
+		for i := 0; i < s.Repeat; i++ {
+			if s.Repeat > 1 {
+				fmt.Printf("[%s] run %d of %d\n", s.Name, i+1, s.Repeat)
+			}
+			if !r.run(s, binary, plan) {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d run(s) failed\n", failed)
+		os.Exit(1)
+	}
+}
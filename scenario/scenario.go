@@ -0,0 +1,387 @@
+/* Declarative benchmark scenarios
+ *
+ * A scenario is a JSON file describing one experiment: the service under
+ * test, how many servers and clients, the transport and codec, the payload,
+ * the window, how long to run, the work each call does on the server and
+ * the faults to inject. Checked into scenarios/, it replaces a line of shell
+ * history; runscenario turns it into the flags of the existing binaries and
+ * runs them.
+ *
+ *   {
+ *     "Name": "dfs-restart",
+ *     "Service": "dfs",
+ *     "Servers": 1, "Clients": 2,
+ *     "Payload": {"Size": 65536, "Snappy": true},
+ *     "Calls": 20000, "Retries": 10,
+ *     "Faults": [{"At": "2s", "Action": "restart", "Server": 0, "For": "500ms"}]
+ *   }
+ *
+ * Services and the binaries they run:
+ *
+ *   echo           throughput, servers in-process, calls one at a time
+ *   windowed-echo  windowedThroughput, servers in-process, Window calls in flight
+ *   dfs            snappy (dfs.go), one server process per server
+ *   paxos          paxos, 2F acceptor processes and the proposer as client
+ *
+ * Faults need servers in processes of their own, so only dfs and paxos
+ * take them. Durations are strings as for time.ParseDuration.
+ *
+ * Basic usage:
+ *   s, err := scenario.Load("scenarios/dfs-restart.json")
+ *   plan := s.Plan()
+ *   ... start plan.Servers, then plan.Clients, then plan.Faults ...
+ */
+
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorpc-tests/codec"
+	"gorpc-tests/payload"
+	"gorpc-tests/sizedist"
+)
+
+// Duration is a time.Duration written as "500ms" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration %s: want a string like \"2s\"", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+type Payload struct {
+	Kind   string // content, see payload; "" keeps each binary's default
+	Size   int    // bytes per message, or per block for dfs
+	Dist   string // echo services: message sizes, see sizedist; overrides Size
+	File   string // dfs: the file blocks are read from
+	Snappy bool   // dfs: ask for snappy-encoded blocks
+}
+
+// Fault actions
+const (
+	Kill    = "kill"    // SIGKILL the server for good
+	Restart = "restart" // SIGKILL it, start it again after For
+	Stall   = "stall"   // SIGSTOP it, SIGCONT after For
+)
+
+type Fault struct {
+	At     Duration // after the clients start
+	Action string
+	Server int // index into the plan's servers
+	For    Duration
+}
+
+type Scenario struct {
+	Name        string
+	Description string
+	Service     string
+	Servers     int
+	Clients     int
+	Transport   string // only tcp
+	Codec       string // one of codec.Names; dfs speaks only gob
+	Payload     Payload
+	Window      int      // windowed-echo: calls in flight per client
+	Calls       int      // per client
+	Warmup      string   // a call count or a duration, as -warmup takes
+	Duration    Duration // measure for this long instead of Calls
+	Work        Duration // server time per echo call
+	Balance     string   // rr, least or p2c: pool clients over all servers
+	Conns       int      // connections per server for a pooled client
+	Timeout     Duration
+	Retries     int
+	Faults      []Fault
+	Repeat      int      // run the whole scenario this many times
+	Dir         string   // working directory, relative to the scenario file
+	Flags       []string // passed to the clients as they are
+}
+
+// Services in the order the package doc lists them
+var Services = []string{"echo", "windowed-echo", "dfs", "paxos"}
+
+// Binaries run for each service, as go install names them
+var Binaries = map[string]string{
+	"echo":          "throughput",
+	"windowed-echo": "windowedThroughput",
+	"dfs":           "snappy",
+	"paxos":         "paxos",
+}
+
+// Load reads and validates a scenario. Without a Name it is named after
+// the file, and a relative Dir is taken from the file's directory.
+func Load(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(Scenario)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if !filepath.IsAbs(s.Dir) {
+		s.Dir = filepath.Join(filepath.Dir(path), s.Dir)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// paxos runs 2F+1 acceptors; the proposer on PaxosPort is one of them.
+const (
+	PaxosF    = 5
+	PaxosPort = 9000
+	DFSPort   = 1337
+)
+
+// Validate fills in defaults and rejects what the binaries cannot do.
+func (s *Scenario) Validate() error {
+	if _, ok := Binaries[s.Service]; !ok {
+		return fmt.Errorf("unknown service %q, want one of %v", s.Service, Services)
+	}
+	if s.Transport != "" && s.Transport != "tcp" {
+		return fmt.Errorf("transport %q: only tcp is supported", s.Transport)
+	}
+	if s.Codec != "" {
+		if err := codec.Check(s.Codec); err != nil {
+			return err
+		}
+		if s.Codec != "gob" && s.Service == "dfs" {
+			return fmt.Errorf("codec %q: dfs only speaks gob", s.Codec)
+		}
+	}
+	if s.Servers == 0 {
+		s.Servers = 1
+		if s.Service == "paxos" {
+			s.Servers = 2 * PaxosF
+		}
+	}
+	if s.Clients == 0 {
+		s.Clients = 1
+	}
+	if s.Repeat == 0 {
+		s.Repeat = 1
+	}
+	if s.Servers < 0 || s.Clients < 0 || s.Repeat < 0 || s.Calls < 0 || s.Window < 0 || s.Payload.Size < 0 {
+		return errors.New("counts and sizes must not be negative")
+	}
+	if s.Payload.Kind != "" {
+		if err := payload.Check(s.Payload.Kind); err != nil {
+			return err
+		}
+	}
+	if s.Payload.Dist != "" {
+		if s.Service != "echo" && s.Service != "windowed-echo" {
+			return fmt.Errorf("%s takes no size distribution", s.Service)
+		}
+		if _, err := sizedist.Parse(s.Payload.Dist, 0); err != nil {
+			return err
+		}
+	}
+	if s.Payload.File != "" && s.Payload.Kind != "" {
+		return errors.New("payload: give a File or a Kind, not both")
+	}
+	switch s.Service {
+	case "echo":
+		if s.Window > 1 {
+			return errors.New("echo makes one call at a time; use windowed-echo for a window")
+		}
+		if s.Balance != "" && s.Retries > 0 {
+			return errors.New("echo retries over one connection per client, so it takes Balance or Retries, not both")
+		}
+	case "windowed-echo":
+		if s.Retries > 0 {
+			return errors.New("windowed-echo does not retry")
+		}
+	case "dfs":
+		if s.Window > 0 || s.Balance != "" || s.Work > 0 || s.Duration > 0 || s.Warmup != "" {
+			return errors.New("dfs takes no Window, Balance, Work, Duration or Warmup")
+		}
+	case "paxos":
+		if s.Servers != 2*PaxosF || s.Clients != 1 {
+			return fmt.Errorf("paxos runs %d acceptors and 1 proposer (F=%d is a constant in paxos.go)", 2*PaxosF, PaxosF)
+		}
+		if s.Payload != (Payload{}) || s.Window > 0 || s.Calls > 0 || s.Balance != "" || s.Work > 0 ||
+			s.Duration > 0 || s.Warmup != "" || s.Retries > 0 {
+			return errors.New("paxos takes only Codec, Timeout and Faults (it always decides MAX_ITER values)")
+		}
+	}
+	for i, f := range s.Faults {
+		if s.Service == "echo" || s.Service == "windowed-echo" {
+			return fmt.Errorf("%s runs its servers in-process, so faults cannot be injected", s.Service)
+		}
+		if f.Server < 0 || f.Server >= s.Servers {
+			return fmt.Errorf("fault %d: no server %d", i, f.Server)
+		}
+		switch f.Action {
+		case Kill:
+		case Restart, Stall:
+			if f.For <= 0 {
+				return fmt.Errorf("fault %d: %s needs For", i, f.Action)
+			}
+		default:
+			return fmt.Errorf("fault %d: unknown action %q, want kill, restart or stall", i, f.Action)
+		}
+	}
+	return nil
+}
+
+// Proc is one process of a plan.
+type Proc struct {
+	Name string
+	Args []string // after the binary
+	Addr string   // servers: where they listen once ready
+}
+
+type Plan struct {
+	Binary  string
+	Dir     string
+	Servers []Proc
+	Clients []Proc
+	Faults  []Fault
+}
+
+// Plan maps the scenario onto the flags of its service's binary.
+func (s *Scenario) Plan() *Plan {
+	p := &Plan{Binary: Binaries[s.Service], Dir: s.Dir, Faults: s.Faults}
+	var common []string
+	flag := func(name string, value interface{}) {
+		common = append(common, fmt.Sprintf("-%s=%v", name, value))
+	}
+	if s.Timeout > 0 {
+		flag("timeout", s.Timeout)
+	}
+	if s.Warmup != "" {
+		flag("warmup", s.Warmup)
+	}
+	if s.Duration > 0 {
+		flag("duration", s.Duration)
+	}
+	if s.Balance != "" {
+		flag("balance", s.Balance)
+	}
+	if s.Conns > 0 {
+		flag("conns", s.Conns)
+	}
+	if s.Payload.Kind != "" && s.Service != "dfs" {
+		flag("payload", s.Payload.Kind)
+	}
+	if s.Payload.Dist != "" {
+		flag("dist", s.Payload.Dist)
+	}
+	// dfs takes no -codec; Validate keeps it to gob
+	if s.Codec != "" && s.Service != "dfs" {
+		flag("codec", s.Codec)
+	}
+	switch s.Service {
+	case "echo":
+		flag("clients", s.Clients)
+		flag("servers", s.Servers)
+		if s.Calls > 0 {
+			flag("windows", s.Calls)
+		}
+		if s.Payload.Size > 0 {
+			flag("size", s.Payload.Size)
+		}
+		flag("work", time.Duration(s.Work))
+		if s.Retries > 0 {
+			flag("retries", s.Retries)
+		}
+		p.Clients = append(p.Clients, Proc{Name: "client", Args: append(common, s.Flags...)})
+	case "windowed-echo":
+		flag("nc", s.Clients)
+		flag("ns", s.Servers)
+		if s.Calls > 0 {
+			flag("nm", s.Calls)
+		}
+		if s.Payload.Size > 0 {
+			flag("ml", s.Payload.Size)
+		}
+		if s.Window > 0 {
+			flag("ws", s.Window)
+		}
+		flag("work", time.Duration(s.Work))
+		p.Clients = append(p.Clients, Proc{Name: "client", Args: append(common, s.Flags...)})
+	case "dfs":
+		// servers and clients alike are told where blocks come from
+		var file []string
+		if s.Payload.File != "" {
+			file = []string{"-file=" + s.Payload.File}
+		}
+		if s.Payload.Kind != "" {
+			file = []string{"-payload=" + s.Payload.Kind}
+		}
+		for i := 0; i < s.Servers; i++ {
+			port := DFSPort + i
+			p.Servers = append(p.Servers, Proc{
+				Name: fmt.Sprintf("server%d", i),
+				Args: append([]string{"-server", "-port=" + strconv.Itoa(port)}, file...),
+				Addr: fmt.Sprintf("127.0.0.1:%d", port),
+			})
+		}
+		if s.Calls > 0 {
+			flag("calls", s.Calls)
+		}
+		if s.Payload.Size > 0 {
+			flag("block", s.Payload.Size)
+		}
+		if s.Payload.Snappy {
+			flag("snappy", true)
+		}
+		if s.Retries > 0 {
+			flag("retries", s.Retries)
+		}
+		common = append(common, file...)
+		// clients are spread over the servers as windowedThroughput does
+		for i := 0; i < s.Clients; i++ {
+			args := append([]string{"-port=" + strconv.Itoa(DFSPort+i%s.Servers)}, common...)
+			p.Clients = append(p.Clients, Proc{Name: fmt.Sprintf("client%d", i), Args: append(args, s.Flags...)})
+		}
+	case "paxos":
+		// acceptors serve the codec the proposer dials with
+		var serverCodec []string
+		if s.Codec != "" {
+			serverCodec = []string{"-codec=" + s.Codec}
+		}
+		for i := 1; i <= s.Servers; i++ {
+			port := PaxosPort + i
+			p.Servers = append(p.Servers, Proc{
+				Name: fmt.Sprintf("acceptor%d", i),
+				Args: append([]string{"-p=" + strconv.Itoa(port)}, serverCodec...),
+				Addr: fmt.Sprintf("127.0.0.1:%d", port),
+			})
+		}
+		args := append([]string{"-prop", "-p=" + strconv.Itoa(PaxosPort)}, common...)
+		p.Clients = append(p.Clients, Proc{Name: "proposer", Args: append(args, s.Flags...)})
+	}
+	return p
+}
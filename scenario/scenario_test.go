@@ -0,0 +1,121 @@
+package scenario
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every checked-in scenario loads and plans
+func TestCheckedIn(t *testing.T) {
+	files, err := filepath.Glob("../scenarios/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no scenarios: %v", err)
+	}
+	for _, file := range files {
+		s, err := Load(file)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		p := s.Plan()
+		if p.Binary == "" || len(p.Clients) == 0 {
+			t.Errorf("%s: plan %+v", file, p)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	s := &Scenario{Service: "paxos"}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Servers != 2*PaxosF || s.Clients != 1 || s.Repeat != 1 {
+		t.Errorf("paxos defaults: %+v", s)
+	}
+	p := s.Plan()
+	if len(p.Servers) != 2*PaxosF || p.Servers[0].Addr != "127.0.0.1:9001" || p.Clients[0].Args[0] != "-prop" {
+		t.Errorf("paxos plan: %+v", p)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, s := range []Scenario{
+		{Service: "ftp"},
+		{Service: "echo", Transport: "udp"},
+		{Service: "dfs", Codec: "batch"},
+		{Service: "echo", Codec: "json"},
+		{Service: "echo", Window: 4},
+		{Service: "echo", Balance: "rr", Retries: 1},
+		{Service: "windowed-echo", Retries: 1},
+		{Service: "dfs", Window: 4},
+		{Service: "paxos", Calls: 10},
+		{Service: "paxos", Clients: 2},
+		{Service: "echo", Calls: -1},
+		{Service: "dfs", Payload: Payload{Dist: "uniform:1-10"}},
+		{Service: "echo", Payload: Payload{Kind: "noise"}},
+		{Service: "windowed-echo", Faults: []Fault{{Action: Kill}}},
+		{Service: "dfs", Faults: []Fault{{Action: Kill, Server: 1}}},
+		{Service: "dfs", Faults: []Fault{{Action: Restart}}},
+		{Service: "dfs", Faults: []Fault{{Action: "pause", For: Duration(time.Second)}}},
+	} {
+		s := s
+		if err := s.Validate(); err == nil {
+			t.Errorf("%+v accepted", s)
+		}
+	}
+}
+
+// The flags a plan passes are the ones its binary takes
+func TestPlanFlags(t *testing.T) {
+	s := &Scenario{Service: "windowed-echo", Servers: 2, Clients: 3, Calls: 100, Window: 8,
+		Codec: "batch", Payload: Payload{Size: 512}, Work: Duration(time.Millisecond)}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(s.Plan().Clients[0].Args, " ")
+	want := "-codec=batch -nc=3 -ns=2 -nm=100 -ml=512 -ws=8 -work=1ms"
+	if args != want {
+		t.Errorf("windowed-echo args %q, want %q", args, want)
+	}
+	s = &Scenario{Service: "dfs", Servers: 2, Clients: 3, Calls: 10, Payload: Payload{Size: 4096, Snappy: true}}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := s.Plan()
+	if len(p.Servers) != 2 || len(p.Clients) != 3 {
+		t.Fatalf("dfs plan: %+v", p)
+	}
+	if args := strings.Join(p.Clients[2].Args, " "); args != "-port=1337 -calls=10 -block=4096 -snappy=true" {
+		t.Errorf("the third dfs client: %q", args)
+	}
+}
+
+// Acceptors serve the codec the proposer dials with
+func TestPaxosCodec(t *testing.T) {
+	s := &Scenario{Service: "paxos", Codec: "compress"}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := s.Plan()
+	if args := strings.Join(p.Servers[0].Args, " "); args != "-p=9001 -codec=compress" {
+		t.Errorf("acceptor args %q", args)
+	}
+	if args := strings.Join(p.Clients[0].Args, " "); args != "-prop -p=9000 -codec=compress" {
+		t.Errorf("proposer args %q", args)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	var d Duration
+	if err := d.UnmarshalJSON([]byte(`"1.5s"`)); err != nil || time.Duration(d) != 1500*time.Millisecond {
+		t.Errorf("got %v, %v", d, err)
+	}
+	if b, err := d.MarshalJSON(); err != nil || string(b) != `"1.5s"` {
+		t.Errorf("marshalled %s, %v", b, err)
+	}
+	if err := d.UnmarshalJSON([]byte(`"soon"`)); err == nil {
+		t.Error("accepted soon")
+	}
+}
@@ -0,0 +1,489 @@
+/* Request scheduling for net/rpc servers
+ *
+ * rpc.Server starts every request the moment it is read, so a burst of
+ * bulk calls competes for the CPU with interactive ones on equal terms.
+ * Server reads and decodes requests as they arrive, tags each with a class,
+ * and lets at most Workers of them run at once, choosing the next one by
+ *
+ *   FIFO    the longest waiting request, whatever its class: the worker
+ *           limit alone, to compare the others with
+ *   Strict  the waiting request of the highest-priority class (FIFO within
+ *           a class); lower classes only run when higher ones are idle
+ *   WFQ     weighted fair queuing (start-time fair queuing): every class
+ *           gets server time in proportion to its weight while it has
+ *           work, estimated from each method's recent service times
+ *
+ * A request's class comes from the client when it calls "Service.Method@class"
+ * (see Tag), else from Config.Methods, else it is Config.Default. Reading is
+ * never held up by scheduling, so a queued bulk request does not stop an
+ * interactive one behind it on the same connection from being read.
+ *
+ * Basic usage:
+ *   classes, _ := sched.ParseClasses("interactive:8,bulk:1")
+ *   s := sched.NewServer(sched.Config{Policy: sched.WFQ, Classes: classes,
+ *       Methods: map[string]string{"Arith.Multiply": "interactive"}})
+ *   s.Register(new(Arith))
+ *   go s.Accept(listener)
+ */
+
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorpc-tests/codec"
+	"gorpc-tests/measure"
+)
+
+type Policy int
+
+const (
+	WFQ Policy = iota
+	Strict
+	FIFO
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "wfq":
+		return WFQ, nil
+	case "strict":
+		return Strict, nil
+	case "fifo":
+		return FIFO, nil
+	}
+	return 0, fmt.Errorf("unknown scheduling policy %q (want wfq, strict or fifo)", s)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Strict:
+		return "strict"
+	case FIFO:
+		return "fifo"
+	}
+	return "wfq"
+}
+
+// Class is a kind of traffic. Weight is its share under WFQ; under Strict
+// the classes are served in the order given, first to last.
+type Class struct {
+	Name   string
+	Weight float64
+}
+
+// ParseClasses reads "name:weight,name:weight", highest priority first; a
+// class without a weight gets 1.
+func ParseClasses(s string) ([]Class, error) {
+	var classes []Class
+	for _, f := range strings.Split(s, ",") {
+		name, weight := strings.TrimSpace(f), "1"
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, weight = name[:i], name[i+1:]
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w <= 0 || name == "" {
+			return nil, fmt.Errorf("bad class %q (want name:weight, weight > 0)", f)
+		}
+		classes = append(classes, Class{name, w})
+	}
+	return classes, nil
+}
+
+// ParseMethods reads "Service.Method=class,...".
+func ParseMethods(s string) (map[string]string, error) {
+	methods := make(map[string]string)
+	if s == "" {
+		return methods, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad method class %q (want Service.Method=class)", f)
+		}
+		methods[kv[0]] = kv[1]
+	}
+	return methods, nil
+}
+
+type Config struct {
+	Policy  Policy
+	Workers int // requests running at once; 0 means GOMAXPROCS
+	Classes []Class
+	Methods map[string]string // Service.Method to class name
+	Default string            // class of everything else; "" is the last class
+}
+
+// Tag names method for a call in class, e.g. c.Call(sched.Tag("DFS.GetBlock", "bulk"), ...).
+func Tag(method, class string) string {
+	return method + "@" + class
+}
+
+// ClassStats counts a class's requests since the server started.
+type ClassStats struct {
+	Name    string
+	Served  int64
+	Waiting int
+	Wait    measure.Histogram // from read to dispatch
+}
+
+type Server struct {
+	rpc *rpc.Server
+	cfg Config
+
+	mu      sync.Mutex
+	args    map[string]reflect.Type // argument type of every registered method
+	queues  []*queue
+	byName  map[string]*queue
+	dflt    *queue
+	busy    int
+	vtime   float64            // WFQ virtual time: the start tag last dispatched
+	arrived uint64             // requests read, for FIFO
+	cost    map[string]float64 // recent service time per method, in seconds
+	workers int
+}
+
+type queue struct {
+	ClassStats
+	Weight     float64
+	reqs       []*request
+	lastFinish float64
+}
+
+func NewServer(cfg Config) *Server {
+	if len(cfg.Classes) == 0 {
+		cfg.Classes = []Class{{"default", 1}}
+	}
+	s := &Server{
+		rpc:     rpc.NewServer(),
+		cfg:     cfg,
+		args:    make(map[string]reflect.Type),
+		byName:  make(map[string]*queue),
+		cost:    make(map[string]float64),
+		workers: cfg.Workers,
+	}
+	if s.workers <= 0 {
+		s.workers = runtime.GOMAXPROCS(0)
+	}
+	for _, c := range cfg.Classes {
+		q := &queue{Weight: c.Weight}
+		q.Name = c.Name
+		s.queues = append(s.queues, q)
+		s.byName[c.Name] = q
+	}
+	s.dflt = s.queues[len(s.queues)-1]
+	if q, ok := s.byName[cfg.Default]; ok {
+		s.dflt = q
+	}
+	return s
+}
+
+func (s *Server) Register(rcvr interface{}) error {
+	return s.RegisterName(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+// RegisterName registers rcvr with the rpc.Server and notes the argument
+// type of each of its methods, so requests can be decoded before they run.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	if err := s.rpc.RegisterName(name, rcvr); err != nil {
+		return err
+	}
+	t := reflect.TypeOf(rcvr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !token.IsExported(m.Name) || m.Type.NumIn() != 3 {
+			continue
+		}
+		// rpc.Server hands the codec a pointer to the argument either way
+		arg := m.Type.In(1)
+		if arg.Kind() == reflect.Ptr {
+			arg = arg.Elem()
+		}
+		s.args[name+"."+m.Name] = arg
+	}
+	return nil
+}
+
+// Accept serves gob connections from l until it fails.
+func (s *Server) Accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Print("sched: accept: ", err)
+			}
+			return
+		}
+		go s.ServeCodec(codec.NewGobServerCodec(conn))
+	}
+}
+
+// ServeConn serves one connection with the gob codec.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	s.ServeCodec(codec.NewGobServerCodec(conn))
+}
+
+// ServeCodec serves one connection, scheduling its requests with every
+// other connection's.
+func (s *Server) ServeCodec(c rpc.ServerCodec) {
+	sc := &schedCodec{
+		ServerCodec: c,
+		s:           s,
+		ready:       make(chan *request, s.workers),
+		running:     make(map[uint64]*request),
+	}
+	go sc.readLoop()
+	s.rpc.ServeCodec(sc)
+}
+
+func (s *Server) Stats() []ClassStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stats []ClassStats
+	for _, q := range s.queues {
+		st := q.ClassStats
+		st.Waiting = len(q.reqs)
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// Report prints each class's requests and how long they waited.
+func (s *Server) Report(w io.Writer) {
+	fmt.Fprintf(w, "Scheduling (%v, %d workers):\n", s.cfg.Policy, s.workers)
+	for _, st := range s.Stats() {
+		fmt.Fprintf(w, "  %-12s served %d, waiting %d, wait %v\n", st.Name, st.Served, st.Waiting, &st.Wait)
+	}
+}
+
+type request struct {
+	sc         *schedCodec
+	method     string
+	seq        uint64
+	arg        reflect.Value // invalid when the method is unknown
+	q          *queue
+	arrival    uint64
+	start      float64 // WFQ tags
+	finish     float64
+	read       time.Time
+	dispatched time.Time
+}
+
+// classify strips a client's @class from method and picks the queue.
+func (s *Server) classify(method string) (string, *queue) {
+	if i := strings.LastIndex(method, "@"); i >= 0 {
+		method, class := method[:i], method[i+1:]
+		if q, ok := s.byName[class]; ok {
+			return method, q
+		}
+		return method, s.classOf(method)
+	}
+	return method, s.classOf(method)
+}
+
+func (s *Server) classOf(method string) *queue {
+	if q, ok := s.byName[s.cfg.Methods[method]]; ok {
+		return q
+	}
+	return s.dflt
+}
+
+// costOf estimates a method's service time; methods not yet seen cost the
+// mean of those that have been, so they neither jump nor starve.
+func (s *Server) costOf(method string) float64 {
+	if c, ok := s.cost[method]; ok {
+		return c
+	}
+	if len(s.cost) == 0 {
+		return 1e-3
+	}
+	var sum float64
+	for _, c := range s.cost {
+		sum += c
+	}
+	return sum / float64(len(s.cost))
+}
+
+func (s *Server) enqueue(r *request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := r.q
+	s.arrived++
+	r.arrival = s.arrived
+	r.start = s.vtime
+	if q.lastFinish > r.start {
+		r.start = q.lastFinish
+	}
+	r.finish = r.start + s.costOf(r.method)/q.Weight
+	q.lastFinish = r.finish
+	q.reqs = append(q.reqs, r)
+	s.dispatchLocked()
+}
+
+// pickLocked removes the next request to run, or returns nil.
+func (s *Server) pickLocked() *request {
+	var best *queue
+	for _, q := range s.queues {
+		if len(q.reqs) == 0 {
+			continue
+		}
+		if s.cfg.Policy == Strict {
+			best = q
+			break
+		}
+		if best == nil {
+			best = q
+		} else if s.cfg.Policy == FIFO && q.reqs[0].arrival < best.reqs[0].arrival {
+			best = q
+		} else if s.cfg.Policy == WFQ && q.reqs[0].start < best.reqs[0].start {
+			best = q
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	r := best.reqs[0]
+	best.reqs[0] = nil
+	best.reqs = best.reqs[1:]
+	if r.start > s.vtime {
+		s.vtime = r.start
+	}
+	return r
+}
+
+func (s *Server) dispatchLocked() {
+	for s.busy < s.workers {
+		r := s.pickLocked()
+		if r == nil {
+			return
+		}
+		// requests of closed connections are dropped without running
+		if r.sc.deliver(r) {
+			s.busy++
+			r.dispatched = time.Now()
+			r.q.Served++
+			r.q.Wait.Record(r.dispatched.Sub(r.read))
+		}
+	}
+}
+
+// done frees r's worker and learns from how long it took.
+func (s *Server) done(r *request) {
+	took := time.Since(r.dispatched).Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.cost[r.method]; ok {
+		s.cost[r.method] = 0.8*c + 0.2*took
+	} else {
+		s.cost[r.method] = took
+	}
+	s.busy--
+	s.dispatchLocked()
+}
+
+// schedCodec sits between a connection's codec and rpc.Server: readLoop
+// reads and decodes requests into the scheduler, and rpc.Server reads back
+// only those dispatched.
+type schedCodec struct {
+	rpc.ServerCodec
+	s *Server
+
+	mu      sync.Mutex
+	ready   chan *request // dispatched, for rpc.Server to read
+	closed  bool
+	running map[uint64]*request
+	current *request // the request rpc.Server is reading
+}
+
+func (c *schedCodec) readLoop() {
+	defer func() {
+		c.mu.Lock()
+		c.closed = true
+		close(c.ready)
+		c.mu.Unlock()
+	}()
+	for {
+		var h rpc.Request
+		if err := c.ServerCodec.ReadRequestHeader(&h); err != nil {
+			return
+		}
+		c.s.mu.Lock()
+		method, q := c.s.classify(h.ServiceMethod)
+		argType, known := c.s.args[method]
+		c.s.mu.Unlock()
+		r := &request{sc: c, method: method, seq: h.Seq, q: q}
+		var err error
+		if known {
+			r.arg = reflect.New(argType)
+			err = c.ServerCodec.ReadRequestBody(r.arg.Interface())
+		} else {
+			// rpc.Server answers that the method does not exist
+			err = c.ServerCodec.ReadRequestBody(nil)
+		}
+		if err != nil {
+			return
+		}
+		r.read = time.Now()
+		c.s.enqueue(r)
+	}
+}
+
+// deliver hands a dispatched request to rpc.Server; there is always room,
+// since no more than Workers requests are dispatched at once.
+func (c *schedCodec) deliver(r *request) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.running[r.seq] = r
+	c.ready <- r
+	return true
+}
+
+func (c *schedCodec) ReadRequestHeader(h *rpc.Request) error {
+	r, ok := <-c.ready
+	if !ok {
+		return io.EOF
+	}
+	c.current = r
+	h.ServiceMethod = r.method
+	h.Seq = r.seq
+	return nil
+}
+
+func (c *schedCodec) ReadRequestBody(body interface{}) error {
+	r := c.current
+	c.current = nil
+	if body == nil || !r.arg.IsValid() {
+		return nil
+	}
+	reflect.ValueOf(body).Elem().Set(r.arg.Elem())
+	return nil
+}
+
+func (c *schedCodec) WriteResponse(h *rpc.Response, body interface{}) error {
+	err := c.ServerCodec.WriteResponse(h, body)
+	c.mu.Lock()
+	r, ok := c.running[h.Seq]
+	delete(c.running, h.Seq)
+	c.mu.Unlock()
+	if ok {
+		c.s.done(r)
+	}
+	return err
+}
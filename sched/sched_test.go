@@ -0,0 +1,184 @@
+package sched
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Svc struct {
+	release chan struct{}
+	mu      sync.Mutex
+	order   []string
+}
+
+// Block holds its worker until release is closed
+func (s *Svc) Block(args *string, reply *int) error {
+	<-s.release
+	return nil
+}
+
+// Note records the order the calls ran in
+func (s *Svc) Note(args *string, reply *int) error {
+	s.mu.Lock()
+	s.order = append(s.order, *args)
+	s.mu.Unlock()
+	return nil
+}
+
+// serve starts a one-worker Server and a client of it over a pipe.
+func serve(t *testing.T, cfg Config) (*Server, *Svc, *rpc.Client) {
+	cfg.Workers = 1
+	s := NewServer(cfg)
+	svc := &Svc{release: make(chan struct{})}
+	if err := s.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	cconn, sconn := net.Pipe()
+	go s.ServeConn(sconn)
+	client := rpc.NewClient(cconn)
+	t.Cleanup(func() { client.Close() })
+	return s, svc, client
+}
+
+// queued waits until n requests wait behind the blocked worker
+func queued(t *testing.T, s *Server, n int) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		waiting := 0
+		for _, st := range s.Stats() {
+			waiting += st.Waiting
+		}
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// run blocks the worker, queues a Note for each of notes in its class and
+// returns the order they ran in
+func run(t *testing.T, cfg Config, notes ...[2]string) (*Server, []string) {
+	s, svc, client := serve(t, cfg)
+	block := client.Go("Svc.Block", new(string), new(int), nil)
+	queued(t, s, 0)
+	var calls []*rpc.Call
+	for _, n := range notes {
+		method := "Svc.Note"
+		if n[1] != "" {
+			method = Tag(method, n[1])
+		}
+		arg := n[0]
+		calls = append(calls, client.Go(method, &arg, new(int), nil))
+	}
+	queued(t, s, len(notes))
+	close(svc.release)
+	for _, call := range append(calls, block) {
+		if err := (<-call.Done).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, svc.order
+}
+
+func TestParse(t *testing.T) {
+	for _, p := range []Policy{WFQ, Strict, FIFO} {
+		if got, err := ParsePolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParsePolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	classes, err := ParseClasses("interactive:8, bulk")
+	if err != nil || len(classes) != 2 || classes[0] != (Class{"interactive", 8}) || classes[1] != (Class{"bulk", 1}) {
+		t.Errorf("ParseClasses: %v, %v", classes, err)
+	}
+	for _, bad := range []string{"a:0", "a:x", ":2"} {
+		if _, err := ParseClasses(bad); err == nil {
+			t.Errorf("ParseClasses(%q) accepted", bad)
+		}
+	}
+	methods, err := ParseMethods("A.B=bulk,C.D=interactive")
+	if err != nil || methods["A.B"] != "bulk" || methods["C.D"] != "interactive" {
+		t.Errorf("ParseMethods: %v, %v", methods, err)
+	}
+	if _, err := ParseMethods("A.B"); err == nil {
+		t.Error("ParseMethods(A.B) accepted")
+	}
+}
+
+var classes = []Class{{"interactive", 4}, {"bulk", 1}}
+
+// FIFO runs requests in the order they arrived, whatever their class
+func TestFIFO(t *testing.T) {
+	_, order := run(t, Config{Policy: FIFO, Classes: classes},
+		[2]string{"b1", "bulk"}, [2]string{"i1", "interactive"}, [2]string{"b2", "bulk"})
+	if got := strings.Join(order, " "); got != "b1 i1 b2" {
+		t.Errorf("ran %s", got)
+	}
+}
+
+// Strict runs every waiting interactive request before any bulk one
+func TestStrict(t *testing.T) {
+	s, order := run(t, Config{Policy: Strict, Classes: classes},
+		[2]string{"b1", "bulk"}, [2]string{"b2", "bulk"}, [2]string{"i1", "interactive"}, [2]string{"i2", "interactive"})
+	if got := strings.Join(order, " "); got != "i1 i2 b1 b2" {
+		t.Errorf("ran %s", got)
+	}
+	stats := s.Stats()
+	if stats[0].Served != 2 || stats[1].Served != 3 || stats[0].Wait.Count() != 2 {
+		t.Errorf("interactive %+v, bulk %+v: want 2 and 3 (with Block) served", stats[0], stats[1])
+	}
+}
+
+// WFQ gives interactive requests four turns to bulk's one
+func TestWFQ(t *testing.T) {
+	var notes [][2]string
+	for i := 0; i < 8; i++ {
+		notes = append(notes, [2]string{"b", "bulk"})
+	}
+	for i := 0; i < 8; i++ {
+		notes = append(notes, [2]string{"i", "interactive"})
+	}
+	_, order := run(t, Config{Policy: WFQ, Classes: classes}, notes...)
+	interactive := 0
+	for _, n := range order[:5] {
+		if n == "i" {
+			interactive++
+		}
+	}
+	if interactive < 3 {
+		t.Errorf("ran %s: %d of the first 5 interactive, want about 4", strings.Join(order, " "), interactive)
+	}
+}
+
+// Untagged methods take their class from Methods, else Default
+func TestClassify(t *testing.T) {
+	s := NewServer(Config{Classes: classes, Methods: map[string]string{"Svc.Fast": "interactive"}, Default: "bulk"})
+	for _, c := range []struct{ method, want, class string }{
+		{"Svc.Fast", "Svc.Fast", "interactive"},
+		{"Svc.Slow", "Svc.Slow", "bulk"},
+		{"Svc.Slow@interactive", "Svc.Slow", "interactive"},
+		{"Svc.Fast@unknown", "Svc.Fast", "interactive"},
+	} {
+		method, q := s.classify(c.method)
+		if method != c.want || q.Name != c.class {
+			t.Errorf("classify(%q) = %q, %s, want %q, %s", c.method, method, q.Name, c.want, c.class)
+		}
+	}
+}
+
+// A call to a method that does not exist gets rpc.Server's error back
+func TestUnknownMethod(t *testing.T) {
+	_, _, client := serve(t, Config{})
+	if err := client.Call("Svc.Missing", new(string), new(int)); err == nil {
+		t.Error("a call to Svc.Missing succeeded")
+	}
+	arg := "after"
+	if err := client.Call("Svc.Note", &arg, new(int)); err != nil {
+		t.Errorf("call after the unknown method: %v", err)
+	}
+}
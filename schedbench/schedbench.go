@@ -0,0 +1,310 @@
+/*
+ * Interactive latency under bulk traffic, with and without a scheduler.
+ *
+ * One server offers Arith.Multiply, which takes microseconds, and
+ * DFS.GetBlock, which generates and hashes a block. Bulk clients keep
+ * GetBlock calls in flight while an interactive client calls Multiply one
+ * at a time on a connection of its own; this reports Multiply's latency
+ * with a plain rpc.Server (off) and with each sched policy (fifo is the
+ * same worker limit without priorities), next to the bulk throughput each
+ * one leaves and how long Multiply waited in the scheduler.
+ *
+ * schedbench  [-policies off,fifo,strict,wfq]
+ *             [-classes interactive:8,bulk:1, see sched.ParseClasses]
+ *             [-workers requests run at once by sched (0: GOMAXPROCS)]
+ *             [-tagged the clients name their class instead of the server]
+ *             [-block GetBlock size] [-rounds times GetBlock hashes its block]
+ *             [-bulkclients] [-window per bulk client]
+ *             [-interval pause between Multiply calls]
+ *             [-warmup, -duration per measurement]
+ *             [-cpuprofile/-memprofile/... see profiling]
+ *             [-results directory results are stored in, see results]
+ *
+ * Client and server share the process, like holblocking.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorpc-tests/codec"
+	"gorpc-tests/measure"
+	"gorpc-tests/payload"
+	"gorpc-tests/profiling"
+	"gorpc-tests/results"
+	"gorpc-tests/sched"
+	"gorpc-tests/sizedist"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Arith int
+
+func (t *Arith) Multiply(args *Args, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+type DataChunk struct {
+	Chunk, Hash []byte
+}
+
+type DFS struct {
+	block  []byte
+	rounds int
+}
+
+// GetBlock copies and hashes the block, as the snappy DFS server does
+// with -payload; more rounds stand for a costlier read
+func (d *DFS) GetBlock(blockSize int, reply *DataChunk) error {
+	data := d.block
+	if blockSize < len(data) {
+		data = data[:blockSize]
+	}
+	h := md5.New()
+	for i := 0; i < d.rounds; i++ {
+		h.Write(data)
+	}
+	reply.Chunk = append([]byte(nil), data...)
+	reply.Hash = h.Sum(reply.Hash)
+	return nil
+}
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Fatal error ", err.Error())
+		profiling.Exit(1)
+	}
+}
+
+var blockSize int
+var block []byte
+var rounds int
+
+// the classes calls are tagged with under -tagged
+const interactive, bulkClass = "interactive", "bulk"
+
+var tagged bool
+
+// method names a call, tagged with class if the clients tag theirs and
+// the server is a sched.Server
+func method(name, class string, tag bool) string {
+	if tag {
+		return sched.Tag(name, class)
+	}
+	return name
+}
+
+// startServer listens with a plain rpc.Server for policy "off", else a
+// sched.Server, which it returns.
+func startServer(policy string, cfg sched.Config) (net.Listener, *sched.Server) {
+	l, err := net.Listen("tcp", "localhost:0")
+	checkError(err)
+	if policy == "off" {
+		server := rpc.NewServer()
+		server.Register(new(Arith))
+		server.Register(&DFS{block, rounds})
+		go codec.Accept(server, l, "gob", codec.DefaultOptions())
+		return l, nil
+	}
+	cfg.Policy, err = sched.ParsePolicy(policy)
+	checkError(err)
+	server := sched.NewServer(cfg)
+	server.Register(new(Arith))
+	server.Register(&DFS{block, rounds})
+	go server.Accept(l)
+	return l, server
+}
+
+func dial(addr string) *rpc.Client {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	return rpc.NewClientWithCodec(codec.NewGobClientCodec(conn))
+}
+
+// bulk keeps window GetBlock calls in flight on c until stop is closed,
+// counting the blocks received.
+func bulk(c *rpc.Client, tag bool, window int, stop chan struct{}, blocks *int64) {
+	done := make(chan *rpc.Call, window)
+	getBlock := method("DFS.GetBlock", bulkClass, tag)
+	for i := 0; i < window; i++ {
+		c.Go(getBlock, blockSize, new(DataChunk), done)
+	}
+	for outstanding := window; outstanding > 0; outstanding-- {
+		call := <-done
+		checkError(call.Error)
+		atomic.AddInt64(blocks, 1)
+		select {
+		case <-stop:
+		default:
+			c.Go(getBlock, blockSize, new(DataChunk), done)
+			outstanding++
+		}
+	}
+}
+
+// probe calls Multiply one at a time for duration, pausing interval
+// between calls, and records their latency.
+func probe(c *rpc.Client, tag bool, interval, duration time.Duration) *measure.Histogram {
+	h := new(measure.Histogram)
+	multiply := method("Arith.Multiply", interactive, tag)
+	end := time.Now().Add(duration)
+	for i := 0; ; i++ {
+		began := time.Now()
+		if began.After(end) {
+			return h
+		}
+		var reply int
+		checkError(c.Call(multiply, &Args{i, 7}, &reply))
+		h.Record(time.Since(began))
+		time.Sleep(interval)
+	}
+}
+
+type cell struct {
+	latency      *measure.Histogram
+	blocksPerSec float64
+}
+
+// measureCell runs the interactive client after warmup, next to
+// bulkClients bulk clients.
+func measureCell(addr string, tag bool, bulkClients, window int, interval, warmup, duration time.Duration) cell {
+	stop := make(chan struct{})
+	var w sync.WaitGroup
+	var blocks int64
+	for i := 0; i < bulkClients; i++ {
+		c := dial(addr)
+		defer c.Close()
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			bulk(c, tag, window, stop, &blocks)
+		}()
+	}
+	c := dial(addr)
+	defer c.Close()
+	time.Sleep(warmup)
+	before := atomic.LoadInt64(&blocks)
+	h := probe(c, tag, interval, duration)
+	after := atomic.LoadInt64(&blocks)
+	close(stop)
+	w.Wait()
+	return cell{h, float64(after-before) / duration.Seconds()}
+}
+
+func us(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func main() {
+	policiesFlag := flag.String("policies", "off,fifo,strict,wfq", "off (plain rpc.Server) and/or sched policies, comma separated")
+	classesFlag := flag.String("classes", "interactive:8,bulk:1", "sched classes, highest priority first, as name:weight")
+	workers := flag.Int("workers", 0, "requests sched runs at once (0: GOMAXPROCS)")
+	flag.BoolVar(&tagged, "tagged", false, "clients tag calls with their class (sched.Tag) instead of the server classing methods")
+	blockFlag := flag.String("block", "512K", "GetBlock size (K and M suffixes)")
+	flag.IntVar(&rounds, "rounds", 1, "times GetBlock hashes its block, for a server-bound bulk load")
+	bulkClients := flag.Int("bulkclients", 4, "bulk clients, one connection each")
+	window := flag.Int("window", 4, "GetBlock calls in flight per bulk client")
+	interval := flag.Duration("interval", time.Millisecond, "pause between Multiply calls")
+	warmup := flag.Duration("warmup", 200*time.Millisecond, "run before measuring, per measurement")
+	duration := flag.Duration("duration", 2*time.Second, "measure for this long, per measurement")
+	prof := profiling.AddFlags()
+	store := results.AddFlags()
+	flag.Parse()
+	sess := prof.Start()
+	defer sess.Stop()
+
+	var err error
+	blockSize, err = sizedist.ParseSize(*blockFlag)
+	checkError(err)
+	block, err = payload.Generate("text", blockSize)
+	checkError(err)
+	classes, err := sched.ParseClasses(*classesFlag)
+	checkError(err)
+	cfg := sched.Config{Workers: *workers, Classes: classes}
+	if !tagged {
+		cfg.Methods = map[string]string{"Arith.Multiply": interactive, "DFS.GetBlock": bulkClass}
+	}
+	policies := strings.Split(*policiesFlag, ",")
+	for _, p := range policies {
+		if p != "off" {
+			_, err := sched.ParsePolicy(p)
+			checkError(err)
+		}
+	}
+
+	stored := results.New("schedbench")
+	l, _ := startServer("off", cfg)
+	alone := measureCell(l.Addr().String(), false, 0, 0, *interval, *warmup, *duration)
+	l.Close()
+	base50, base99 := alone.latency.Percentile(0.5), alone.latency.Percentile(0.99)
+	fmt.Printf("Arith.Multiply alone: p50 %v, p99 %v\n", base50, base99)
+	stored.Add("alone multiply-p50", "µs", false, us(base50))
+	stored.Add("alone multiply-p99", "µs", false, us(base99))
+	fmt.Printf("Bulk: %d clients x %d DFS.GetBlock of %d bytes in flight\n\n", *bulkClients, *window, blockSize)
+
+	type row struct {
+		policy string
+		c      cell
+		server *sched.Server
+	}
+	var rows []row
+	for _, p := range policies {
+		l, server := startServer(p, cfg)
+		c := measureCell(l.Addr().String(), tagged && server != nil, *bulkClients, *window, *interval, *warmup, *duration)
+		l.Close()
+		rows = append(rows, row{p, c, server})
+	}
+
+	fmt.Printf("%-7s %10s %12s %12s %8s %8s %12s %12s\n",
+		"policy", "blocks/s", "mult p50", "mult p99", "p50 x", "p99 x", "wait p50", "wait p99")
+	for _, r := range rows {
+		p50, p99 := r.c.latency.Percentile(0.5), r.c.latency.Percentile(0.99)
+		x50, x99 := float64(p50)/float64(base50), float64(p99)/float64(base99)
+		fmt.Printf("%-7s %10.1f %12v %12v %8.1f %8.1f", r.policy, r.c.blocksPerSec, p50, p99, x50, x99)
+		stored.Add(r.policy+" multiply-p50", "µs", false, us(p50))
+		stored.Add(r.policy+" multiply-p99", "µs", false, us(p99))
+		stored.Add(r.policy+" inflation-p99", "x", false, x99)
+		stored.Add(r.policy+" bulk", "blocks/s", true, r.c.blocksPerSec)
+		// how much of the latency was spent queued in the scheduler
+		if wait := classWait(r.server, interactive); wait != nil {
+			w50, w99 := wait.Percentile(0.5), wait.Percentile(0.99)
+			fmt.Printf(" %12v %12v", w50, w99)
+			stored.Add(r.policy+" multiply-wait-p50", "µs", false, us(w50))
+			stored.Add(r.policy+" multiply-wait-p99", "µs", false, us(w99))
+		}
+		fmt.Println()
+	}
+	for _, r := range rows {
+		if r.server != nil {
+			fmt.Println()
+			r.server.Report(os.Stdout)
+		}
+	}
+	store.Save(stored)
+}
+
+// classWait is how long the named class waited in server, or nil.
+func classWait(server *sched.Server, class string) *measure.Histogram {
+	if server == nil {
+		return nil
+	}
+	for _, st := range server.Stats() {
+		if st.Name == class {
+			return &st.Wait
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+/* Connection capacity probe (test 2)
+ *
+ * Keeps dialing the server until a dial fails or maxConns clients are open,
+ * then reports how many connections succeeded, why the first failure happened
+ * and what each connection costs the server in goroutines and memory.
+ *
+ * The server numbers come from the Arith.Stats RPC, so they are the server's
+ * own even when it runs in a different process (basicTests -serve). When the
+ * server runs in-process they include the client side of every connection too.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+var maxConns int
+var dialTimeout time.Duration
+var verifyEcho bool
+var remoteServer bool
+
+type ServerStats struct {
+	Goroutines int
+	HeapInuse  uint64
+	Sys        uint64
+}
+
+//reports the server's goroutine count and memory use after a GC
+func (t *Arith) Stats(args *Args, reply *ServerStats) error {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	reply.Goroutines = runtime.NumGoroutine()
+	reply.HeapInuse = ms.HeapInuse
+	reply.Sys = ms.Sys
+	return nil
+}
+
+//gives a short name to the usual reasons a dial fails
+func classifyDialError(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.EMFILE):
+		return "EMFILE (process out of file descriptors)"
+	case errors.Is(err, syscall.ENFILE):
+		return "ENFILE (system out of file descriptors)"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "ECONNREFUSED (listen backlog full or server gone)"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "EADDRNOTAVAIL (out of ephemeral ports)"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+func dialWithTimeout(port int) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", DEFAULTSERVER+fmt.Sprintf(":%d", port), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func serverStats(c *rpc.Client) ServerStats {
+	var stats ServerStats
+	err := c.Call("Arith.Stats", Args{}, &stats)
+	checkError(err)
+	return stats
+}
+
+//an accepted-but-unserved connection only shows up as a call that never
+//returns, so every Echo gets the dial timeout as its deadline
+func echoWithin(c *rpc.Client, timeout time.Duration) error {
+	var reply BasicArg
+	call := c.Go("Arith.Echo", BasicArg{1}, &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return errors.New("timed out")
+	}
+}
+
+func perConn(before, after uint64, n int) float64 {
+	return (float64(after) - float64(before)) / float64(n)
+}
+
+//returns the number of connections made
+func maxConnectionsTest(port int) int64 {
+	if !remoteServer {
+		startTCPServer(port)
+	}
+	// the control connection is opened first so it is never the one refused
+	control := startTCPClient(port)
+	before := serverStats(control)
+
+	var clients []*rpc.Client
+	var firstErr error
+	startTime := time.Now()
+	for i := 0; i < maxConns; i++ {
+		c, err := dialWithTimeout(port)
+		if err != nil {
+			firstErr = err
+			break
+		}
+		clients = append(clients, c)
+		if (i+1)%1000 == 0 {
+			fmt.Printf("Connected %d clients\n", i+1)
+		}
+	}
+	duration := time.Since(startTime)
+
+	n := len(clients)
+	fmt.Printf("Connected %d clients in %v\n", n, duration)
+	if firstErr != nil {
+		fmt.Printf("First failure at client # %d: %s: %v\n", n, classifyDialError(firstErr), firstErr)
+	} else {
+		fmt.Printf("No failure before the limit of %d connections\n", maxConns)
+	}
+
+	if n > 0 {
+		after := serverStats(control)
+		if !remoteServer {
+			fmt.Println("Server is in-process: the numbers below include the client side")
+		}
+		fmt.Printf("Server goroutines: %d -> %d (%.2f per connection)\n",
+			before.Goroutines, after.Goroutines,
+			float64(after.Goroutines-before.Goroutines)/float64(n))
+		fmt.Printf("Server heap in use: %d -> %d bytes (%.0f bytes per connection)\n",
+			before.HeapInuse, after.HeapInuse, perConn(before.HeapInuse, after.HeapInuse, n))
+		fmt.Printf("Server memory from OS: %d -> %d bytes (%.0f bytes per connection)\n",
+			before.Sys, after.Sys, perConn(before.Sys, after.Sys, n))
+	}
+
+	if verifyEcho {
+		ok := 0
+		var firstEchoErr error
+		for i, c := range clients {
+			if err := echoWithin(c, dialTimeout); err != nil {
+				if firstEchoErr == nil {
+					firstEchoErr = fmt.Errorf("client # %d: %v", i, err)
+				}
+				continue
+			}
+			ok++
+		}
+		fmt.Printf("Echo succeeded on %d/%d clients\n", ok, n)
+		if firstEchoErr != nil {
+			fmt.Printf("First Echo failure: %v\n", firstEchoErr)
+		}
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+	control.Close()
+	return int64(n)
+}
+
+//runs just the server so the probe can measure it from another process
+func serveForever(port int) {
+	startTCPServer(port)
+	fmt.Printf("Serving on port %d (pid %d)\n", port, os.Getpid())
+	<-make(chan int)
+}
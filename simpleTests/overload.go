@@ -0,0 +1,136 @@
+/* Overload test (test 4)
+ *
+ * Runs Arith behind an admission.Server and offers it open-loop load of
+ * Arith.Wait calls (1ms of work each) at a series of rates, regardless of how
+ * fast the server answers. For every rate it reports goodput (calls that
+ * succeeded, within -timeout if one is set), rejections and latency, so the
+ * queue and reject modes can be compared past the point of saturation.
+ */
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorpc-tests/admission"
+	"gorpc-tests/connstat"
+	"gorpc-tests/measure"
+	"gorpc-tests/rpcctx"
+)
+
+var admitLimits admission.Limits
+var offeredRates string
+var stepDuration time.Duration
+var loadClients int
+
+type stepResult struct {
+	offered, ok, rejected, timedOut, failed int64
+	elapsed                                 time.Duration
+	latency                                 measure.Histogram
+}
+
+func startAdmissionServer(port int, limits admission.Limits) *admission.Server {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
+	checkError(err)
+
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	checkError(err)
+
+	server := admission.NewServer(limits)
+	server.Register(new(Arith))
+
+	go server.Accept(connstat.WrapListener(listener, &serverConns))
+	return server
+}
+
+func parseRates(s string) []int {
+	var rates []int
+	for _, f := range strings.Split(s, ",") {
+		r, err := strconv.Atoi(strings.TrimSpace(f))
+		checkError(err)
+		rates = append(rates, r)
+	}
+	return rates
+}
+
+//issues rate calls per second for d, then waits for the stragglers
+func offerLoad(clients []*rpc.Client, rate int, d time.Duration) *stepResult {
+	res := new(stepResult)
+	var mu sync.Mutex
+	var inFlight sync.WaitGroup
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	next := 0
+	for now := start; now.Sub(start) < d; now = <-ticker.C {
+		due := int64(float64(rate)*now.Sub(start).Seconds()) - res.offered
+		for ; due > 0; due-- {
+			c := clients[next%len(clients)]
+			next++
+			res.offered++
+			inFlight.Add(1)
+			go func() {
+				defer inFlight.Done()
+				var reply int
+				began := time.Now()
+				err := call(c, "Arith.Wait", Args{1, 2}, &reply)
+				took := time.Since(began)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					res.ok++
+					res.latency.Record(took)
+				case admission.IsOverloaded(err):
+					res.rejected++
+				case rpcctx.IsTimeout(err):
+					res.timedOut++
+				default:
+					res.failed++
+				}
+			}()
+		}
+	}
+	inFlight.Wait()
+	res.elapsed = time.Since(start)
+	return res
+}
+
+//returns the number of calls offered
+func overloadTest(port int) int64 {
+	server := startAdmissionServer(port, admitLimits)
+	var clients []*rpc.Client
+	for i := 0; i < loadClients; i++ {
+		clients = append(clients, startTCPClient(port))
+	}
+	fmt.Printf("Admission: mode %v, max conns %d, max in-flight/conn %d, max concurrent %d, queue timeout %v\n",
+		admitLimits.Mode, admitLimits.MaxConns, admitLimits.MaxInFlightPerConn,
+		admitLimits.MaxConcurrent, admitLimits.QueueTimeout)
+	fmt.Printf("%d client connections, %v per rate\n", loadClients, stepDuration)
+	fmt.Printf("%10s %10s %10s %10s %10s %10s %12s %12s\n",
+		"offered/s", "goodput/s", "rejected/s", "timeouts", "errors", "queued", "p50", "p99")
+
+	var offered int64
+	for _, rate := range parseRates(offeredRates) {
+		before := server.Stats()
+		res := offerLoad(clients, rate, stepDuration)
+		offered += res.offered
+		after := server.Stats()
+		secs := res.elapsed.Seconds()
+		fmt.Printf("%10d %10.0f %10.0f %10d %10d %10d %12v %12v\n",
+			rate, float64(res.ok)/secs, float64(res.rejected)/secs, res.timedOut, res.failed,
+			after.Queued-before.Queued, res.latency.Percentile(0.5), res.latency.Percentile(0.99))
+	}
+	if tracker != nil {
+		tracker.Report(os.Stdout)
+	}
+	return offered
+}
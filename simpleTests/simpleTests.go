@@ -1,11 +1,19 @@
 /* Provides three basic tests:  
  * 1) Simple throughput: 1 client sending 1 byte, 1 server echoing that byte
- * 2) Maximum number of connections: Keep making clients until server can't handle any more
+ * 2) Maximum number of connections: Keep making clients until server can't handle any more,
+ *    then report why it stopped and what each connection costs (see capacity.go)
  * 3) Connect+Close Clients: 1 server, connect client, close client, repeat
+ * 4) Overload: open-loop load at rising rates against a server with admission
+ *    control, reporting goodput against offered load (see overload.go)
  *
  * Basic usage:
  * go install gorpc-tests/basicTests
-   basicTests [-port] [-test] [-http] [-nCalls] 
+   basicTests [-port] [-test] [-http] [-nCalls] [-warmup] [-duration] [-timeout]
+              [-maxConns] [-dialTimeout] [-verify] [-remote] [-serve]
+              [-admitMode] [-admitConns] [-admitInFlight] [-admitConcurrent]
+              [-admitQueueTimeout] [-rates] [-step] [-loadClients]
+              [-cpuprofile] [-memprofile] [-blockprofile] [-mutexprofile] [-trace] [-pprof]
+              [-results]
  */
 package main
 
@@ -19,6 +27,12 @@ import (
 	"io/ioutil"
 	"flag"
 	"log"
+	"gorpc-tests/measure"
+	"gorpc-tests/rpcctx"
+	"gorpc-tests/admission"
+	"gorpc-tests/profiling"
+	"gorpc-tests/connstat"
+	"gorpc-tests/results"
 )
 
 const (
@@ -32,6 +46,14 @@ const (
 var port int
 var withHTTP bool
 var numCalls int
+var warmup measure.Warmup
+var measureFor time.Duration
+
+//bounds every call when -timeout is set
+var tracker *rpcctx.Tracker
+
+//read/write syscalls on every client and every server connection
+var clientConns, serverConns connstat.Counters
 
 type Args struct {
 	A, B int
@@ -60,7 +82,7 @@ func (t *Arith) Wait(args *Args, reply *int) error {
 }
 
 func startTCPClient(port int) (*rpc.Client) {
-	client, err := rpc.Dial("tcp", DEFAULTSERVER + fmt.Sprintf(":%d", port))
+	client, err := connstat.Dial("tcp", DEFAULTSERVER + fmt.Sprintf(":%d", port), &clientConns)
 	checkError(err)
 
 	return client
@@ -73,22 +95,39 @@ func startHTTPClient(port int) (*rpc.Client) {
 	return client
 }
 
+//makes a call, giving up after -timeout if one is set
+func call(c *rpc.Client, serviceMethod string, args interface{}, reply interface{}) error {
+	if tracker != nil {
+		return tracker.Call(c, serviceMethod, args, reply)
+	}
+	return c.Call(serviceMethod, args, reply)
+}
+
 func synchronousCall(c *rpc.Client) {
 	// Synchronous call
 	args := Args{7,8}
 	var reply int
-	err := c.Call("Arith.Multiply", args, &reply)
+	err := call(c, "Arith.Multiply", args, &reply)
+	if rpcctx.IsTimeout(err) {
+		return
+	}
 	checkError(err)
 	log.Printf("Arith: %d*%d=%d", args.A, args.B, reply)
 }
 
-//sends 1 byte to server and expects the same byte in return
-func basicCall(c *rpc.Client) {
+//sends 1 byte to server and expects the same byte in return;
+//returns false if the call timed out
+func basicCall(c *rpc.Client) bool {
 	args := BasicArg{1};
 	var reply BasicArg
-	err := c.Call("Arith.Echo", args, &reply)
+	err := call(c, "Arith.Echo", args, &reply)
+	if rpcctx.IsTimeout(err) {
+		log.Printf("Arith: timed out")
+		return false
+	}
 	log.Printf("Arith: %d, %d", args.A, reply.A)
 	checkError(err)
+	return true
 }
 
 func startTCPServer(port int) (*rpc.Server) {
@@ -104,7 +143,7 @@ func startTCPServer(port int) (*rpc.Server) {
 	arith := new(Arith)
 	newServer.Register(arith)
 	
-	go newServer.Accept(listener)
+	go newServer.Accept(connstat.WrapListener(listener, &serverConns))
 	return newServer
 }
 
@@ -123,7 +162,7 @@ func startHTTPServer(port int) (*rpc.Server) {
 	return newServer
 }
 
-func basicCallTest(port int) {
+func basicCallTest(port int) int64 {
 	var client1 *rpc.Client
 	if withHTTP {
 		log.Printf("Using HTTP\n")
@@ -135,15 +174,31 @@ func basicCallTest(port int) {
 		client1 = startTCPClient(port)
 	}
 
-	startTime := time.Now()
-	for i := 0; i < numCalls ; i++ {
-		basicCall(client1)
+	// dialing and the first calls fall into the warm-up, not the measurement
+	win := measure.NewWindow(warmup, measureFor, numCalls)
+	win.Begin()
+	for {
+		more := false
+		if basicCall(client1) {
+			more = win.Record(1)
+		} else {
+			more = win.Skip()
+		}
+		if !more {
+			break
+		}
 	}
-	duration := time.Since(startTime)
-	fmt.Printf("Average duration of Basic Call: %v us\n", duration.Seconds()*1000000/float64(numCalls))
+	res := win.Close()
+	fmt.Printf("Warm-up: %d calls in %v\n", res.WarmupCalls, res.WarmupTime)
+	fmt.Printf("Measured %d calls in %v\n", res.Calls, res.Elapsed)
+	fmt.Printf("Average duration of Basic Call: %v us\n", res.Elapsed.Seconds()*1000000/float64(res.Calls))
+	if tracker != nil {
+		tracker.Report(os.Stdout)
+	}
+	return res.WarmupCalls + res.Calls + res.Skipped
 }
 
-func connectAndCloseClientTest(port int) {
+func connectAndCloseClientTest(port int) int64 {
 	startTCPServer(port)
 	startTime := time.Now()
 	for i := 0; i < NUMCLIENTS ; i++ {
@@ -153,20 +208,7 @@ func connectAndCloseClientTest(port int) {
 	duration := time.Since(startTime)
 	fmt.Printf("Average duration to Connect + Close Client: %v us\n", 
 		duration.Seconds()*1000000/float64(NUMCLIENTS) )
-}
-
-//will crash once there are too many clients (as long as that number is > numConnections)
-func maxConnectionsTest(port int) {
-	startTCPServer(port)
-	startTime := time.Now()
-	for i := 0; i < NUMCONNECTIONS ; i++ {
-		fmt.Printf("Starting client # %d\n", i)
-		startTCPClient(port)
-		fmt.Printf("Successfully connected client # %d\n", i)
-	}
-	duration := time.Since(startTime)
-	fmt.Printf("Duration to Connect %v Clients: %v us\n", 
-		NUMCONNECTIONS, duration.Seconds() )
+	return NUMCLIENTS
 }
 
 func main() {
@@ -176,28 +218,80 @@ func main() {
     }
 
     p := flag.Int("port", PORTBASE, "port number")
-    t := flag.Int("test", 1, "1 for basic, 2 for maxconnections, 3 for open+close connections")
+    t := flag.Int("test", 1, "1 for basic, 2 for maxconnections, 3 for open+close connections, 4 for overload")
     h := flag.Bool("http", false, "use HTTP")
     nCalls := flag.Int("nCalls", 100000, "number of calls to make")
+    flag.Var(&warmup, "warmup", "warm-up before measuring (call count or duration, e.g. 1000 or 2s)")
+    flag.DurationVar(&measureFor, "duration", 0, "measure for this long instead of nCalls calls")
+    flag.IntVar(&maxConns, "maxConns", NUMCONNECTIONS, "test 2: stop probing after this many connections")
+    flag.DurationVar(&dialTimeout, "dialTimeout", 5*time.Second, "test 2: dial and Echo timeout")
+    flag.BoolVar(&verifyEcho, "verify", false, "test 2: check every open client can still Echo")
+    flag.BoolVar(&remoteServer, "remote", false, "test 2: probe a server started separately with -serve")
+    serve := flag.Bool("serve", false, "only run the server")
+    timeout := flag.Duration("timeout", 0, "give up on a call after this long (0 waits forever)")
+    admitMode := flag.String("admitMode", "reject", "test 4: queue or reject requests over the limits")
+    flag.IntVar(&admitLimits.MaxConns, "admitConns", 0, "test 4: max open connections (0 = unlimited)")
+    flag.IntVar(&admitLimits.MaxInFlightPerConn, "admitInFlight", 0, "test 4: max requests in flight per connection (0 = unlimited)")
+    flag.IntVar(&admitLimits.MaxConcurrent, "admitConcurrent", 64, "test 4: max requests in flight on the server (0 = unlimited)")
+    flag.DurationVar(&admitLimits.QueueTimeout, "admitQueueTimeout", 0, "test 4: reject a queued request after this long (0 = never)")
+    flag.StringVar(&offeredRates, "rates", "1000,5000,10000,20000,40000", "test 4: offered loads in calls/s")
+    flag.DurationVar(&stepDuration, "step", 2*time.Second, "test 4: how long each offered load runs")
+    flag.IntVar(&loadClients, "loadClients", 8, "test 4: client connections carrying the load")
+    prof := profiling.AddFlags()
+    store := results.AddFlags()
 
     flag.Parse()
+    sess := prof.Start()
+    defer sess.Stop()
     port = *p
     withHTTP = *h
     test_type := *t
     numCalls = *nCalls
+    if *timeout > 0 {
+    	tracker = rpcctx.NewTracker(*timeout)
+    }
+    mode, err := admission.ParseMode(*admitMode)
+    checkError(err)
+    admitLimits.Mode = mode
+    if *serve {
+    	// serves until interrupted, so the profiles are written then
+    	sess.StopOnInterrupt()
+    	serveForever(port)
+    }
+    before := profiling.Snapshot()
+    clientBefore, serverBefore := clientConns.Snapshot(), serverConns.Snapshot()
+    var calls int64
     switch test_type {
     	case 1 :
-    		basicCallTest(port)
+    		calls = basicCallTest(port)
     	case 2 :
-    		maxConnectionsTest(port)
+    		calls = maxConnectionsTest(port)
     	case 3 :
-    		connectAndCloseClientTest(port)
+    		calls = connectAndCloseClientTest(port)
+    	case 4 :
+    		calls = overloadTest(port)
+    }
+    runtimeDelta := profiling.Snapshot().Sub(before)
+    // the servers run in this process unless test 2 probes a -remote one
+    allocs := "process: clients and servers together"
+    if remoteServer && test_type == 2 {
+    	allocs = "process: clients only"
+    }
+    runtimeDelta.ReportAs(os.Stdout, allocs, calls)
+    connstat.Report(os.Stdout, clientConns.Snapshot().Sub(clientBefore),
+    	serverConns.Snapshot().Sub(serverBefore), calls)
+    run := results.New(fmt.Sprintf("simpleTests %d", test_type))
+    if runtimeDelta.Elapsed > 0 {
+    	run.Add("throughput", "calls/s", true, float64(calls)/runtimeDelta.Elapsed.Seconds())
     }
+    run.AddRuntime(runtimeDelta, calls)
+    run.Param("allocs", allocs)
+    store.Save(run)
 }
 
 func checkError(err error) {
 	if err != nil {
 		fmt.Println("Fatal error ", err.Error())
-		os.Exit(1)
+		profiling.Exit(1)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,271 @@
+/* Message size distributions
+ *
+ * Real traffic mixes sizes, and a large message on a shared connection
+ * holds up the small ones queued behind it. A Dist draws the size of each
+ * message from a spec:
+ *
+ *   4096                  every message 4096 bytes
+ *   uniform:100-10K       uniform between 100 bytes and 10KiB
+ *   lognormal:1K,1.5      lognormal with a 1KiB median and sigma 1.5
+ *   bimodal:100,1M,0.05   100 bytes, but 5% of messages 1MiB
+ *   trace:sizes.txt       replay the sizes in a file, one per line
+ *
+ * Sizes take K, M and G suffixes (powers of 1024). Draws are seeded, so a
+ * run is repeatable; give each client its own seed so they differ. A Dist
+ * is not safe for concurrent use.
+ *
+ * Basic usage:
+ *   d, err := sizedist.Parse("bimodal:100,1M,0.05", int64(client))
+ *   data := make([]byte, d.Max())
+ *   ... send data[:d.Next()] ...
+ */
+
+package sizedist
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Dist interface {
+	// Next draws the size of the next message.
+	Next() int
+	// Max bounds every size Next returns.
+	Max() int
+	// String is the spec the distribution was parsed from.
+	String() string
+}
+
+// Lognormal draws are cut off at this many sigmas above the median, so
+// Max stays finite
+const lognormalSigmas = 4
+
+// ParseSize reads a byte count with an optional K, M or G suffix.
+func ParseSize(s string) (int, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "B")
+	mult := 1
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			mult = 1 << 10
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'G', 'g':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return v * mult, nil
+}
+
+// Parse reads a spec as the package doc describes, seeding its draws with
+// seed; trace replay starts at line seed instead.
+func Parse(spec string, seed int64) (Dist, error) {
+	kind, args := "fixed", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, args = spec[:i], spec[i+1:]
+	}
+	rng := rand.New(rand.NewSource(seed))
+	var d Dist
+	var err error
+	switch kind {
+	case "fixed":
+		var n int
+		n, err = ParseSize(args)
+		d = fixed{spec, n}
+	case "uniform":
+		d, err = parseUniform(spec, args, rng)
+	case "lognormal":
+		d, err = parseLognormal(spec, args, rng)
+	case "bimodal":
+		d, err = parseBimodal(spec, args, rng)
+	case "trace":
+		d, err = loadTrace(spec, args, seed)
+	default:
+		err = fmt.Errorf("unknown distribution %q, want fixed, uniform, lognormal, bimodal or trace", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("size distribution %q: %v", spec, err)
+	}
+	return d, nil
+}
+
+type fixed struct {
+	spec string
+	n    int
+}
+
+func (f fixed) Next() int      { return f.n }
+func (f fixed) Max() int       { return f.n }
+func (f fixed) String() string { return f.spec }
+
+type uniform struct {
+	spec     string
+	min, max int
+	rng      *rand.Rand
+}
+
+func parseUniform(spec, args string, rng *rand.Rand) (Dist, error) {
+	parts := strings.Split(args, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("want uniform:MIN-MAX")
+	}
+	min, err := ParseSize(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	max, err := ParseSize(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if max < min {
+		return nil, fmt.Errorf("max below min")
+	}
+	return &uniform{spec, min, max, rng}, nil
+}
+
+func (u *uniform) Next() int      { return u.min + u.rng.Intn(u.max-u.min+1) }
+func (u *uniform) Max() int       { return u.max }
+func (u *uniform) String() string { return u.spec }
+
+type lognormal struct {
+	spec          string
+	median, sigma float64
+	max           int
+	rng           *rand.Rand
+}
+
+func parseLognormal(spec, args string, rng *rand.Rand) (Dist, error) {
+	parts := strings.Split(args, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("want lognormal:MEDIAN,SIGMA")
+	}
+	median, err := ParseSize(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	sigma, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || sigma < 0 {
+		return nil, fmt.Errorf("bad sigma %q", parts[1])
+	}
+	max := float64(median) * math.Exp(lognormalSigmas*sigma)
+	return &lognormal{spec, float64(median), sigma, int(math.Min(max, 1<<30)), rng}, nil
+}
+
+func (l *lognormal) Next() int {
+	n := int(l.median * math.Exp(l.sigma*l.rng.NormFloat64()))
+	if n > l.max {
+		return l.max
+	}
+	return n
+}
+
+func (l *lognormal) Max() int       { return l.max }
+func (l *lognormal) String() string { return l.spec }
+
+type bimodal struct {
+	spec         string
+	small, large int
+	p            float64 // of a large message
+	rng          *rand.Rand
+}
+
+func parseBimodal(spec, args string, rng *rand.Rand) (Dist, error) {
+	parts := strings.Split(args, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("want bimodal:SMALL,LARGE,P(large)")
+	}
+	small, err := ParseSize(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	large, err := ParseSize(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || p < 0 || p > 1 {
+		return nil, fmt.Errorf("bad probability %q", parts[2])
+	}
+	return &bimodal{spec, small, large, p, rng}, nil
+}
+
+func (b *bimodal) Next() int {
+	if b.rng.Float64() < b.p {
+		return b.large
+	}
+	return b.small
+}
+
+func (b *bimodal) Max() int {
+	if b.large > b.small {
+		return b.large
+	}
+	return b.small
+}
+
+func (b *bimodal) String() string { return b.spec }
+
+type trace struct {
+	spec  string
+	sizes []int
+	next  int
+	max   int
+}
+
+// loadTrace reads one size per line; blank lines and lines starting with
+// # are skipped.
+func loadTrace(spec, path string, seed int64) (Dist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &trace{spec: spec}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		n, err := ParseSize(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		t.sizes = append(t.sizes, n)
+		if n > t.max {
+			t.max = n
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.sizes) == 0 {
+		return nil, fmt.Errorf("%s: no sizes", path)
+	}
+	t.next = int(seed % int64(len(t.sizes)))
+	if t.next < 0 {
+		t.next += len(t.sizes)
+	}
+	return t, nil
+}
+
+func (t *trace) Next() int {
+	n := t.sizes[t.next]
+	t.next = (t.next + 1) % len(t.sizes)
+	return n
+}
+
+func (t *trace) Max() int       { return t.max }
+func (t *trace) String() string { return t.spec }
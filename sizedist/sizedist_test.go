@@ -0,0 +1,95 @@
+package sizedist
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int{"100": 100, "10K": 10 << 10, "1M": 1 << 20, "2g": 2 << 30, "4KB": 4 << 10} {
+		if n, err := ParseSize(s); err != nil || n != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, n, err, want)
+		}
+	}
+	for _, s := range []string{"", "K", "-1", "1T"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) accepted", s)
+		}
+	}
+}
+
+// Every draw is within Max, and the same seed draws the same sizes
+func TestDraws(t *testing.T) {
+	for _, spec := range []string{"4096", "uniform:100-10K", "lognormal:1K,1.5", "bimodal:100,1M,0.05"} {
+		a, err := Parse(spec, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := Parse(spec, 7)
+		if a.String() != spec {
+			t.Errorf("%s: String() = %q", spec, a.String())
+		}
+		for i := 0; i < 1000; i++ {
+			n := a.Next()
+			if n < 0 || n > a.Max() {
+				t.Fatalf("%s: drew %d, Max %d", spec, n, a.Max())
+			}
+			if m := b.Next(); m != n {
+				t.Fatalf("%s: seed 7 drew %d then %d", spec, n, m)
+			}
+		}
+	}
+}
+
+func TestBimodal(t *testing.T) {
+	d, err := Parse("bimodal:100,1M,0.25", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := 0
+	for i := 0; i < 10000; i++ {
+		switch d.Next() {
+		case 1 << 20:
+			large++
+		case 100:
+		default:
+			t.Fatal("drew neither mode")
+		}
+	}
+	if large < 2200 || large > 2800 {
+		t.Errorf("%d of 10000 large, want about 2500", large)
+	}
+}
+
+// A trace replays its sizes in order from line seed, skipping comments
+func TestTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sizes.txt")
+	if err := ioutil.WriteFile(path, []byte("# sizes\n10\n\n2K\n30\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Parse("trace:"+path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Max() != 2048 {
+		t.Errorf("Max %d, want 2048", d.Max())
+	}
+	want := []int{2048, 30, 10, 2048}
+	for i, w := range want {
+		if n := d.Next(); n != w {
+			t.Fatalf("draw %d: %d, want %d", i, n, w)
+		}
+	}
+	if _, err := Parse("trace:"+filepath.Join(t.TempDir(), "missing"), 0); err == nil {
+		t.Error("a missing trace parsed")
+	}
+}
+
+func TestBadSpecs(t *testing.T) {
+	for _, spec := range []string{"uniform:10K-100", "uniform:100", "lognormal:1K", "lognormal:1K,-1", "bimodal:1,2,1.5", "zipf:1"} {
+		if _, err := Parse(spec, 0); err == nil {
+			t.Errorf("Parse(%q) accepted", spec)
+		}
+	}
+}
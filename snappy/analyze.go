@@ -0,0 +1,224 @@
+package main
+
+import "bytes"
+import "compress/flate"
+import "fmt"
+import "io/ioutil"
+import "math"
+import "strings"
+import "time"
+import "code.google.com/p/snappy-go/snappy"
+import "gorpc-tests/connstat"
+import "gorpc-tests/payload"
+import "gorpc-tests/results"
+
+////
+
+// A codec the cost model weighs, one block at a time as GetSnappyBlock
+// compresses
+type costCodec struct {
+	name   string
+	encode func(src []byte) ([]byte, error)
+	decode func(src []byte) ([]byte, error)
+}
+
+func deflateCodec(name string, level int) costCodec {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, level)
+	return costCodec{
+		name: name,
+		encode: func(src []byte) ([]byte, error) {
+			buf.Reset()
+			w.Reset(&buf)
+			w.Write(src)
+			err := w.Close()
+			return buf.Bytes(), err
+		},
+		decode: func(src []byte) ([]byte, error) {
+			return ioutil.ReadAll(flate.NewReader(bytes.NewReader(src)))
+		},
+	}
+}
+
+var costCodecs = []costCodec{
+	{
+		name:   "snappy",
+		encode: func(src []byte) ([]byte, error) { return snappy.Encode(nil, src) },
+		decode: func(src []byte) ([]byte, error) { return snappy.Decode(nil, src) },
+	},
+	deflateCodec("deflate-1", flate.BestSpeed),
+	deflateCodec("deflate-6", flate.DefaultCompression),
+}
+
+// Each codec encodes (and decodes) a file over and over for at least this
+// long
+const costMeasureTime = 300 * time.Millisecond
+
+// Generated content analyzed for a "payload:kind" entry
+const analyzedPayloadSize = 8 << 20
+
+// What a codec costs on one file: wire bytes over raw bytes, and raw MB/s
+// through encode and decode
+type codecCost struct {
+	ratio          float64
+	encode, decode float64
+}
+
+// breakEven is the link speed, in MB/s, below which compressing pays:
+// serial when a block is encoded, sent and decoded before the next (time
+// per byte 1/E + r/B + 1/D against 1/B), pipelined when the three overlap
+// (throughput min(E, D, B/r) against B)
+func (c codecCost) breakEven() (serial, pipelined float64) {
+	if c.ratio >= 1 {
+		return 0, 0
+	}
+	return (1 - c.ratio) / (1/c.encode + 1/c.decode), math.Min(c.encode, c.decode)
+}
+
+// speedup is how much faster the file moves compressed over a link of
+// link MB/s, serial and pipelined
+func (c codecCost) speedup(link float64) (serial, pipelined float64) {
+	serial = 1 / (1/c.encode + c.ratio/link + 1/c.decode) / link
+	pipelined = math.Min(math.Min(c.encode, c.decode), link/c.ratio) / link
+	return serial, pipelined
+}
+
+// splitBlocks cuts data into blocks of blockSize, the last one short
+func splitBlocks(data []byte) [][]byte {
+	var blocks [][]byte
+	for len(data) > blockSize {
+		blocks = append(blocks, data[:blockSize])
+		data = data[blockSize:]
+	}
+	return append(blocks, data)
+}
+
+// measureCodec encodes and decodes every block of data with c until
+// costMeasureTime has passed, checking that the blocks come back whole
+func measureCodec(c costCodec, data []byte) (codecCost, error) {
+	blocks := splitBlocks(data)
+	encoded := make([][]byte, len(blocks))
+	var wire int
+	for i, b := range blocks {
+		enc, err := c.encode(b)
+		if err != nil {
+			return codecCost{}, err
+		}
+		encoded[i] = append([]byte(nil), enc...)
+		wire += len(enc)
+		dec, err := c.decode(encoded[i])
+		if err != nil {
+			return codecCost{}, err
+		}
+		if !bytes.Equal(dec, b) {
+			return codecCost{}, fmt.Errorf("%s: block %d does not decode to itself", c.name, i)
+		}
+	}
+	rate := func(f func(i int) error) (float64, error) {
+		began := time.Now()
+		var n int64
+		for time.Since(began) < costMeasureTime {
+			for i := range blocks {
+				if err := f(i); err != nil {
+					return 0, err
+				}
+				n += int64(len(blocks[i]))
+			}
+		}
+		return float64(n) / 1e6 / time.Since(began).Seconds(), nil
+	}
+	encodeRate, err := rate(func(i int) error {
+		_, err := c.encode(blocks[i])
+		return err
+	})
+	if err != nil {
+		return codecCost{}, err
+	}
+	decodeRate, err := rate(func(i int) error {
+		_, err := c.decode(encoded[i])
+		return err
+	})
+	if err != nil {
+		return codecCost{}, err
+	}
+	return codecCost{float64(wire) / float64(len(data)), encodeRate, decodeRate}, nil
+}
+
+// probeLink streams size raw bytes from the server at host:port and
+// returns the MB/s. The stream hashes every frame on both ends, so on a
+// fast link this is what one connection carries rather than the wire
+func probeLink(host string, port int, size int64) (float64, error) {
+	client, err := connstat.Dial("tcp", fmt.Sprintf("%s:%d", host, port), &connCounters)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	began := time.Now()
+	n, _, err := transferStream(client, host, size, false)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n) / 1e6 / time.Since(began).Seconds(), nil
+}
+
+// loadAnalyzed reads a file to analyze, or generates "payload:kind"
+func loadAnalyzed(name string) ([]byte, error) {
+	if strings.HasPrefix(name, "payload:") {
+		return payload.Generate(strings.TrimPrefix(name, "payload:"), analyzedPayloadSize)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// runAnalysis prints, per file and codec, the compression ratio, encode
+// and decode throughput and the link speed below which the codec pays
+// off; with a link speed (given, or probed from the server when link is 0)
+// it also predicts the speedup there
+func runAnalysis(files []string, link float64, host string, port int, probeSize int64, store *results.Flags) {
+	how := "given"
+	if link == 0 {
+		var err error
+		if link, err = probeLink(host, port, probeSize); err != nil {
+			fmt.Printf("No link speed: probing %s:%d failed (%v); give -link or start a server\n\n", host, port, err)
+		}
+		how = fmt.Sprintf("probed with a %d byte stream from %s:%d", probeSize, host, port)
+	}
+	if link > 0 {
+		fmt.Printf("Link: %.1f MB/s (%.0f Mbit/s), %s\n\n", link, link*8, how)
+	}
+	run := results.New("dfs-costmodel")
+	run.Param("block", blockSize)
+	if link > 0 {
+		run.Add("link", "MB/s", true, link)
+	}
+	for _, name := range files {
+		data, err := loadAnalyzed(name)
+		handleError(err)
+		fmt.Printf("%s: %d bytes in blocks of %d\n", name, len(data), blockSize)
+		fmt.Printf("  %-10s %7s %12s %12s %22s", "codec", "ratio", "encode MB/s", "decode MB/s", "pays below MB/s (s/p)")
+		if link > 0 {
+			fmt.Printf(" %16s", "speedup (s/p)")
+		}
+		fmt.Println()
+		for _, c := range costCodecs {
+			cost, err := measureCodec(c, data)
+			handleError(err)
+			serial, pipelined := cost.breakEven()
+			fmt.Printf("  %-10s %7.3f %12.1f %12.1f %10.1f / %9.1f", c.name, cost.ratio, cost.encode, cost.decode, serial, pipelined)
+			metric := name + " " + c.name
+			run.Add(metric+" ratio", "wire/raw", false, cost.ratio)
+			run.Add(metric+" encode", "MB/s", true, cost.encode)
+			run.Add(metric+" decode", "MB/s", true, cost.decode)
+			run.Add(metric+" break-even-serial", "MB/s", true, serial)
+			run.Add(metric+" break-even-pipelined", "MB/s", true, pipelined)
+			if link > 0 {
+				s, p := cost.speedup(link)
+				fmt.Printf(" %7.2fx / %5.2fx", s, p)
+				run.Add(metric+" speedup-pipelined", "x", true, p)
+			}
+			fmt.Println()
+		}
+		fmt.Println()
+	}
+	fmt.Println("s: a block is encoded, sent and decoded before the next; p: the three overlap")
+	store.Save(run)
+}
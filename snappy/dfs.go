@@ -1,6 +1,7 @@
 package main
 
 import "bytes"
+import "context"
 import "crypto/md5"
 import "errors"
 import "flag"
@@ -10,18 +11,66 @@ import "net"
 import "net/rpc"
 import "os"
 import "runtime"
+import "sort"
+import "strings"
 import "sync"
+import "sync/atomic"
+import "time"
 import "code.google.com/p/snappy-go/snappy"
+import "gorpc-tests/replica"
+import "gorpc-tests/resilient"
+import "gorpc-tests/rpcctx"
+import "gorpc-tests/profiling"
+import "gorpc-tests/connstat"
+import "gorpc-tests/results"
+import "gorpc-tests/payload"
+import "gorpc-tests/sizedist"
+import "gorpc-tests/workpool"
 
 ////
 type DFS int
 
+// The file blocks are read from; clients give it too, to label their results
+var blockFile = "moby.txt"
+
 type DataChunk struct {
 	Chunk, Hash []byte
 }
 
+// Generated content served instead of blockFile when -payload is set
+var payloadKind string
+var generatedMu sync.Mutex
+var generated = make(map[int][]byte)
+
+// generatedBlock is the first blockSize bytes of the -payload content,
+// generated once per size so every GetBlock returns the same block, as it
+// does from a file
+func generatedBlock(blockSize int) ([]byte, error) {
+	generatedMu.Lock()
+	defer generatedMu.Unlock()
+	if data, ok := generated[blockSize]; ok {
+		return data, nil
+	}
+	data, err := payload.Generate(payloadKind, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	generated[blockSize] = data
+	return data, nil
+}
+
 func (d *DFS) GetBlock(blockSize int, reply *DataChunk) error {
-	file, err := os.Open("moby.txt")
+	if payloadKind != "" {
+		data, err := generatedBlock(blockSize)
+		handleError(err)
+		h := md5.New()
+		h.Write(data)
+		// a copy, since GetSnappyBlock encodes in place
+		reply.Chunk = append([]byte(nil), data...)
+		reply.Hash = h.Sum(reply.Hash)
+		return nil
+	}
+	file, err := os.Open(blockFile)
 	defer file.Close()
 	handleError(err)
 	//
@@ -53,9 +102,13 @@ func (d *DFS) GetSnappyBlock(blockSize int, reply *DataChunk) error {
 
 ////
 
+// Read/write syscalls on this process's connections
+var connCounters connstat.Counters
+
 func handleError(err error) {
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		profiling.Exit(1)
 	}
 }
 
@@ -70,14 +123,20 @@ func startServer(port int) *rpc.Server {
 	//
 	rpcServer := rpc.NewServer()
 	rpcServer.Register(new(DFS))
+	// Lets clients read the server's syscall and allocation counts
+	rpcServer.RegisterName("Stats", &connstat.Service{Counters: &connCounters})
+	// Blocks written by -replicas clients
+	blocks := replica.NewStore()
+	blocks.Diverge = diverge
+	rpcServer.RegisterName("Blocks", blocks)
 	//
 	fmt.Println("Starting blocking server...")
-	rpcServer.Accept(listener)
+	rpcServer.Accept(connstat.WrapListener(listener, &connCounters))
 	return rpcServer
 }
 
 func startClient(host string, port int) *rpc.Client {
-	client, err := rpc.Dial("tcp", host+fmt.Sprintf(":%d", port))
+	client, err := connstat.Dial("tcp", host+fmt.Sprintf(":%d", port), &connCounters)
 	handleError(err)
 
 	return client
@@ -85,38 +144,224 @@ func startClient(host string, port int) *rpc.Client {
 
 ////
 
-func performGetBlock(host string, port int, isSnappy bool) {
-	remote := startClient(host, port)
-	defer remote.Close()
-	//
-	var reply DataChunk
-	var err error
-	blockSize := 512 * 1024 // 512 KB
-	// Retrieve the block
+// Retry policy for GetBlock calls; nil means any error is fatal
+var retryPolicy *resilient.Policy
+
+// Retry counts of every call made with retryPolicy
+var retryMu sync.Mutex
+var retryStats resilient.Stats
+
+// Bounds every GetBlock call when -timeout is set
+var tracker *rpcctx.Tracker
+
+type remoteDFS interface {
+	Call(string, interface{}, interface{}) error
+	Go(string, interface{}, interface{}, chan *rpc.Call) *rpc.Call
+	Close() error
+}
+
+func callBlock(remote remoteDFS, method string, blockSize int, reply *DataChunk) error {
+	if tracker != nil {
+		return tracker.Call(remote, method, blockSize, reply)
+	}
+	return remote.Call(method, blockSize, reply)
+}
+
+// Size of each block a client asks for
+var blockSize = 512 * 1024 // 512 KB
+
+// countedRetries folds a resilient client's counts into retryStats when
+// it is closed
+type countedRetries struct{ *resilient.Client }
+
+func (c countedRetries) Close() error {
+	retryMu.Lock()
+	retryStats.Add(c.Stats())
+	retryMu.Unlock()
+	return c.Client.Close()
+}
+
+func dialDFS(host string, port int) remoteDFS {
+	if retryPolicy == nil {
+		return startClient(host, port)
+	}
+	// dials lazily, so a restarting server costs retries instead of exiting
+	policy := *retryPolicy
+	policy.Dial = func(network, addr string) (*rpc.Client, error) {
+		return connstat.Dial(network, addr, &connCounters)
+	}
+	return countedRetries{resilient.New("tcp", host+fmt.Sprintf(":%d", port), policy)}
+}
+
+func blockMethod(isSnappy bool) string {
 	if isSnappy {
-		err = remote.Call("DFS.GetSnappyBlock", blockSize, &reply)
-		handleError(err)
-		reply.Chunk, err = snappy.Decode(reply.Chunk, reply.Chunk)
-		handleError(err)
-	} else {
-		err = remote.Call("DFS.GetBlock", blockSize, &reply)
-		handleError(err)
+		return "DFS.GetSnappyBlock"
+	}
+	return "DFS.GetBlock"
+}
+
+// checkBlock decodes a block if it is snappy and verifies its hash
+func checkBlock(reply *DataChunk, isSnappy bool) error {
+	if isSnappy {
+		var err error
+		if reply.Chunk, err = snappy.Decode(reply.Chunk, reply.Chunk); err != nil {
+			return err
+		}
+	}
+	if err := verifyChunk(reply); err != nil {
+		return err
+	}
+	firstBlock.Do(func() { sampleBlock = reply.Chunk })
+	return nil
+}
+
+// performGetBlock fetches and checks one block, and reports whether it
+// arrived before -timeout
+func performGetBlock(remote remoteDFS, isSnappy bool) (bool, error) {
+	var reply DataChunk
+	err := callBlock(remote, blockMethod(isSnappy), blockSize, &reply)
+	if rpcctx.IsTimeout(err) {
+		return false, nil
 	}
-	// Calculate the MD5 hash and ensure it's equal
+	if err != nil {
+		return false, err
+	}
+	return true, checkBlock(&reply, isSnappy)
+}
+
+// The first block a client received, to report how well blocks compress
+var firstBlock sync.Once
+var sampleBlock []byte
+
+// Calculate the MD5 hash and ensure it's equal
+func verifyChunk(reply *DataChunk) error {
 	h := md5.New()
 	h.Write(reply.Chunk)
 	if !bytes.Equal(reply.Hash, h.Sum(nil)) {
-		handleError(errors.New("Hash did not match"))
+		return errors.New("Hash did not match")
 	}
+	return nil
 }
 
-func worker(host string, port int, isSnappy bool, linkChan chan int, w *sync.WaitGroup) {
-	// Signal this is complete when we leave the function
-	defer w.Done()
-	//
-	for _ = range linkChan {
-		performGetBlock(host, port, isSnappy)
+// How the block client hands -calls blocks to its workers: a workpool
+// dispatch, or pipelined, -window workers sharing each connection so it
+// has as many calls in flight
+const pipelined = "pipelined"
+
+var workers = 10
+var dispatch = "unbuffered"
+
+// Each worker keeps one connection instead of dialing per block
+var reuseConns = false
+
+// fetchBlocks fetches -calls blocks through a workpool and returns its
+// stats, the blocks that arrived and the time spent dialing
+func fetchBlocks(host string, port int, isSnappy bool, calls int) (workpool.Stats, int64, time.Duration, error) {
+	cfg := workpool.Config{Workers: workers}
+	// connections kept for reuse; nil when every block dials its own
+	var conns chan remoteDFS
+	if dispatch == pipelined {
+		cfg.Workers = workers * transferWindow
+		conns = make(chan remoteDFS, cfg.Workers)
+		for i := 0; i < workers; i++ {
+			remote := dialDFS(host, port)
+			defer remote.Close()
+			for j := 0; j < transferWindow; j++ {
+				conns <- remote
+			}
+		}
+	} else {
+		d, err := workpool.ParseDispatch(dispatch)
+		if err != nil {
+			return workpool.Stats{}, 0, 0, err
+		}
+		cfg.Dispatch = d
+		// buffered queues every block up front, as do the per-worker queues
+		cfg.QueueSize = calls
+		if d == workpool.PerWorker || d == workpool.Stealing {
+			cfg.QueueSize = calls/workers + 1
+		}
+		if reuseConns {
+			conns = make(chan remoteDFS, workers)
+			for i := 0; i < workers; i++ {
+				remote := dialDFS(host, port)
+				defer remote.Close()
+				conns <- remote
+			}
+		}
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := workpool.New(ctx, cfg)
+	var blocks, dialing int64
+	fetch := func(ctx context.Context) error {
+		var remote remoteDFS
+		if conns != nil {
+			remote = <-conns
+			defer func() { conns <- remote }()
+		} else {
+			// a -retries client dials in its first call instead
+			began := time.Now()
+			remote = dialDFS(host, port)
+			atomic.AddInt64(&dialing, int64(time.Since(began)))
+			defer remote.Close()
+		}
+		ok, err := performGetBlock(remote, isSnappy)
+		if err != nil {
+			// the first error stops the run; the blocks still queued are dropped
+			cancel()
+			return err
+		}
+		if ok {
+			atomic.AddInt64(&blocks, 1)
+		}
+		return nil
+	}
+	for i := 0; i < calls; i++ {
+		if p.Submit(fetch) != nil {
+			break
+		}
+	}
+	err := p.Close()
+	return p.Stats(), blocks, time.Duration(dialing), err
+}
+
+// reportWorkers prints the rate of all workers together over elapsed and
+// of each one, how long blocks waited for a worker and the share of
+// worker time spent dialing, and adds them to run
+func reportWorkers(stats workpool.Stats, blocks int64, dialing, elapsed time.Duration, run *results.Run) {
+	var rates []float64
+	for _, n := range stats.Ran {
+		rates = append(rates, float64(n)/elapsed.Seconds())
+	}
+	sorted := append([]float64(nil), rates...)
+	sort.Float64s(sorted)
+	conns := "a connection per block"
+	if dispatch == pipelined {
+		conns = fmt.Sprintf("%d connections, %d workers each", workers, transferWindow)
+	} else if reuseConns {
+		conns = "a connection per worker"
+	}
+	fmt.Printf("Workers: %d, %s dispatch, %s\n", stats.Workers, dispatch, conns)
+	fmt.Printf("Aggregate: %.1f blocks/s\n", float64(blocks)/elapsed.Seconds())
+	// pipelined runs a pool goroutine per call in flight, not per connection
+	per := "Per worker"
+	if dispatch == pipelined {
+		per = "Per pipelined goroutine"
+	}
+	fmt.Printf("%s: %.1f / %.1f / %.1f blocks/s (min / median / max)\n",
+		per, sorted[0], sorted[len(sorted)/2], sorted[len(sorted)-1])
+	fmt.Printf("Queued: p50 %v, p99 %v before a worker took the block\n",
+		stats.Wait.Percentile(0.5), stats.Wait.Percentile(0.99))
+	// dialing only: the first call on a connection also pays for gob's
+	// type exchange
+	share := 100 * dialing.Seconds() / (elapsed.Seconds() * float64(stats.Workers))
+	fmt.Printf("Dialing: %.1f%% of worker time\n", share)
+	run.Param("workers", stats.Workers)
+	run.Param("dispatch", dispatch)
+	run.Param("reuse", reuseConns || dispatch == pipelined)
+	run.Add("worker-throughput", "blocks/s", true, rates...)
+	run.Add("dial-share", "%", false, share)
 }
 
 ////
@@ -130,24 +375,136 @@ func main() {
 	isServer := flag.Bool("server", false, "Run as server")
 	isSnappy := flag.Bool("snappy", false, "Blocks encoded using Snappy codec")
 	totalCalls := flag.Int("calls", 3000, "Number of calls to make to the server")
+	retries := flag.Int("retries", 0, "Redial and retry a block this many times when the server goes away")
+	retryMax := flag.Duration("retry-max", 2*time.Second, "Longest backoff between retries")
+	timeout := flag.Duration("timeout", 0, "Give up on a block after this long (0 waits forever)")
+	flag.IntVar(&blockSize, "block", blockSize, "Block size in bytes")
+	flag.StringVar(&payloadKind, "payload", "", "Serve generated blocks instead of -file: "+payload.Usage)
+	flag.StringVar(&blockFile, "file", blockFile, "File the server reads blocks from (give clients the same, for their results)")
+	transfer := flag.String("transfer", "", "Fetch one whole file by blocks (ReadAt calls of -block) or by stream, instead of -calls blocks")
+	transferSize := flag.String("size", "", "Bytes to transfer (K, M, G suffixes) [default: the server's file]")
+	flag.IntVar(&frameSize, "frame", frameSize, "Stream frame size in bytes")
+	flag.IntVar(&credits, "credits", credits, "Stream frames the server may send ahead")
+	flag.IntVar(&transferWindow, "window", transferWindow, "ReadAt calls in flight (per server) when transferring by blocks, GetBlock calls per worker with -dispatch=pipelined")
+	flag.IntVar(&workers, "workers", workers, "Workers fetching -calls blocks")
+	flag.BoolVar(&reuseConns, "reuse", reuseConns, "Each worker keeps one connection instead of dialing per block")
+	flag.StringVar(&dispatch, "dispatch", dispatch, "How blocks reach the workers: unbuffered (as each frees up), buffered (all queued up front), perworker or stealing (see workpool), or pipelined (-window calls in flight per connection, one connection per worker)")
+	servers := flag.String("servers", "", "Fetch one whole file striped across these servers: a count on consecutive ports from -port, or host:port,...")
+	flag.IntVar(&stripeSize, "stripe", stripeSize, "Stripe size in bytes for -servers and -launch -partition [default: -block]")
+	flag.StringVar(&layout, "layout", layout, "How the file lies on -servers: replicated (each holds it whole) or partitioned (as -launch -partition splits it)")
+	outFile := flag.String("out", "", "Write the file fetched with -servers here, in order")
+	launchN := flag.Int("launch", 0, "Start this many servers on consecutive ports from -port and wait for ^C")
+	partition := flag.Bool("partition", false, "With -launch, split -file into one part per server, stripe k to server k%N")
+	replicas := flag.Int("replicas", 0, "Write -calls blocks to this many of -servers each and read them back at -quorum")
+	quorum := flag.Int("quorum", 0, "Agreeing copies a -replicas read needs [default: a majority]")
+	passes := flag.Int("passes", 3, "Times -replicas reads every block back")
+	flag.Float64Var(&diverge, "diverge", diverge, "Fraction of -replicas blocks the server keeps altered, as if it missed the write")
+	analyze := flag.String("analyze", "", "Weigh compression for these files (or payload:kind), comma separated: ratio, encode and decode MB/s and the link speed below which each codec pays off")
+	link := flag.Float64("link", 0, "Link speed in MB/s for -analyze (12.5 is 100 Mbit/s) [default: probe the server with a -size stream]")
+	prof := profiling.AddFlags()
+	store := results.AddFlags()
 	flag.Parse()
+	if payloadKind != "" {
+		handleError(payload.Check(payloadKind))
+	}
+	sess := prof.Start()
+	defer sess.Stop()
+	if dispatch != pipelined {
+		_, err := workpool.ParseDispatch(dispatch)
+		handleError(err)
+	}
+	if workers < 1 {
+		handleError(errors.New("-workers: want at least one"))
+	}
+	if *timeout > 0 {
+		tracker = rpcctx.NewTracker(*timeout)
+	}
+	if *retries > 0 {
+		policy := resilient.DefaultPolicy("DFS.GetBlock", "DFS.GetSnappyBlock")
+		policy.MaxRetries = *retries
+		policy.MaxDelay = *retryMax
+		retryPolicy = &policy
+	}
 	//
-	if *isServer {
+	if *analyze != "" {
+		probeSize := int64(64 << 20)
+		if *transferSize != "" {
+			n, err := sizedist.ParseSize(*transferSize)
+			handleError(err)
+			probeSize = int64(n)
+		}
+		runAnalysis(strings.Split(*analyze, ","), *link, *host, *port, probeSize, store)
+	} else if *launchN > 0 {
+		launch(*launchN, *port, *partition)
+	} else if *isServer {
+		// Profiles are written when the server is interrupted
+		sess.StopOnInterrupt()
 		// Start server blocks
 		startServer(*port)
+	} else if *replicas > 0 {
+		if *servers == "" {
+			handleError(errors.New("-replicas needs -servers"))
+		}
+		addrs, err := parseServers(*servers, *host, *port)
+		handleError(err)
+		cfg := replica.Config{R: *replicas, Quorum: *quorum, Timeout: *timeout}
+		runReplicated(addrs, *totalCalls, *passes, cfg, store)
+	} else if *transfer != "" || *servers != "" {
+		total := 0
+		if *transferSize != "" {
+			n, err := sizedist.ParseSize(*transferSize)
+			handleError(err)
+			total = n
+		}
+		if *servers == "" {
+			runTransfer(*transfer, *host, *port, *isSnappy, int64(total), store)
+		} else if *transfer == "" || *transfer == "blocks" {
+			addrs, err := parseServers(*servers, *host, *port)
+			handleError(err)
+			runStriped(addrs, int64(total), *isSnappy, *outFile, store)
+		} else {
+			handleError(errors.New("-servers fetches by blocks; it takes no -transfer=" + *transfer))
+		}
 	} else {
-		lCh := make(chan int)
-		w := new(sync.WaitGroup)
-		// Set up the worker pool
-		for i := 0; i < 10; i++ {
-			w.Add(1)
-			go worker(*host, *port, *isSnappy, lCh, w)
-		}
-		// Send in the work requests to the workers
-		for i := 0; i < *totalCalls; i++ {
-			lCh <- i
-		}
-		close(lCh)
-		w.Wait()
+		// A separate connection reads the server's counters around the run;
+		// it is opened before counting starts so it costs nothing in between
+		control, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", *host, *port))
+		handleError(err)
+		serverBefore, err := connstat.Fetch(control)
+		handleError(err)
+		before := profiling.Snapshot()
+		clientBefore := connCounters.Snapshot()
+		poolStats, blocks, dialing, fetchErr := fetchBlocks(*host, *port, *isSnappy, *totalCalls)
+		handleError(fetchErr)
+		calls := int64(*totalCalls)
+		clientDelta := connCounters.Snapshot().Sub(clientBefore)
+		runtimeDelta := profiling.Snapshot().Sub(before)
+		// A server restarted mid-run has lost the counters it started with
+		serverAfter, err := connstat.Fetch(control)
+		serverDelta := serverAfter.Sub(serverBefore)
+		runtimeDelta.Report(os.Stdout, calls)
+		if err == nil {
+			serverDelta.Allocs.Report(os.Stdout, "server", calls)
+			connstat.Report(os.Stdout, clientDelta, serverDelta.Conn, calls)
+		} else {
+			fmt.Printf("Server counters unavailable: %v\n", err)
+		}
+		if retryPolicy != nil {
+			fmt.Printf("Retries: %v\n", retryStats)
+		}
+		if tracker != nil {
+			tracker.Report(os.Stdout)
+		}
+		//
+		run := results.New("dfs")
+		// blocks that arrived, not calls asked for
+		run.Add("throughput", "blocks/s", true, float64(blocks)/runtimeDelta.Elapsed.Seconds())
+		run.AddRuntime(runtimeDelta, calls)
+		run.AddPayload(sampleBlock)
+		reportWorkers(poolStats, blocks, dialing, runtimeDelta.Elapsed, run)
+		if err == nil {
+			run.Add("server-allocs", "allocs/call", false, float64(serverDelta.Allocs.Objects)/float64(calls))
+		}
+		store.Save(run)
 	}
 }
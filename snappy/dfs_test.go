@@ -0,0 +1,285 @@
+package main
+
+import "bytes"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net"
+import "net/rpc"
+import "testing"
+import "code.google.com/p/snappy-go/snappy"
+import "gorpc-tests/stream"
+import "gorpc-tests/codec"
+
+////
+
+// payload sizes the benchmarks sweep
+var sizes = []int{64, 4096, 65536, 1 << 20}
+
+// serveDFS connects to a DFS served on a loopback port with the named codec.
+// GetBlock reads moby.txt, which go test finds in the package directory.
+func serveDFS(t testing.TB, codecName string) *rpc.Client {
+	server := rpc.NewServer()
+	server.Register(new(DFS))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go codec.Accept(server, l, codecName, codec.DefaultOptions())
+	client, err := codec.Dial("tcp", l.Addr().String(), codecName, codec.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// A block fetch as performGetBlock does it, decode and hash check included
+func fetchBlock(client *rpc.Client, isSnappy bool, blockSize int) error {
+	var reply DataChunk
+	if !isSnappy {
+		if err := client.Call("DFS.GetBlock", blockSize, &reply); err != nil {
+			return err
+		}
+		return verifyChunk(&reply)
+	}
+	if err := client.Call("DFS.GetSnappyBlock", blockSize, &reply); err != nil {
+		return err
+	}
+	var err error
+	reply.Chunk, err = snappy.Decode(nil, reply.Chunk)
+	if err != nil {
+		return err
+	}
+	return verifyChunk(&reply)
+}
+
+func benchmarkBlock(b *testing.B, isSnappy bool) {
+	for _, blockSize := range sizes {
+		for _, codecName := range codec.Names {
+			b.Run(fmt.Sprintf("size=%d/codec=%s", blockSize, codecName), func(b *testing.B) {
+				client := serveDFS(b, codecName)
+				//
+				b.SetBytes(int64(blockSize))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := fetchBlock(client, isSnappy, blockSize); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkGetBlock(b *testing.B) { benchmarkBlock(b, false) }
+
+func BenchmarkGetSnappyBlock(b *testing.B) { benchmarkBlock(b, true) }
+
+////
+
+// Both block kinds arrive intact over every codec
+func TestFetch(t *testing.T) {
+	for _, codecName := range codec.Names {
+		client := serveDFS(t, codecName)
+		for _, isSnappy := range []bool{false, true} {
+			if err := fetchBlock(client, isSnappy, 64*1024); err != nil {
+				t.Errorf("%s, snappy %v: %v", codecName, isSnappy, err)
+			}
+		}
+	}
+}
+
+// The hash check rejects a corrupted or truncated chunk
+func TestHashCheck(t *testing.T) {
+	var chunk DataChunk
+	if err := new(DFS).GetBlock(4096, &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChunk(&chunk); err != nil {
+		t.Fatalf("intact chunk: %v", err)
+	}
+	chunk.Chunk[100] ^= 1
+	if verifyChunk(&chunk) == nil {
+		t.Error("flipped bit not detected")
+	}
+	chunk.Chunk[100] ^= 1
+	chunk.Chunk = chunk.Chunk[:len(chunk.Chunk)-1]
+	if verifyChunk(&chunk) == nil {
+		t.Error("truncated chunk not detected")
+	}
+}
+
+// A block larger than the file is trimmed to the file, hash included
+func TestShortBlock(t *testing.T) {
+	var chunk DataChunk
+	if err := new(DFS).GetBlock(4<<20, &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk.Chunk) >= 4<<20 {
+		t.Errorf("got %d bytes, want the file's length", len(chunk.Chunk))
+	}
+	if err := verifyChunk(&chunk); err != nil {
+		t.Error(err)
+	}
+}
+
+// The whole file arrives intact by blocks and by stream, with and
+// without Snappy
+func TestTransfer(t *testing.T) {
+	file, err := ioutil.ReadFile(blockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serveDFS(t, "gob")
+	for _, isSnappy := range []bool{false, true} {
+		n, err := transferBlocks(client, int64(len(file)), isSnappy)
+		if err != nil {
+			t.Errorf("blocks, snappy %v: %v", isSnappy, err)
+		} else if n != int64(len(file)) {
+			t.Errorf("blocks, snappy %v: %d bytes, want %d", isSnappy, n, len(file))
+		}
+		got, err := streamAll(client, int64(len(file)), isSnappy)
+		if err != nil {
+			t.Errorf("stream, snappy %v: %v", isSnappy, err)
+		} else if !bytes.Equal(got, file) {
+			t.Errorf("stream, snappy %v: differs from the file", isSnappy)
+		}
+	}
+}
+
+// streamAll reads a stream of length bytes as transferStream does, but
+// keeps them
+func streamAll(client *rpc.Client, length int64, isSnappy bool) ([]byte, error) {
+	var ticket StreamTicket
+	if err := client.Call("DFS.OpenStream", StreamArgs{0, length}, &ticket); err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ticket.Port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	r, err := stream.NewReader(conn, stream.Hello{Token: ticket.Token, FrameSize: 4096, Credits: 2, Snappy: isSnappy})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// flipper flips one bit of what passes through it, at offset at
+type flipper struct {
+	r   io.Reader
+	at  int64
+	off int64
+}
+
+func (f *flipper) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	if f.at >= f.off && f.at < f.off+int64(n) {
+		b[f.at-f.off] ^= 1
+	}
+	f.off += int64(n)
+	return n, err
+}
+
+// A stream frame corrupted on the way is rejected, and so is a token
+// nobody asked for
+func TestStreamErrors(t *testing.T) {
+	client := serveDFS(t, "gob")
+	var ticket StreamTicket
+	if err := client.Call("DFS.OpenStream", StreamArgs{0, 64 * 1024}, &ticket); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ticket.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a bit in the second frame's data
+	corrupting := struct {
+		io.Reader
+		io.Writer
+	}{&flipper{r: conn, at: 2*4096 + 100}, conn}
+	r, err := stream.NewReader(corrupting, stream.Hello{Token: ticket.Token, FrameSize: 4096, Credits: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != stream.ErrCorrupt {
+		t.Errorf("corrupted frame: got %v, want %v", err, stream.ErrCorrupt)
+	}
+	//
+	conn2, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ticket.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	r, err = stream.NewReader(conn2, stream.Hello{Token: ticket.Token ^ 1, FrameSize: 4096, Credits: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err == nil {
+		t.Error("unknown token streamed")
+	}
+}
+
+// A file striped across three replicas arrives whole and in order, the
+// last stripe short
+func TestStriped(t *testing.T) {
+	file, err := ioutil.ReadFile(blockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &stripedFetch{total: int64(len(file)), stripe: 100000, isSnappy: true, ahead: 4}
+	f.stripes = (f.total + f.stripe - 1) / f.stripe
+	for i := 0; i < 3; i++ {
+		f.servers = append(f.servers, &stripeServer{addr: fmt.Sprint("replica ", i), client: serveDFS(t, "gob")})
+	}
+	var out bytes.Buffer
+	if err := f.run(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), file) {
+		t.Error("reassembled file differs")
+	}
+}
+
+// The whole file (moby.txt, about 1.2MB) per op, by ReadAt calls of
+// blockSize over every codec and by stream
+func BenchmarkFileByBlocks(b *testing.B) {
+	for _, codecName := range codec.Names {
+		b.Run("codec="+codecName, func(b *testing.B) {
+			client := serveDFS(b, codecName)
+			var size int64
+			if err := client.Call("DFS.Size", 0, &size); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := transferBlocks(client, size, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFileByStream(b *testing.B) {
+	client := serveDFS(b, "gob")
+	var size int64
+	if err := client.Call("DFS.Size", 0, &size); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := transferStream(client, "127.0.0.1", size, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
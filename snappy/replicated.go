@@ -0,0 +1,135 @@
+package main
+
+import "bytes"
+import "errors"
+import "fmt"
+import "net/rpc"
+import "sync"
+import "time"
+import "gorpc-tests/connstat"
+import "gorpc-tests/payload"
+import "gorpc-tests/replica"
+import "gorpc-tests/resilient"
+import "gorpc-tests/results"
+
+////
+
+// Fraction of the blocks a server's Blocks store keeps altered, standing
+// for a replica that missed writes
+var diverge = 0.0
+
+// replicatedBlock is the content of block k: generated data, shifted by k
+// so no two blocks are alike
+func replicatedBlock(data []byte, k int) []byte {
+	block := make([]byte, blockSize)
+	(&periodic{data, int64(k) * 4099}).Read(block)
+	return block
+}
+
+// runReplicated writes n blocks to R of the servers each, then reads them
+// all back passes times at quorum, reporting throughput and what the
+// reads found degraded, divergent and repaired along the way
+func runReplicated(addrs []string, n, passes int, cfg replica.Config, store *results.Flags) {
+	kind := payloadKind
+	if kind == "" {
+		kind = "text"
+	}
+	data, err := payload.Generate(kind, generatedPeriod)
+	handleError(err)
+	// Clients redial a server that comes back, but never retry: another
+	// replica answers instead
+	policy := resilient.Policy{Dial: func(network, addr string) (*rpc.Client, error) {
+		return connstat.Dial(network, addr, &connCounters)
+	}}
+	var servers []replica.Caller
+	for _, addr := range addrs {
+		c := resilient.New("tcp", addr, policy)
+		defer c.Close()
+		servers = append(servers, c)
+	}
+	if cfg.Quorum == 0 {
+		cfg.Quorum = cfg.R/2 + 1
+	}
+	r, err := replica.New(servers, cfg)
+	handleError(err)
+	fmt.Printf("%d blocks of %d bytes, %d copies each on %d servers, reads need %d\n",
+		n, blockSize, cfg.R, len(addrs), cfg.Quorum)
+	//
+	// each pass is transferWindow workers over all the blocks
+	pass := func(op func(k int) error) (time.Duration, int) {
+		keys := make(chan int)
+		var mu sync.Mutex
+		failed := 0
+		var w sync.WaitGroup
+		began := time.Now()
+		for i := 0; i < transferWindow; i++ {
+			w.Add(1)
+			go func() {
+				defer w.Done()
+				for k := range keys {
+					if err := op(k); err != nil {
+						mu.Lock()
+						if failed == 0 {
+							fmt.Println("First failure:", err)
+						}
+						failed++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		for k := 0; k < n; k++ {
+			keys <- k
+		}
+		close(keys)
+		w.Wait()
+		elapsed := time.Since(began)
+		// replies still outstanding belong to this pass
+		r.Wait()
+		return elapsed, failed
+	}
+	key := func(k int) string { return fmt.Sprint("block-", k) }
+	run := results.New("dfs-replicated")
+	//
+	before := r.Stats()
+	elapsed, failed := pass(func(k int) error {
+		return r.Put(key(k), replicatedBlock(data, k))
+	})
+	written := float64((n-failed)*blockSize) / 1e6
+	fmt.Printf("Write: %.1f MB/s, %d failed; %v\n", written/elapsed.Seconds(), failed, r.Stats().Sub(before))
+	run.Add("write", "MB/s", true, written/elapsed.Seconds())
+	var throughput []float64
+	var wrong, failedReads int
+	for p := 1; p <= passes; p++ {
+		before := r.Stats()
+		var mu sync.Mutex
+		elapsed, failed := pass(func(k int) error {
+			block, err := r.Get(key(k))
+			if err == nil && !bytes.Equal(block, replicatedBlock(data, k)) {
+				mu.Lock()
+				wrong++
+				mu.Unlock()
+				err = errors.New(key(k) + ": read back other than written")
+			}
+			return err
+		})
+		failedReads += failed
+		// only the blocks that arrived count
+		read := float64((n-failed)*blockSize) / 1e6
+		throughput = append(throughput, read/elapsed.Seconds())
+		fmt.Printf("Read %d: %.1f MB/s, %d failed; %v\n", p, read/elapsed.Seconds(), failed, r.Stats().Sub(before))
+	}
+	total := r.Stats()
+	if wrong > 0 {
+		fmt.Printf("%d reads returned a block other than the one written: the quorum was too small to outvote divergent copies\n", wrong)
+	}
+	run.Param("replicas", cfg.R)
+	run.Param("quorum", cfg.Quorum)
+	run.Add("read", "MB/s", true, throughput...)
+	run.Add("failed-reads", "reads", false, float64(failedReads))
+	run.Add("wrong-reads", "reads", false, float64(wrong))
+	run.Add("degraded", "ops", false, float64(total.Degraded))
+	run.Add("divergent", "copies", false, float64(total.Divergent))
+	run.Add("repaired", "copies", false, float64(total.Repaired))
+	store.Save(run)
+}
@@ -0,0 +1,407 @@
+package main
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/rpc"
+import "os"
+import "os/exec"
+import "os/signal"
+import "strconv"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+import "code.google.com/p/snappy-go/snappy"
+import "gorpc-tests/measure"
+import "gorpc-tests/profiling"
+import "gorpc-tests/results"
+
+////
+
+// How a file is laid out over the servers: every server holds all of it
+// (replicated), or stripe k lives on server k%N at (k/N)*stripe, as the
+// launcher's -partition splits it (partitioned)
+const (
+	replicated  = "replicated"
+	partitioned = "partitioned"
+)
+
+// Striping of a fetch across servers; a stripe of 0 is -block
+var stripeSize = 0
+var layout = replicated
+
+// parseServers reads -servers: a count of servers on consecutive ports
+// from host:port, or a list of host:port
+func parseServers(spec, host string, port int) ([]string, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 1 {
+			return nil, fmt.Errorf("-servers=%d: want at least one", n)
+		}
+		var addrs []string
+		for i := 0; i < n; i++ {
+			addrs = append(addrs, fmt.Sprintf("%s:%d", host, port+i))
+		}
+		return addrs, nil
+	}
+	return strings.Split(spec, ","), nil
+}
+
+// One server of a striped fetch
+type stripeServer struct {
+	addr    string
+	client  *rpc.Client
+	mu      sync.Mutex
+	bytes   int64
+	latency measure.Histogram
+}
+
+// A fetched stripe, for the assembler
+type fetched struct {
+	k    int64
+	data []byte
+	err  error
+}
+
+// stripedFetch reads total bytes as stripes from servers, transferWindow
+// ReadAt calls in flight per server, and writes them to out in order. No
+// stripe is fetched more than ahead stripes beyond the first not yet
+// written, which bounds what waits for reassembly.
+type stripedFetch struct {
+	servers  []*stripeServer
+	total    int64
+	stripe   int64
+	stripes  int64
+	isSnappy bool
+	ahead    int64
+
+	mu        sync.Mutex
+	moved     *sync.Cond // written advanced, or the fetch failed
+	written   int64      // stripes written to out
+	next      int64      // replicated: the next stripe any server takes
+	nextOf    []int64    // partitioned: the next stripe of each server
+	failed    bool
+	delivered chan fetched
+}
+
+// take returns the next stripe server i should fetch, or -1 when it has
+// none left
+func (f *stripedFetch) take(i int) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		k := f.next
+		if layout == partitioned {
+			k = f.nextOf[i]
+		}
+		if k >= f.stripes || f.failed {
+			return -1
+		}
+		if k < f.written+f.ahead {
+			if layout == partitioned {
+				f.nextOf[i] += int64(len(f.servers))
+			} else {
+				f.next++
+			}
+			return k
+		}
+		f.moved.Wait()
+	}
+}
+
+// read fetches stripe k from server i and checks it
+func (f *stripedFetch) read(i int, k int64) ([]byte, error) {
+	s := f.servers[i]
+	offset := k * f.stripe
+	size := f.stripe
+	if f.total-offset < size {
+		size = f.total - offset
+	}
+	if layout == partitioned {
+		offset = k / int64(len(f.servers)) * f.stripe
+	}
+	var reply DataChunk
+	began := time.Now()
+	err := s.client.Call("DFS.ReadAt", ReadArgs{offset, int(size), f.isSnappy}, &reply)
+	took := time.Since(began)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.addr, err)
+	}
+	if f.isSnappy {
+		if reply.Chunk, err = snappy.Decode(nil, reply.Chunk); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.addr, err)
+		}
+	}
+	if err := verifyChunk(&reply); err != nil {
+		return nil, fmt.Errorf("%s: stripe %d: %v", s.addr, k, err)
+	}
+	if int64(len(reply.Chunk)) != size {
+		return nil, fmt.Errorf("%s: stripe %d: %d bytes, want %d", s.addr, k, len(reply.Chunk), size)
+	}
+	s.mu.Lock()
+	s.bytes += size
+	s.latency.Record(took)
+	s.mu.Unlock()
+	return reply.Chunk, nil
+}
+
+func (f *stripedFetch) worker(i int, w *sync.WaitGroup) {
+	defer w.Done()
+	for {
+		k := f.take(i)
+		if k < 0 {
+			return
+		}
+		data, err := f.read(i, k)
+		f.delivered <- fetched{k, data, err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// run fetches every stripe and writes them to out in order
+func (f *stripedFetch) run(out io.Writer) error {
+	f.moved = sync.NewCond(&f.mu)
+	f.nextOf = make([]int64, len(f.servers))
+	for i := range f.nextOf {
+		f.nextOf[i] = int64(i)
+	}
+	f.delivered = make(chan fetched, f.ahead)
+	w := new(sync.WaitGroup)
+	for i := range f.servers {
+		for j := 0; j < transferWindow; j++ {
+			w.Add(1)
+			go f.worker(i, w)
+		}
+	}
+	go func() {
+		w.Wait()
+		close(f.delivered)
+	}()
+	pending := make(map[int64][]byte)
+	var err error
+	for s := range f.delivered {
+		if err != nil {
+			continue
+		}
+		if s.err != nil {
+			err = s.err
+		} else {
+			pending[s.k] = s.data
+			for data, ok := pending[f.written]; ok && err == nil; data, ok = pending[f.written] {
+				_, err = out.Write(data)
+				delete(pending, f.written)
+				f.mu.Lock()
+				f.written++
+				f.mu.Unlock()
+			}
+		}
+		f.mu.Lock()
+		f.failed = err != nil
+		f.moved.Broadcast()
+		f.mu.Unlock()
+	}
+	if err == nil && f.written != f.stripes {
+		err = fmt.Errorf("%d of %d stripes arrived", f.written, f.stripes)
+	}
+	return err
+}
+
+// stripedSize is the file's length: the sum of the partitions, or what
+// every replica agrees on
+func stripedSize(servers []*stripeServer) (int64, error) {
+	var total int64
+	for i, s := range servers {
+		var size int64
+		if err := s.client.Call("DFS.Size", 0, &size); err != nil {
+			return 0, fmt.Errorf("%s: %v", s.addr, err)
+		}
+		if size < 0 {
+			return 0, errors.New("the servers generate their content: give -size")
+		}
+		if layout == partitioned {
+			total += size
+		} else if i > 0 && size != total {
+			return 0, fmt.Errorf("%s holds %d bytes, %s %d: not replicas", s.addr, size, servers[0].addr, total)
+		} else {
+			total = size
+		}
+	}
+	return total, nil
+}
+
+// runStriped fetches one whole file striped across addrs and reports the
+// bandwidth of each server and of all together
+func runStriped(addrs []string, total int64, isSnappy bool, outFile string, store *results.Flags) {
+	if layout != replicated && layout != partitioned {
+		handleError(fmt.Errorf("unknown layout %q, want %s or %s", layout, replicated, partitioned))
+	}
+	stripe := int64(stripeSize)
+	if stripe == 0 {
+		stripe = int64(blockSize)
+	}
+	var servers []*stripeServer
+	for _, addr := range addrs {
+		i := strings.LastIndex(addr, ":")
+		if i < 0 {
+			handleError(fmt.Errorf("server %q: want host:port", addr))
+		}
+		port, err := strconv.Atoi(addr[i+1:])
+		handleError(err)
+		s := &stripeServer{addr: addr, client: startClient(addr[:i], port)}
+		defer s.client.Close()
+		servers = append(servers, s)
+	}
+	if total == 0 {
+		var err error
+		total, err = stripedSize(servers)
+		handleError(err)
+	}
+	var out io.Writer = ioutil.Discard
+	if outFile != "" {
+		file, err := os.Create(outFile)
+		handleError(err)
+		defer file.Close()
+		buffered := bufio.NewWriter(file)
+		defer buffered.Flush()
+		out = buffered
+	}
+	f := &stripedFetch{
+		servers:  servers,
+		total:    total,
+		stripe:   stripe,
+		stripes:  (total + stripe - 1) / stripe,
+		isSnappy: isSnappy,
+		// room for every call in flight, and as many again waiting on a
+		// slow server
+		ahead: int64(2 * len(servers) * transferWindow),
+	}
+	//
+	stop := make(chan struct{})
+	peak := samplePeakHeap(stop)
+	before := profiling.Snapshot()
+	err := f.run(out)
+	runtimeDelta := profiling.Snapshot().Sub(before)
+	close(stop)
+	peakHeap := <-peak
+	handleError(err)
+	//
+	elapsed := runtimeDelta.Elapsed.Seconds()
+	mb := float64(total) / 1e6
+	fmt.Printf("Transferred %d bytes striped across %d %s servers in %v: %.1f MB/s\n",
+		total, len(servers), layout, runtimeDelta.Elapsed, mb/elapsed)
+	fmt.Printf("Stripes: %d of %d bytes, %d in flight per server\n", f.stripes, stripe, transferWindow)
+	run := results.New("dfs-striped")
+	run.Add("throughput", "MB/s", true, mb/elapsed)
+	for i, s := range servers {
+		share := float64(s.bytes) / 1e6
+		fmt.Printf("  %-21s %8.1f MB (%4.1f%%) %8.1f MB/s, ReadAt p50 %v, p99 %v\n", s.addr, share,
+			100*share/mb, share/elapsed, s.latency.Percentile(0.5), s.latency.Percentile(0.99))
+		run.Add(fmt.Sprintf("server %d throughput", i), "MB/s", true, share/elapsed)
+	}
+	fmt.Printf("Memory (client): %.0f bytes allocated per MB, peak heap %.1f MB\n",
+		float64(runtimeDelta.Allocs.Bytes)/mb, float64(peakHeap)/1e6)
+	run.Add("client-alloc", "bytes/MB", false, float64(runtimeDelta.Allocs.Bytes)/mb)
+	run.Add("client-peak-heap", "MB", false, float64(peakHeap)/1e6)
+	store.Save(run)
+}
+
+////
+
+// partitionFile writes part i of n of file for every i, stripe k of the
+// file going to part k%n, and returns their names
+func partitionFile(file string, n int, stripe int64) ([]string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var names []string
+	var parts []*bufio.Writer
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s.part%dof%d", file, i, n)
+		out, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		defer out.Close()
+		w := bufio.NewWriter(out)
+		defer w.Flush()
+		names = append(names, name)
+		parts = append(parts, w)
+	}
+	for k := 0; ; k++ {
+		_, err := io.CopyN(parts[k%n], in, stripe)
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// launch starts n servers of this binary on ports port to port+n-1, each
+// serving the file whole or, partitioned, its part, and stops them when
+// interrupted or when one of them exits
+func launch(n, port int, partition bool) {
+	exe, err := os.Executable()
+	handleError(err)
+	files := make([]string, n)
+	for i := range files {
+		files[i] = blockFile
+	}
+	if partition {
+		if payloadKind != "" {
+			handleError(errors.New("-partition splits -file; generated content cannot be partitioned"))
+		}
+		stripe := int64(stripeSize)
+		if stripe == 0 {
+			stripe = int64(blockSize)
+		}
+		files, err = partitionFile(blockFile, n, stripe)
+		handleError(err)
+	}
+	exited := make(chan int, n)
+	var cmds []*exec.Cmd
+	for i := 0; i < n; i++ {
+		args := []string{"-server", "-port", strconv.Itoa(port + i), "-file", files[i]}
+		if payloadKind != "" {
+			args = append(args, "-payload", payloadKind)
+		}
+		if diverge > 0 {
+			args = append(args, "-diverge", strconv.FormatFloat(diverge, 'g', -1, 64))
+		}
+		cmd := exec.Command(exe, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		handleError(cmd.Start())
+		cmds = append(cmds, cmd)
+		go func(i int, cmd *exec.Cmd) {
+			cmd.Wait()
+			exited <- i
+		}(i, cmd)
+	}
+	layoutName := replicated
+	if partition {
+		layoutName = partitioned
+	}
+	fmt.Printf("Started %d %s servers on ports %d-%d; ^C stops them\n", n, layoutName, port, port+n-1)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	running := n
+	select {
+	case <-interrupted:
+	case i := <-exited:
+		fmt.Printf("Server on port %d exited, stopping the others\n", port+i)
+		running--
+	}
+	for _, cmd := range cmds {
+		cmd.Process.Kill()
+	}
+	for ; running > 0; running-- {
+		<-exited
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import "crypto/rand"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "log"
+import "net"
+import "net/rpc"
+import "os"
+import "runtime/metrics"
+import "sync"
+import "time"
+import "crypto/md5"
+import "code.google.com/p/snappy-go/snappy"
+import "gorpc-tests/connstat"
+import "gorpc-tests/profiling"
+import "gorpc-tests/results"
+import "gorpc-tests/stream"
+
+////
+
+// A range of the served content, for ReadAt
+type ReadArgs struct {
+	Offset int64
+	Size   int
+	Snappy bool
+}
+
+// Generated content repeats with this period, so any offset can be served
+const generatedPeriod = 1 << 20
+
+// periodic reads data over and over, starting at off
+type periodic struct {
+	data []byte
+	off  int64
+}
+
+func (p *periodic) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		c := copy(b[n:], p.data[p.off%int64(len(p.data)):])
+		n += c
+		p.off += int64(c)
+	}
+	return n, nil
+}
+
+// openRange returns length bytes of what the server serves, from offset;
+// a negative length reads to the end of the file
+func openRange(offset, length int64) (io.Reader, func(), error) {
+	if payloadKind != "" {
+		if length < 0 {
+			return nil, nil, errors.New("generated content has no end, give a length")
+		}
+		data, err := generatedBlock(generatedPeriod)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.LimitReader(&periodic{data, offset}, length), func() {}, nil
+	}
+	file, err := os.Open(blockFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length < 0 {
+		length = 1<<63 - 1 - offset
+	}
+	return io.NewSectionReader(file, offset, length), func() { file.Close() }, nil
+}
+
+// Size is the length of the served file, or -1 for generated content
+func (d *DFS) Size(args int, reply *int64) error {
+	if payloadKind != "" {
+		*reply = -1
+		return nil
+	}
+	info, err := os.Stat(blockFile)
+	if err != nil {
+		return err
+	}
+	*reply = info.Size()
+	return nil
+}
+
+// ReadAt is GetBlock (or GetSnappyBlock) anywhere in the file; a range
+// past the end comes back short
+func (d *DFS) ReadAt(args ReadArgs, reply *DataChunk) error {
+	r, done, err := openRange(args.Offset, int64(args.Size))
+	if err != nil {
+		return err
+	}
+	defer done()
+	//
+	data := make([]byte, args.Size)
+	n, err := io.ReadFull(r, data)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	data = data[:n]
+	h := md5.New()
+	h.Write(data)
+	reply.Hash = h.Sum(reply.Hash)
+	reply.Chunk = data
+	if args.Snappy {
+		reply.Chunk, err = snappy.Encode(nil, data)
+	}
+	return err
+}
+
+////
+
+// A stream of the served content; a negative Length streams to the end of
+// the file
+type StreamArgs struct {
+	Offset, Length int64
+}
+
+// Where to connect for a stream, and the token that claims it
+type StreamTicket struct {
+	Port  int
+	Token uint64
+}
+
+// Streams opened but not yet connected to, by token
+var streamMu sync.Mutex
+var pendingStreams = make(map[uint64]StreamArgs)
+
+// The stream listener, started by the first OpenStream
+var streamOnce sync.Once
+var streamPort int
+var streamErr error
+
+// How long a client has to send its hello
+const helloTimeout = 10 * time.Second
+
+// OpenStream reserves a stream; the client then connects to the ticket's
+// port and sends a stream.Hello with its token
+func (d *DFS) OpenStream(args StreamArgs, reply *StreamTicket) error {
+	streamOnce.Do(func() {
+		var l net.Listener
+		l, streamErr = net.Listen("tcp", ":0")
+		if streamErr != nil {
+			return
+		}
+		streamPort = l.Addr().(*net.TCPAddr).Port
+		go serveStreams(connstat.WrapListener(l, &connCounters))
+	})
+	if streamErr != nil {
+		return streamErr
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	token := binary.BigEndian.Uint64(b[:])
+	streamMu.Lock()
+	pendingStreams[token] = args
+	streamMu.Unlock()
+	*reply = StreamTicket{streamPort, token}
+	return nil
+}
+
+func serveStreams(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Print("stream listener: ", err)
+			return
+		}
+		go serveStream(conn)
+	}
+}
+
+// failing is a source that fails at once, to send an error to the client
+type failing struct{ err error }
+
+func (f failing) Read([]byte) (int, error) { return 0, f.err }
+
+func serveStream(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	hello, err := stream.ReadHello(conn)
+	if err != nil {
+		log.Print("stream hello: ", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	streamMu.Lock()
+	args, ok := pendingStreams[hello.Token]
+	delete(pendingStreams, hello.Token)
+	streamMu.Unlock()
+	var src io.Reader = failing{errors.New("unknown stream token")}
+	if ok {
+		r, done, err := openRange(args.Offset, args.Length)
+		if err != nil {
+			src = failing{err}
+		} else {
+			defer done()
+			src = r
+		}
+	}
+	stats, err := stream.Send(conn, src, hello)
+	if err != nil {
+		log.Print("stream: ", err)
+	}
+	log.Printf("Streamed %d bytes in %d frames, waited for credits %d times (%v)",
+		stats.RawBytes, stats.Frames, stats.Stalls, stats.Stalled)
+}
+
+////
+
+// How a client transfers a whole file: frames and credits of a stream, or
+// ReadAt calls of blockSize in flight at once
+var frameSize = 64 * 1024
+var credits = 8
+var transferWindow = 4
+
+// transferBlocks reads total bytes with ReadAt calls, checking every block,
+// and returns how many arrived
+func transferBlocks(c *rpc.Client, total int64, isSnappy bool) (int64, error) {
+	done := make(chan *rpc.Call, transferWindow)
+	var next, received int64
+	inFlight := 0
+	issue := func() {
+		size := int64(blockSize)
+		if total-next < size {
+			size = total - next
+		}
+		c.Go("DFS.ReadAt", ReadArgs{next, int(size), isSnappy}, new(DataChunk), done)
+		next += size
+		inFlight++
+	}
+	for inFlight < transferWindow && next < total {
+		issue()
+	}
+	for inFlight > 0 {
+		call := <-done
+		inFlight--
+		if call.Error != nil {
+			return received, call.Error
+		}
+		reply := call.Reply.(*DataChunk)
+		if isSnappy {
+			var err error
+			if reply.Chunk, err = snappy.Decode(nil, reply.Chunk); err != nil {
+				return received, err
+			}
+		}
+		if err := verifyChunk(reply); err != nil {
+			return received, err
+		}
+		received += int64(len(reply.Chunk))
+		if next < total {
+			issue()
+		}
+	}
+	return received, nil
+}
+
+// transferStream streams total bytes from host, frames checked by the
+// stream.Reader, and returns how many arrived
+func transferStream(c *rpc.Client, host string, total int64, isSnappy bool) (int64, stream.ReadStats, error) {
+	var ticket StreamTicket
+	if err := c.Call("DFS.OpenStream", StreamArgs{0, total}, &ticket); err != nil {
+		return 0, stream.ReadStats{}, err
+	}
+	conn, err := connstat.DialConn("tcp", fmt.Sprintf("%s:%d", host, ticket.Port), &connCounters)
+	if err != nil {
+		return 0, stream.ReadStats{}, err
+	}
+	defer conn.Close()
+	r, err := stream.NewReader(conn, stream.Hello{
+		Token:     ticket.Token,
+		FrameSize: uint32(frameSize),
+		Credits:   uint32(credits),
+		Snappy:    isSnappy,
+	})
+	if err != nil {
+		return 0, stream.ReadStats{}, err
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	return n, r.Stats(), err
+}
+
+// samplePeakHeap reads the heap in use every few milliseconds until stop
+// is closed, then sends the highest reading
+func samplePeakHeap(stop chan struct{}) chan uint64 {
+	peak := make(chan uint64, 1)
+	go func() {
+		sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		var max uint64
+		tick := time.NewTicker(5 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			metrics.Read(sample)
+			if v := sample[0].Value.Uint64(); v > max {
+				max = v
+			}
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return peak
+}
+
+// runTransfer moves a whole file (total bytes, or the server's file when
+// 0) by blocks or by stream and reports throughput and memory on both ends
+func runTransfer(mode, host string, port int, isSnappy bool, total int64, store *results.Flags) {
+	if mode != "blocks" && mode != "stream" {
+		handleError(fmt.Errorf("unknown transfer %q, want blocks or stream", mode))
+	}
+	client := startClient(host, port)
+	defer client.Close()
+	if total == 0 {
+		handleError(client.Call("DFS.Size", 0, &total))
+		if total < 0 {
+			handleError(errors.New("the server generates its content: give -size"))
+		}
+	}
+	// A separate connection reads the server's counters around the run
+	control, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	handleError(err)
+	defer control.Close()
+	serverBefore, err := connstat.Fetch(control)
+	handleError(err)
+	//
+	stop := make(chan struct{})
+	peak := samplePeakHeap(stop)
+	before := profiling.Snapshot()
+	var received int64
+	var streamStats stream.ReadStats
+	if mode == "blocks" {
+		received, err = transferBlocks(client, total, isSnappy)
+	} else {
+		received, streamStats, err = transferStream(client, host, total, isSnappy)
+	}
+	runtimeDelta := profiling.Snapshot().Sub(before)
+	close(stop)
+	peakHeap := <-peak
+	handleError(err)
+	serverAfter, err := connstat.Fetch(control)
+	handleError(err)
+	serverDelta := serverAfter.Sub(serverBefore)
+	//
+	mb := float64(received) / 1e6
+	mbPerSec := mb / runtimeDelta.Elapsed.Seconds()
+	fmt.Printf("Transferred %d bytes by %s in %v: %.1f MB/s\n", received, mode, runtimeDelta.Elapsed, mbPerSec)
+	if mode == "blocks" {
+		fmt.Printf("Blocks: %d bytes, %d in flight\n", blockSize, transferWindow)
+	} else {
+		fmt.Printf("Stream: %d frames of up to %d bytes, %d credits, wire/raw %.3f\n",
+			streamStats.Frames, frameSize, credits, float64(streamStats.WireBytes)/float64(streamStats.RawBytes))
+	}
+	fmt.Printf("Memory (client): %.0f bytes allocated per MB, peak heap %.1f MB\n",
+		float64(runtimeDelta.Allocs.Bytes)/mb, float64(peakHeap)/1e6)
+	fmt.Printf("Memory (server): %.0f bytes allocated per MB\n", float64(serverDelta.Allocs.Bytes)/mb)
+	//
+	run := results.New("dfs-transfer")
+	run.Add("throughput", "MB/s", true, mbPerSec)
+	run.Add("client-alloc", "bytes/MB", false, float64(runtimeDelta.Allocs.Bytes)/mb)
+	run.Add("client-peak-heap", "MB", false, float64(peakHeap)/1e6)
+	run.Add("server-alloc", "bytes/MB", false, float64(serverDelta.Allocs.Bytes)/mb)
+	if mode == "stream" {
+		run.Add("wire-ratio", "wire/raw", false, float64(streamStats.WireBytes)/float64(streamStats.RawBytes))
+	}
+	store.Save(run)
+}
@@ -0,0 +1,333 @@
+/* Flow-controlled streams of framed chunks
+ *
+ * A DataChunk reply holds a whole block, so both ends buffer all of it, and
+ * a file of many blocks costs a call per block. A stream sends a file as
+ * frames of at most FrameSize bytes over a connection of its own. Each
+ * frame carries the MD5 of its bytes and may be Snappy-compressed on its
+ * own. The receiver grants the sender credits, one per frame it may send
+ * ahead, as it consumes frames, so a slow reader holds the sender back
+ * instead of buffers growing: each end holds about one frame, whatever the
+ * length of the stream.
+ *
+ * On the wire, after the receiver's Hello:
+ *
+ *   frame   flags byte, raw length uint32, wire length uint32, MD5 of the
+ *           raw bytes, then the wire bytes; sender to receiver
+ *   credit  uint32 frames; receiver to sender
+ *
+ * A frame flagged end closes the stream, one flagged error carries the
+ * sender's error message.
+ *
+ * Basic usage:
+ *   sender:    hello, err := stream.ReadHello(conn)
+ *              ... find what hello.Token asks for ...
+ *              stats, err := stream.Send(conn, file, hello)
+ *   receiver:  r, err := stream.NewReader(conn, stream.Hello{Token: t, FrameSize: 64 << 10, Credits: 8})
+ *              n, err := io.Copy(dst, r)
+ */
+
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+const (
+	flagSnappy = 1 << iota
+	flagEnd
+	flagError
+)
+
+const headerSize = 1 + 4 + 4 + md5.Size
+
+// Largest frame either end accepts
+const MaxFrameSize = 16 << 20
+
+var ErrCorrupt = errors.New("stream: frame does not match its hash")
+
+// Hello opens a stream: the receiver sends it first.
+type Hello struct {
+	Token     uint64 // names the stream to the sender, e.g. from an RPC
+	FrameSize uint32 // largest frame, before compression
+	Credits   uint32 // frames the sender may send ahead
+	Snappy    bool   // compress each frame that gets smaller
+}
+
+const helloSize = 8 + 4 + 4 + 1
+
+func (h Hello) check() error {
+	if h.FrameSize == 0 || h.FrameSize > MaxFrameSize {
+		return fmt.Errorf("stream: frame size %d out of range (1 to %d)", h.FrameSize, MaxFrameSize)
+	}
+	if h.Credits == 0 {
+		return errors.New("stream: no credits")
+	}
+	return nil
+}
+
+func ReadHello(r io.Reader) (Hello, error) {
+	var b [helloSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Hello{}, err
+	}
+	h := Hello{
+		Token:     binary.BigEndian.Uint64(b[0:]),
+		FrameSize: binary.BigEndian.Uint32(b[8:]),
+		Credits:   binary.BigEndian.Uint32(b[12:]),
+		Snappy:    b[16] != 0,
+	}
+	return h, h.check()
+}
+
+func writeHello(w io.Writer, h Hello) error {
+	var b [helloSize]byte
+	binary.BigEndian.PutUint64(b[0:], h.Token)
+	binary.BigEndian.PutUint32(b[8:], h.FrameSize)
+	binary.BigEndian.PutUint32(b[12:], h.Credits)
+	if h.Snappy {
+		b[16] = 1
+	}
+	_, err := w.Write(b[:])
+	return err
+}
+
+// SendStats counts what Send sent and how long it waited for credits.
+type SendStats struct {
+	Frames    int64
+	RawBytes  int64
+	WireBytes int64
+	Stalls    int64         // frames that waited for a credit
+	Stalled   time.Duration // waiting for credits in all
+}
+
+// Send writes src to conn as frames until src ends, reading the credits
+// the receiver returns on conn. A read error from src is sent on as an
+// error frame and returned. The caller closes conn.
+func Send(conn io.ReadWriter, src io.Reader, h Hello) (SendStats, error) {
+	var stats SendStats
+	if err := h.check(); err != nil {
+		return stats, err
+	}
+	grants, done := make(chan uint32, 16), make(chan struct{})
+	defer close(done)
+	go readCredits(conn, grants, done)
+	w := bufio.NewWriterSize(conn, headerSize+int(h.FrameSize))
+	raw := make([]byte, h.FrameSize)
+	var enc []byte
+	credits := h.Credits
+	for {
+		n, err := io.ReadFull(src, raw)
+		if err == io.EOF {
+			return stats, writeFrame(w, flagEnd, 0, nil, nil)
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			msg := []byte(err.Error())
+			if len(msg) > len(raw) {
+				msg = msg[:len(raw)]
+			}
+			writeFrame(w, flagError, 0, nil, msg)
+			return stats, err
+		}
+		for credits == 0 {
+			began := time.Now()
+			grant, ok := <-grants
+			if !ok {
+				return stats, errors.New("stream: receiver went away")
+			}
+			stats.Stalls++
+			stats.Stalled += time.Since(began)
+			credits += grant
+		}
+		// take credits already granted without waiting
+	drain:
+		for {
+			select {
+			case grant, ok := <-grants:
+				if !ok {
+					break drain
+				}
+				credits += grant
+			default:
+				break drain
+			}
+		}
+		sum := md5.Sum(raw[:n])
+		flags, wire := byte(0), raw[:n]
+		if h.Snappy {
+			enc, _ = snappy.Encode(enc[:cap(enc)], raw[:n])
+			if len(enc) < n {
+				flags, wire = flagSnappy, enc
+			}
+		}
+		if err := writeFrame(w, flags, n, sum[:], wire); err != nil {
+			return stats, err
+		}
+		credits--
+		stats.Frames++
+		stats.RawBytes += int64(n)
+		stats.WireBytes += int64(headerSize + len(wire))
+		if n < len(raw) {
+			return stats, writeFrame(w, flagEnd, 0, nil, nil)
+		}
+	}
+}
+
+// readCredits passes on credits until the receiver goes away or Send is
+// done.
+func readCredits(r io.Reader, grants chan uint32, done chan struct{}) {
+	defer close(grants)
+	var b [4]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		select {
+		case grants <- binary.BigEndian.Uint32(b[:]):
+		case <-done:
+			return
+		}
+	}
+}
+
+func writeFrame(w *bufio.Writer, flags byte, rawLen int, sum, wire []byte) error {
+	var hdr [headerSize]byte
+	hdr[0] = flags
+	binary.BigEndian.PutUint32(hdr[1:], uint32(rawLen))
+	binary.BigEndian.PutUint32(hdr[5:], uint32(len(wire)))
+	copy(hdr[9:], sum)
+	w.Write(hdr[:])
+	w.Write(wire)
+	return w.Flush()
+}
+
+// Reader reads a stream's bytes, checking every frame and returning
+// credits as it goes.
+type Reader struct {
+	conn  io.ReadWriter
+	r     *bufio.Reader
+	hello Hello
+	wire  []byte
+	raw   []byte
+	buf   []byte // what is left of the current frame
+	owed  uint32 // credits consumed but not yet returned
+	err   error
+	stats ReadStats
+}
+
+type ReadStats struct {
+	Frames    int64
+	RawBytes  int64
+	WireBytes int64
+}
+
+// NewReader sends h on conn and returns the Reader of the stream that
+// follows.
+func NewReader(conn io.ReadWriter, h Hello) (*Reader, error) {
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+	if err := writeHello(conn, h); err != nil {
+		return nil, err
+	}
+	return &Reader{
+		conn:  conn,
+		r:     bufio.NewReaderSize(conn, headerSize+int(h.FrameSize)),
+		hello: h,
+		wire:  make([]byte, h.FrameSize),
+		raw:   make([]byte, h.FrameSize),
+	}, nil
+}
+
+func (r *Reader) Stats() ReadStats { return r.stats }
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	if len(r.buf) == 0 {
+		// the frame is consumed, so the sender may replace it; a sender
+		// that has sent everything may have closed already, and one that
+		// went away early fails the next frame instead
+		r.credit()
+	}
+	return n, nil
+}
+
+// next reads a frame into buf, or returns why there is none.
+func (r *Reader) next() error {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	flags := hdr[0]
+	rawLen := binary.BigEndian.Uint32(hdr[1:])
+	wireLen := binary.BigEndian.Uint32(hdr[5:])
+	if rawLen > r.hello.FrameSize || wireLen > r.hello.FrameSize {
+		return fmt.Errorf("stream: frame of %d bytes (%d on the wire) over %d", rawLen, wireLen, r.hello.FrameSize)
+	}
+	wire := r.wire[:wireLen]
+	if _, err := io.ReadFull(r.r, wire); err != nil {
+		return err
+	}
+	switch {
+	case flags&flagEnd != 0:
+		return io.EOF
+	case flags&flagError != 0:
+		return fmt.Errorf("stream: sender: %s", wire)
+	}
+	data := wire
+	if flags&flagSnappy != 0 {
+		// Decode allocates for a length over its buffer's, so check the
+		// one the frame claims first
+		n, err := snappy.DecodedLen(wire)
+		if err != nil {
+			return err
+		}
+		if n != int(rawLen) {
+			return ErrCorrupt
+		}
+		if data, err = snappy.Decode(r.raw, wire); err != nil {
+			return err
+		}
+	}
+	sum := md5.Sum(data)
+	if len(data) != int(rawLen) || !bytes.Equal(sum[:], hdr[9:]) {
+		return ErrCorrupt
+	}
+	r.buf = data
+	r.stats.Frames++
+	r.stats.RawBytes += int64(rawLen)
+	r.stats.WireBytes += int64(headerSize + wireLen)
+	return nil
+}
+
+// credit returns consumed frames to the sender, half the window at a time
+// so a credit costs less than a write per frame.
+func (r *Reader) credit() error {
+	r.owed++
+	if r.owed < (r.hello.Credits+1)/2 {
+		return nil
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], r.owed)
+	r.owed = 0
+	_, err := r.conn.Write(b[:])
+	return err
+}
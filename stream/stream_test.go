@@ -0,0 +1,225 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// conns returns the two ends of a loopback TCP connection; unlike
+// net.Pipe, its writes do not wait for the other end to read.
+func conns(t *testing.T) (sender, receiver net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	receiver, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender = <-accepted
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	return sender, receiver
+}
+
+type sent struct {
+	stats SendStats
+	err   error
+}
+
+// start runs Send of src on one end and returns a Reader of the other.
+func start(t *testing.T, src io.Reader, h Hello) (*Reader, chan sent) {
+	sconn, rconn := conns(t)
+	done := make(chan sent, 1)
+	go func() {
+		hello, err := ReadHello(sconn)
+		if err != nil {
+			done <- sent{err: err}
+			return
+		}
+		if hello != h {
+			done <- sent{err: errors.New("hello changed on the way")}
+			return
+		}
+		stats, err := Send(sconn, src, hello)
+		done <- sent{stats, err}
+	}()
+	r, err := NewReader(rconn, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, done
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 1000, 4096, 3 * 4096, 100000} {
+		for _, compress := range []bool{false, true} {
+			data := bytes.Repeat([]byte("0123456789"), n/10+1)[:n]
+			h := Hello{Token: 7, FrameSize: 4096, Credits: 4, Snappy: compress}
+			r, done := start(t, bytes.NewReader(data), h)
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%d bytes: %v", n, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%d bytes: read %d changed ones", n, len(got))
+			}
+			s := <-done
+			if s.err != nil {
+				t.Fatal(s.err)
+			}
+			frames := int64((n + 4095) / 4096)
+			if rs := r.Stats(); s.stats.Frames != frames || rs.Frames != frames || rs.RawBytes != int64(n) || rs.WireBytes != s.stats.WireBytes {
+				t.Errorf("%d bytes: sent %+v, read %+v, want %d frames", n, s.stats, rs, frames)
+			}
+		}
+	}
+}
+
+// slow reads one byte at a time, pausing every frame
+type slow struct{ r io.Reader }
+
+func (s slow) Read(p []byte) (int, error) {
+	time.Sleep(100 * time.Microsecond)
+	return s.r.Read(p[:1])
+}
+
+// A reader that falls behind holds the sender to its credits
+func TestCredits(t *testing.T) {
+	data := make([]byte, 8*16)
+	r, done := start(t, bytes.NewReader(data), Hello{FrameSize: 16, Credits: 2})
+	if _, err := ioutil.ReadAll(slow{r}); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-done; s.err != nil || s.stats.Stalls == 0 {
+		t.Errorf("sent %+v, %v: want stalls for credits", s.stats, s.err)
+	}
+}
+
+// A frame's credit returns once the frame is read, not once it is decoded
+func TestCreditOnConsume(t *testing.T) {
+	sconn, rconn := conns(t)
+	data := []byte("0123456789abcdef")
+	go func() {
+		if _, err := ReadHello(sconn); err != nil {
+			return
+		}
+		sum := md5.Sum(data)
+		writeFrame(bufio.NewWriter(sconn), 0, len(data), sum[:], data)
+	}()
+	r, err := NewReader(rconn, Hello{FrameSize: 16, Credits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credit := make([]byte, 4)
+	p := make([]byte, 1)
+	if _, err := r.Read(p); err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := io.ReadFull(sconn, credit); err == nil {
+		t.Fatal("credit returned with the frame half read")
+	}
+	if _, err := io.ReadFull(r, make([]byte, len(data)-1)); err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sconn, credit); err != nil {
+		t.Errorf("no credit for the read frame: %v", err)
+	}
+}
+
+// A compressed frame claiming more than its raw length is refused before
+// it is decoded
+func TestSnappyTooLong(t *testing.T) {
+	sconn, rconn := conns(t)
+	go func() {
+		if _, err := ReadHello(sconn); err != nil {
+			return
+		}
+		wire, _ := snappy.Encode(nil, []byte("eight by"))
+		writeFrame(bufio.NewWriter(sconn), flagSnappy, 4, make([]byte, 16), wire)
+	}()
+	r, err := NewReader(rconn, Hello{FrameSize: 64, Credits: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
+		t.Errorf("read an overlong frame: %v, want %v", err, ErrCorrupt)
+	}
+}
+
+type failing struct{ n int }
+
+func (f *failing) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("disk on fire")
+	}
+	n := len(p)
+	if n > f.n {
+		n = f.n
+	}
+	f.n -= n
+	return n, nil
+}
+
+// A sender's read error reaches the reader after the bytes before it
+func TestSenderError(t *testing.T) {
+	r, done := start(t, &failing{100}, Hello{FrameSize: 64, Credits: 4})
+	got, err := ioutil.ReadAll(r)
+	if err == nil || !strings.Contains(err.Error(), "disk on fire") || len(got) != 64 {
+		t.Errorf("read %d bytes, %v: want 64 and the sender's error", len(got), err)
+	}
+	if s := <-done; s.err == nil {
+		t.Error("Send returned no error")
+	}
+}
+
+// A frame whose bytes do not match its hash fails the read
+func TestCorrupt(t *testing.T) {
+	sconn, rconn := conns(t)
+	go func() {
+		if _, err := ReadHello(sconn); err != nil {
+			return
+		}
+		w := bufio.NewWriter(sconn)
+		writeFrame(w, 0, 4, make([]byte, 16), []byte("data"))
+	}()
+	r, err := NewReader(rconn, Hello{FrameSize: 64, Credits: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
+		t.Errorf("read a corrupt frame: %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestBadHello(t *testing.T) {
+	_, rconn := conns(t)
+	for _, h := range []Hello{{FrameSize: 0, Credits: 1}, {FrameSize: MaxFrameSize + 1, Credits: 1}, {FrameSize: 64}} {
+		if _, err := NewReader(rconn, h); err == nil {
+			t.Errorf("NewReader accepted %+v", h)
+		}
+		if _, err := Send(rconn, bytes.NewReader(nil), h); err == nil {
+			t.Errorf("Send accepted %+v", h)
+		}
+	}
+}
@@ -15,8 +15,49 @@ import (
     "time"
     "net/http"
     "strconv"
+    "flag"
+    "strings"
+    "gorpc-tests/codec"
+    "gorpc-tests/measure"
+    "gorpc-tests/rpcpool"
+    "gorpc-tests/resilient"
+    "gorpc-tests/rpcctx"
+    "gorpc-tests/profiling"
+    "gorpc-tests/connstat"
+    "gorpc-tests/results"
+    "gorpc-tests/payload"
+    "gorpc-tests/sizedist"
 )
 
+//balancing policy for pooled clients ("" keeps one static connection per client)
+var balance string
+var connsPerServer int
+
+//redial and retry Echo this many times on a broken connection (0 exits on any error)
+var retries int
+
+//bounds every call when -timeout is set
+var tracker *rpcctx.Tracker
+
+//read/write syscalls on every client and every server connection
+var clientConns, serverConns connstat.Counters
+
+//where each run's numbers are stored
+var store *results.Flags
+
+//codec used on both ends of every connection
+var codecName string
+var codecOpts = codec.DefaultOptions()
+
+//dials a counted connection speaking the -codec codec
+func dialCounted(network string, addr string) (*rpc.Client, error) {
+    conn, err := connstat.DialConn(network, addr, &clientConns)
+    if err != nil {
+        return nil, err
+    }
+    return codec.Client(codecName, conn, codecOpts)
+}
+
 type DynArg struct {
     A []byte
 }
@@ -24,22 +65,44 @@ type DynArg struct {
 type Message int
 
 
+//simulated server work per Echo
+var work time.Duration
+
 func (t *Message) Echo(args *DynArg, reply *DynArg) error {
     reply.A = args.A 
+    if work > 0 {
+        time.Sleep(work)
+    }
     return nil
 }
 
-func basicCall(c *rpc.Client, numBytes int) {
-    args := DynArg{A: make([]byte, numBytes) };
+//content of every message, from -payload
+var payloadKind string
+
+//draws message sizes when -dist is set, instead of the fixed msgSize
+var sizeSpec string
+
+//returns false if the call timed out
+func basicCall(c rpcpool.Caller, data []byte) bool {
+    args := DynArg{A: data};
     var reply DynArg
-    err := c.Call("Message.Echo", args, &reply)
+    var err error
+    if tracker != nil {
+        err = tracker.Call(c, "Message.Echo", args, &reply)
+        if rpcctx.IsTimeout(err) {
+            return false
+        }
+    } else {
+        err = c.Call("Message.Echo", args, &reply)
+    }
     checkError(err)
+    return true
 }
 
 func checkError(err error) {
     if err != nil {
         fmt.Println("Fatal error ", err.Error())
-        os.Exit(1)
+        profiling.Exit(1)
     }
 }
 
@@ -55,7 +118,7 @@ func startTCPServer(port string) (*rpc.Server) {
     message := new(Message)
     newServer.Register(message)
 
-    go newServer.Accept(listener)
+    go codec.Accept(newServer, connstat.WrapListener(listener, &serverConns), codecName, codecOpts)
 
     return newServer
 }
@@ -76,7 +139,7 @@ func startHTTPServer(port string) (*rpc.Server) {
 }
 
 func startTCPClient(serverAddress string, port string) (*rpc.Client) {
-    client, err := rpc.Dial("tcp", serverAddress + ":" + port)
+    client, err := dialCounted("tcp", serverAddress + ":" + port)
     checkError(err)
     
     return client
@@ -88,10 +151,11 @@ func startHTTPClient(serverAddress string, port string) (*rpc.Client) {
     return client
 }
 
-func throughputTest(serverAddr string, numClients int, numServers int, numWindows int, messageSize int) {
+func throughputTest(serverAddr string, numClients int, numServers int, numWindows int, messageSize int,
+    warmup measure.Warmup, duration time.Duration) {
     
     //arrays of clients and servers
-    var clients []*rpc.Client = make([]*rpc.Client, numClients)
+    var clients []rpcpool.Caller = make([]rpcpool.Caller, numClients)
     var servers []*rpc.Server = make([]*rpc.Server, numServers)
 
     //starting port
@@ -103,50 +167,210 @@ func throughputTest(serverAddr string, numClients int, numServers int, numWindow
     }
 
 
-    startTime := time.Now()
-
     //connect clients to servers
+    var pools []*rpcpool.Pool
     for i := 0; i < numClients; i++ {
+        if balance != "" {
+            //every client is a pool spanning all servers
+            clients[i] = startPooledClient(serverAddr, startPort, numServers)
+            pools = append(pools, clients[i].(*rpcpool.Pool))
+            continue
+        }
         //distribute clients evenly to servers
+        if retries > 0 {
+            clients[i] = startResilientClient(serverAddr, strconv.Itoa(startPort + (i % numServers)))
+            continue
+        }
         clients[i] = startTCPClient(serverAddr, strconv.Itoa(startPort + (i % numServers)))
 
     }
 
+    sizes, err := sizedist.Parse(strconv.Itoa(messageSize), 0)
+    if sizeSpec != "" {
+        sizes, err = sizedist.Parse(sizeSpec, 0)
+    }
+    checkError(err)
 
-    //send messages
-    for i := 0; i < numWindows; i++ {
-        for j := 0; j < numClients; j++ {
-            basicCall(clients[j], messageSize)            
+    //every call sends a prefix of the same generated message; it is only read
+    data, err := payload.Generate(payloadKind, sizes.Max())
+    checkError(err)
+
+    //only the steady state is timed; dialing and generating the payload
+    //happen before Begin
+    win := measure.NewWindow(warmup, duration, numWindows*numClients)
+    win.Begin()
+
+    //the runtime and connection counts cover the steady state too, from the
+    //first call made once the warm-up is over
+    var before profiling.RuntimeStats
+    var clientBefore, serverBefore connstat.Counters
+    steady := false
+
+    //send messages one call at a time, round robin over the clients
+    var latency measure.Histogram
+    var bySize measure.BySize
+    for j := 0; ; j = (j + 1) % numClients {
+        if !steady && win.Measuring() {
+            steady = true
+            before = profiling.Snapshot()
+            clientBefore, serverBefore = clientConns.Snapshot(), serverConns.Snapshot()
+        }
+        more := false
+        n := sizes.Next()
+        began := time.Now()
+        if basicCall(clients[j], data[:n]) {
+            if win.Measuring() {
+                took := time.Since(began)
+                latency.Record(took)
+                bySize.Record(n, took)
+            }
+            more = win.Record(n)
+        } else {
+            more = win.Skip()
         }
-    }       
+        if !more {
+            break
+        }
+    }
 
-    duration := time.Since(startTime)
+    res := win.Close()
+    runtimeDelta := profiling.Snapshot().Sub(before)
+    clientDelta := clientConns.Snapshot().Sub(clientBefore)
+    serverDelta := serverConns.Snapshot().Sub(serverBefore)
 
-    var throughputMb = float64(messageSize*8*numWindows*numClients)/duration.Seconds()/1000000
+    var throughputMb = float64(res.Bytes*8)/res.Elapsed.Seconds()/1000000
 
-    fmt.Printf("Total time: %v s\n", duration.Seconds())
+    fmt.Printf("Warm-up: %d calls in %v\n", res.WarmupCalls, res.WarmupTime)
+    fmt.Printf("Total time: %v s\n", res.Elapsed.Seconds())
     fmt.Printf("Throughput (Mbits/s): %v\n", throughputMb)
-
-}
-
-func main() {
-    if len(os.Args) != 5 {
-        fmt.Println("Usage: ", os.Args[0], "[numClients] [numServers] [numWindows] [msgSize(bytes)]")
-        os.Exit(1)
+    //the calls the counts cover
+    measuredCalls := res.Calls + res.Skipped
+    // the servers run in this process, so only syscalls split by end
+    runtimeDelta.ReportAs(os.Stdout, "process: clients and servers together", measuredCalls)
+    connstat.Report(os.Stdout, clientDelta, serverDelta, measuredCalls)
+
+    if pools != nil {
+        printPoolStats(pools)
+    }
+    if tracker != nil {
+        tracker.Report(os.Stdout)
+    }
+    if sizeSpec != "" {
+        bySize.Report(os.Stdout)
     }
+    run := results.New("throughput")
+    run.AddResult(res)
+    run.AddLatency(&latency)
+    if sizeSpec != "" {
+        run.AddLatencyBySize(&bySize)
+    }
+    run.AddRuntime(runtimeDelta, measuredCalls)
+    run.Param("allocs", "process: clients and servers together")
+    run.AddPayload(data)
+    store.Save(run)
+    if retries > 0 {
+        var stats resilient.Stats
+        for _, c := range clients {
+            if rc, ok := c.(*resilient.Client); ok {
+                stats.Add(rc.Stats())
+            }
+        }
+        fmt.Printf("Retries: %v\n", stats)
+    }
+}
 
-    numClients,err := strconv.Atoi(os.Args[1])
+func startResilientClient(serverAddress string, port string) (*resilient.Client) {
+    policy := resilient.DefaultPolicy("Message.Echo")
+    policy.MaxRetries = retries
+    policy.Dial = dialCounted
+    client, err := resilient.Dial("tcp", serverAddress + ":" + port, policy)
     checkError(err)
+    return client
+}
 
-    numServers,err := strconv.Atoi(os.Args[2])
+func startPooledClient(serverAddress string, startPort int, numServers int) (*rpcpool.Pool) {
+    policy, err := rpcpool.ParsePolicy(balance)
     checkError(err)
 
-    numWindows,err := strconv.Atoi(os.Args[3])
-    checkError(err)
-    
-    numBytes,err := strconv.Atoi(os.Args[4])
+    var addrs []string
+    for i := 0; i < numServers; i++ {
+        addrs = append(addrs, serverAddress + ":" + strconv.Itoa(startPort + i))
+    }
+    dial := func(addr string) (*rpc.Client, error) { return dialCounted("tcp", addr) }
+    pool, err := rpcpool.DialWith(dial, addrs, connsPerServer, policy)
     checkError(err)
+    return pool
+}
+
+//sums the calls every pool sent to each server
+func printPoolStats(pools []*rpcpool.Pool) {
+    calls := make(map[string]int64)
+    var addrs []string
+    for _, p := range pools {
+        for _, b := range p.Stats() {
+            if _, ok := calls[b.Addr]; !ok {
+                addrs = append(addrs, b.Addr)
+            }
+            calls[b.Addr] += b.Calls
+        }
+    }
+    fmt.Printf("Calls per server (%s, %d conns/server/client):\n", balance, connsPerServer)
+    for _, addr := range addrs {
+        fmt.Printf("  %s: %d\n", addr, calls[addr])
+    }
+}
+
+func main() {
+    var warmup measure.Warmup
+    flag.Var(&warmup, "warmup", "warm-up before measuring (call count or duration, e.g. 1000 or 2s)")
+    duration := flag.Duration("duration", 0, "measure for this long instead of numWindows windows")
+    flag.StringVar(&balance, "balance", "", "pool connections across all servers: rr, least or p2c")
+    flag.IntVar(&connsPerServer, "conns", 1, "connections per server for each pooled client")
+    flag.IntVar(&retries, "retries", 0, "redial and retry Echo this many times on a broken connection")
+    timeout := flag.Duration("timeout", 0, "give up on a call after this long (0 waits forever)")
+    flag.DurationVar(&work, "work", 0, "server work (sleep) per Echo")
+    numClients := flag.Int("clients", 1, "number of clients (or the 1st argument)")
+    numServers := flag.Int("servers", 1, "number of servers (or the 2nd argument)")
+    numWindows := flag.Int("windows", 1000, "calls each client makes (or the 3rd argument)")
+    numBytes := flag.Int("size", 1024, "message size in bytes (or the 4th argument)")
+    flag.StringVar(&payloadKind, "payload", "zeros", payload.Usage)
+    flag.StringVar(&sizeSpec, "dist", "", "draw message sizes from a distribution instead of -size, e.g. uniform:100-10K, lognormal:1K,1.5, bimodal:100,1M,0.05 or trace:FILE")
+    flag.StringVar(&codecName, "codec", "gob", fmt.Sprintf("codec on both ends, one of %v", codec.Names))
+    flag.DurationVar(&codecOpts.Batch.Delay, "batchDelay", codec.DefaultBatching.Delay, "batch codec: longest a message waits to be written")
+    flag.IntVar(&codecOpts.Batch.MaxBytes, "batchBytes", codec.DefaultBatching.MaxBytes, "batch codec: write as soon as this many bytes wait")
+    compressions := flag.String("compress", strings.Join(codec.Compressions, ","), "compress codec: algorithms offered, most preferred first")
+    flag.IntVar(&codecOpts.Compress.MinSize, "compressMin", codec.DefaultCompression.MinSize, "compress codec: messages shorter than this are sent as they are")
+    prof := profiling.AddFlags()
+    store = results.AddFlags()
+    flag.Parse()
+    if balance != "" && retries > 0 {
+        fmt.Println("-retries redials a client's one connection, so it does not combine with -balance")
+        os.Exit(1)
+    }
+    checkError(payload.Check(payloadKind))
+    checkError(codec.Check(codecName))
+    codecOpts.Compress.Algorithms = strings.Split(*compressions, ",")
+    sess := prof.Start()
+    defer sess.Stop()
+
+    if *timeout > 0 {
+        tracker = rpcctx.NewTracker(*timeout)
+    }
+
+    //the four positional arguments still override the named flags
+    args := flag.Args()
+    if len(args) != 0 && len(args) != 4 {
+        fmt.Println("Usage: ", os.Args[0], "[-clients n] [-servers n] [-windows n] [-size bytes] [-dist spec] [-payload kind] [-warmup w] [-duration d] [-balance rr|least|p2c] [-conns n] [-retries n] [-timeout t] [-work d] [-codec name] [-batchDelay d] [-batchBytes n] [-compress algs] [-compressMin n] [-cpuprofile f] [-memprofile f] [-blockprofile f] [-mutexprofile f] [-trace f] [-pprof addr] [-results dir] [numClients numServers numWindows msgSize(bytes)]")
+        os.Exit(1)
+    }
+    if len(args) == 4 {
+        var err error
+        for i, n := range []*int{numClients, numServers, numWindows, numBytes} {
+            *n, err = strconv.Atoi(args[i])
+            checkError(err)
+        }
+    }
 
     //args - localAddr, numClients, numServers, numWindows, msgSize in bytes
-    throughputTest("127.0.0.1", numClients, numServers, numWindows, numBytes)
+    throughputTest("127.0.0.1", *numClients, *numServers, *numWindows, *numBytes, warmup, *duration)
 }
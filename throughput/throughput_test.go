@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"gorpc-tests/codec"
+	"gorpc-tests/connstat"
+	"gorpc-tests/payload"
+)
+
+// payload sizes the benchmarks sweep
+var sizes = []int{64, 4096, 65536, 1 << 20}
+
+// serveMessage starts a Message server on a loopback port speaking the named
+// codec and returns its address.
+func serveMessage(t testing.TB, codecName string) string {
+	server := rpc.NewServer()
+	server.Register(new(Message))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go codec.Accept(server, l, codecName, codec.DefaultOptions())
+	return l.Addr().String()
+}
+
+func dialMessage(t testing.TB, codecName string) *rpc.Client {
+	client, err := codec.Dial("tcp", serveMessage(t, codecName), codecName, codec.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Message.Echo as basicCall makes it: a fresh payload per call.
+func BenchmarkMessageEcho(b *testing.B) {
+	for _, size := range sizes {
+		for _, codecName := range codec.Names {
+			b.Run(fmt.Sprintf("size=%d/codec=%s", size, codecName), func(b *testing.B) {
+				client := dialMessage(b, codecName)
+				b.SetBytes(int64(2 * size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					args := DynArg{A: make([]byte, size)}
+					var reply DynArg
+					if err := client.Call("Message.Echo", args, &reply); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMessageEcho(t *testing.T) {
+	for _, codecName := range codec.Names {
+		client := dialMessage(t, codecName)
+		args := DynArg{A: []byte("hello, echo")}
+		var reply DynArg
+		if err := client.Call("Message.Echo", args, &reply); err != nil {
+			t.Fatalf("%s: %v", codecName, err)
+		}
+		if string(reply.A) != string(args.A) {
+			t.Errorf("%s: echoed %q, want %q", codecName, reply.A, args.A)
+		}
+	}
+}
+
+// echoCompressed echoes 256KB of text over the compress codec, the client
+// offering offer and the server accepting accept, and returns the bytes
+// that crossed the wire.
+func echoCompressed(t *testing.T, offer, accept []string) int64 {
+	server := rpc.NewServer()
+	server.Register(new(Message))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var counters connstat.Counters
+	opts := codec.DefaultOptions()
+	opts.Compress.Algorithms = accept
+	go codec.Accept(server, connstat.WrapListener(l, &counters), "compress", opts)
+
+	opts.Compress.Algorithms = offer
+	client, err := codec.Dial("tcp", l.Addr().String(), "compress", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	text, err := payload.Generate("text", 256<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := DynArg{A: text}
+	var reply DynArg
+	if err := client.Call("Message.Echo", args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply.A, text) {
+		t.Fatalf("offering %v to %v: echo came back changed", offer, accept)
+	}
+	return counters.Snapshot().BytesWritten
+}
+
+// The compress codec shrinks what Message.Echo sends once an algorithm is
+// agreed on, and sends it as it is when none is
+func TestCompressedEcho(t *testing.T) {
+	raw := int64(256 << 10)
+	if wire := echoCompressed(t, []string{"snappy", "deflate"}, []string{"deflate"}); wire > raw/2 {
+		t.Errorf("deflate: server wrote %d bytes for a %d byte echo of text", wire, raw)
+	}
+	if wire := echoCompressed(t, []string{"zstd", "snappy"}, []string{"deflate", "zstd"}); wire > raw/2 {
+		t.Errorf("zstd: server wrote %d bytes for a %d byte echo of text", wire, raw)
+	}
+	if wire := echoCompressed(t, []string{"snappy"}, []string{"deflate"}); wire < raw {
+		t.Errorf("nothing agreed on: server wrote %d bytes for a %d byte echo", wire, raw)
+	}
+}
+
+// A compress client gets an error from a plain gob server, not a hang
+func TestCompressAgainstGob(t *testing.T) {
+	client, err := codec.Dial("tcp", serveMessage(t, "gob"), "compress", codec.DefaultOptions())
+	if err == nil {
+		client.Close()
+		t.Fatal("compress client connected to a gob server")
+	}
+}
@@ -10,11 +10,26 @@
  					[-ml message length]
  					[-nm number of messages one client should send]
  					[-ws window size]
+ 					[-warmup calls or duration before measuring]
+ 					[-duration measure for a fixed time instead of -nm messages]
+ 					[-balance pool each client across all servers: rr, least or p2c]
+ 					[-conns connections per server for a pooled client]
+ 					[-timeout give up on a message after this long]
+ 					[-work server work (sleep) per message, 1s by default]
+ 					[-cpuprofile, -memprofile, -blockprofile, -mutexprofile, -trace file]
+ 					[-pprof serve net/http/pprof on this address]
+ 					[-dist message length distribution instead of -ml, see sizedist]
+ 					[-payload random, zeros, pattern, text, gob, json or file:F]
+ 					[-codec gob or batch (coalesce writes)] [-batchDelay] [-batchBytes]
+ 					[-results directory results are stored in, see results]
+ * go test -bench . gorpc-tests/windowedThroughput # Arith per size and codec,
+ *                                                 # without -work
  */
 
 package main
 
 import (	
+    "context"
     "fmt"
     "net"
     "net/rpc"
@@ -23,7 +38,18 @@ import (
     "io/ioutil"
     "time"
     "os"
+    "strings"
 	"sync"
+	"gorpc-tests/measure"
+	"gorpc-tests/rpcpool"
+	"gorpc-tests/rpcctx"
+	"gorpc-tests/profiling"
+	"gorpc-tests/connstat"
+	"gorpc-tests/codec"
+	"gorpc-tests/results"
+	"gorpc-tests/payload"
+	"gorpc-tests/sizedist"
+	"gorpc-tests/workpool"
 )
 
 const (
@@ -37,6 +63,23 @@ var numClients int
 var numServers int
 var messageLength int
 var windowSize int
+var win *measure.Window
+var balance string
+var connsPerServer int
+var payloadKind string
+
+//draws each message's length when -dist is set, instead of -ml
+var sizeSpec string
+
+//bounds every call when -timeout is set
+var tracker *rpcctx.Tracker
+
+//read/write syscalls on every client and every server connection
+var clientConns, serverConns connstat.Counters
+
+//codec used on both ends of every connection
+var codecName string
+var codecOpts = codec.DefaultOptions()
 
 //argument that allows for variable length message
 type ByteArgs struct {
@@ -48,7 +91,13 @@ type LenArgs struct {
 	A int
 }
 
-type Arith int
+//Echo sleeps work per call to simulate the server doing something
+type Arith struct {
+	work time.Duration
+}
+
+//server work per Echo, from -work
+var work = time.Second
 
 //copies input byte-slice to reply 
 func (t *Arith) Echo(args *ByteArgs, reply *ByteArgs) error {
@@ -56,8 +105,7 @@ func (t *Arith) Echo(args *ByteArgs, reply *ByteArgs) error {
 	numWritten := copy(replyData, args.A)
 	reply.A = replyData
 	log.Printf("Echo copied %d elems over", numWritten)
-	second := time.Second
-	time.Sleep(second)
+	time.Sleep(t.work)
 	return nil
 }
 
@@ -75,41 +123,149 @@ func (t *Arith) FindLen(args *ByteArgs, reply *LenArgs) error {
 	return nil
 }
 
+//latency of every measured message, merged from the clients as they finish
+var latencyMu sync.Mutex
+var latency measure.Histogram
+var latencyBySize measure.BySize
+
+//the message lengths client id sends; every client draws its own
+func messageSizes(id int) (sizedist.Dist, error) {
+	if sizeSpec == "" {
+		return sizedist.Parse(fmt.Sprint(messageLength), 0)
+	}
+	return sizedist.Parse(sizeSpec, int64(id))
+}
+
+// settling passes calls on to c and tells settled when each has finished on
+// the connection, which for a call that timed out is after its timeout
+type settling struct {
+	c       rpcpool.Caller
+	settled chan struct{}
+}
+
+func (s settling) Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	inner := s.c.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	go func() {
+		<-inner.Done
+		call.Error = inner.Error
+		s.settled <- struct{}{}
+		done <- call
+	}()
+	return call
+}
+
+//starts an asynchronous call, giving up after -timeout if one is set; with
+//a timeout, settled hears when the call has left the connection
+func goCall(c rpcpool.Caller, args *ByteArgs, reply *ByteArgs, done chan *rpc.Call, settled chan struct{}) *rpc.Call {
+	if tracker != nil {
+		return tracker.Go(settling{c, settled}, "Arith.Echo", args, reply, done)
+	}
+	return c.Go("Arith.Echo", args, reply, done)
+}
+
 //sends specified number of messages to server, with a designated window size
-func clientWindowedCall(c *rpc.Client, w *sync.WaitGroup) {
-	
-	// Signal this client is complete when we leave the function
-	defer w.Done()
-
-	//create byte array that will serve as argument, and initialize with values
-	var args ByteArgs
-	slice := make([]byte, messageLength)
-	for i := range slice {
-        slice[i] = byte(i)
-    }
-	args.A = slice
+func clientWindowedCall(id int, c rpcpool.Caller) {
 
-	var reply ByteArgs
+	//create byte array that messages are cut from, filled as -payload says
+	sizes, err := messageSizes(id)
+	checkError(err)
+	slice, err := payload.Generate(payloadKind, sizes.Max())
+	checkError(err)
 
 	// The channel keeps track of the asynchronous calls
 	lCh := make(chan *rpc.Call, windowSize)
-	
+	// A call that timed out still holds its place on the connection until
+	// the server answers it, so it holds its place in the window too: its
+	// replacement is sent once it has settled. At most windowSize calls are
+	// ever in flight, so at most that many settle
+	settled := make(chan struct{}, windowSize)
+
+	// when each outstanding call was sent and how long it is, and how long
+	// the measured ones took
+	type message struct {
+		began time.Time
+		size  int
+	}
+	sent := make(map[*rpc.Call]message, windowSize)
+	var took measure.Histogram
+	var tookBySize measure.BySize
+	// calls on the connection, and calls whose result is still to come
+	inFlight, outstanding := 0, 0
+	send := func() {
+		n := sizes.Next()
+		args := &ByteArgs{A: slice[:n]}
+		// every call decodes into its own reply: with -balance the calls in
+		// flight are spread over several connections, read concurrently
+		reply := new(ByteArgs)
+		began := time.Now()
+		sent[goCall(c, args, reply, lCh, settled)] = message{began, n}
+		inFlight++
+		outstanding++
+	}
+
 	// make initial windowSize calls
 	for i := 0 ; i < windowSize ; i++ {
-		c.Go("Arith.Echo", &args, &reply, lCh)
+		send()
 	}
 
 	//every time there's a response on the channel, take it off and make a new async call
-	receivedMessages := 0
-	for receivedMessages < numMessages {
+	//once its place in the window is free, until the measurement window has closed
+	more, waiting := true, 0
+	for more {
+		if waiting > 0 && inFlight < windowSize {
+			send()
+			waiting--
+			continue
+		}
+		// against a hung server no timed-out call ever settles; a call that
+		// cannot be sent within the timeout counts as timed out itself
+		var stalled <-chan time.Time
+		if waiting > 0 {
+			stalled = time.After(tracker.Timeout)
+		}
 		select {
-		case <-lCh:
-			receivedMessages+=1
-			log.Printf("Received response for message %d", receivedMessages)
-			c.Go("Arith.Echo", &args, &reply, lCh)
+		case call := <-lCh:
+			outstanding--
+			if tracker == nil {
+				inFlight--
+			}
+			m := sent[call]
+			delete(sent, call)
+			if rpcctx.IsTimeout(call.Error) {
+				log.Printf("Message timed out")
+				more = win.Skip()
+			} else {
+				checkError(call.Error)
+				log.Printf("Received response")
+				if win.Measuring() {
+					d := time.Since(m.began)
+					took.Record(d)
+					tookBySize.Record(m.size, d)
+				}
+				more = win.Record(m.size)
+			}
+			if more {
+				waiting++
+			}
+		case <-settled:
+			inFlight--
+		case <-stalled:
+			log.Printf("Window full of timed-out messages")
+			more = win.Skip()
 		}
 	}
 
+	latencyMu.Lock()
+	latency.Merge(&took)
+	latencyBySize.Merge(&tookBySize)
+	latencyMu.Unlock()
+
+	// drain the results still to come so nothing sends on a closed channel;
+	// settled is left open for calls the server has yet to answer
+	for ; outstanding > 0; outstanding-- {
+		<-lCh
+	}
 	close(lCh)
 }
 
@@ -124,16 +280,45 @@ func main() {
     mL := flag.Int("ml", 100, "message length")
     nM := flag.Int("nm", 10, "number of messages a client should send")
     wS := flag.Int("ws", 1, "window size (# of outstanding messages)")
+    var warmup measure.Warmup
+    flag.Var(&warmup, "warmup", "warm-up before measuring (call count or duration, e.g. 1000 or 2s)")
+    duration := flag.Duration("duration", 0, "measure for this long instead of -nm messages per client")
+    flag.StringVar(&balance, "balance", "", "pool each client across all servers: rr, least or p2c")
+    flag.IntVar(&connsPerServer, "conns", 1, "connections per server for a pooled client")
+    timeout := flag.Duration("timeout", 0, "give up on a message after this long (0 waits forever)")
+    flag.DurationVar(&work, "work", work, "server work (sleep) per Arith.Echo")
+    flag.StringVar(&payloadKind, "payload", "pattern", payload.Usage)
+    flag.StringVar(&sizeSpec, "dist", "", "draw message lengths from a distribution instead of -ml, e.g. uniform:100-10K, lognormal:1K,1.5, bimodal:100,1M,0.05 or trace:FILE")
+    flag.StringVar(&codecName, "codec", "gob", fmt.Sprintf("codec on both ends, one of %v", codec.Names))
+    flag.DurationVar(&codecOpts.Batch.Delay, "batchDelay", codec.DefaultBatching.Delay, "batch codec: longest a message waits to be written")
+    flag.IntVar(&codecOpts.Batch.MaxBytes, "batchBytes", codec.DefaultBatching.MaxBytes, "batch codec: write as soon as this many bytes wait")
+    compressions := flag.String("compress", strings.Join(codec.Compressions, ","), "compress codec: algorithms offered, most preferred first")
+    flag.IntVar(&codecOpts.Compress.MinSize, "compressMin", codec.DefaultCompression.MinSize, "compress codec: messages shorter than this are sent as they are")
+    prof := profiling.AddFlags()
+    store := results.AddFlags()
     flag.Parse()
+    checkError(codec.Check(codecName))
+    codecOpts.Compress.Algorithms = strings.Split(*compressions, ",")
+    checkError(payload.Check(payloadKind))
+    sess := prof.Start()
+    defer sess.Stop()
 
     numServers = *nS
     numClients = *nC
     numMessages = *nM
     messageLength = *mL
     windowSize = *wS
+    if *timeout > 0 {
+    	tracker = rpcctx.NewTracker(*timeout)
+    }
 
-    fmt.Printf("Num servers: %d, Num clients: %d, Num Messages Per Client: %d, Message Length: %d, Window Size: %d\n",
-    	numServers, numClients, numMessages, messageLength, windowSize)
+    fmt.Printf("Num servers: %d, Num clients: %d, Num Messages Per Client: %d, Message Length: %d, Window Size: %d, Codec: %s\n",
+    	numServers, numClients, numMessages, messageLength, windowSize, codecName)
+    if sizeSpec != "" {
+    	_, err := messageSizes(0)
+    	checkError(err)
+    	fmt.Printf("Message lengths: %s\n", sizeSpec)
+    }
 
     //start servers
 	for i := 0; i < numServers; i++ {
@@ -142,41 +327,105 @@ func main() {
 	fmt.Printf("Started %d server(s)\n", numServers)
 
 	//starts clients
-	var clients []*rpc.Client
+	var clients []rpcpool.Caller
 	for i := 0; i < numClients; i++ {
+		if balance != "" {
+			clients = append(clients, startPooledClient())
+			continue
+		}
 		client := startTCPClient(PORTBASE + (i % numServers))
 		clients = append(clients, client)
 	}
 	fmt.Printf("Started %d client(s)\n", numClients)
 
-	//creates new group to wait until all clients are finished
-	w := new(sync.WaitGroup)
-	startTime := time.Now()
+	//one worker per client, so every client runs at once
+	pool := workpool.New(context.Background(), workpool.Config{Workers: numClients})
+	win = measure.NewWindow(warmup, *duration, numMessages * numClients)
+	before := profiling.Snapshot()
+	clientBefore, serverBefore := clientConns.Snapshot(), serverConns.Snapshot()
+	win.Begin()
 	for i := 0; i < numClients; i++ {
-		w.Add(1)
-		//asynchronously calls individual client to start sending messages
-		go clientWindowedCall(clients[i], w)
+		i := i
+		//each client sends its messages on a worker of its own
+		pool.Submit(func(ctx context.Context) error {
+			clientWindowedCall(i, clients[i])
+			return nil
+		})
 	}
 
-	w.Wait()
+	checkError(pool.Close())
 
-	totalTime := time.Since(startTime)
-	totalMB := float64(messageLength * numMessages * numClients) / 1e6
+	res := win.Close()
+	runtimeDelta := profiling.Snapshot().Sub(before)
+	clientDelta := clientConns.Snapshot().Sub(clientBefore)
+	serverDelta := serverConns.Snapshot().Sub(serverBefore)
+	totalTime := res.Elapsed
+	totalMB := float64(res.Bytes) / 1e6
+	fmt.Printf("Warm-up: %d messages in %v\n", res.WarmupCalls, res.WarmupTime)
 	fmt.Printf("Total time: %v\n", totalTime)
 	fmt.Printf("Total megabytes sent: %v\n", totalMB)
 	var throughputMB = totalMB/totalTime.Seconds()
     fmt.Printf("Throughput (megabytes/s): %v\n", throughputMB)
+    totalMessages := res.WarmupCalls + res.Calls + res.Skipped
+    // the servers run in this process, so only syscalls split by end
+    runtimeDelta.ReportAs(os.Stdout, "process: clients and servers together", totalMessages)
+    connstat.Report(os.Stdout, clientDelta, serverDelta, totalMessages)
+    if tracker != nil {
+    	tracker.Report(os.Stdout)
+    }
+    if sizeSpec != "" {
+    	latencyBySize.Report(os.Stdout)
+    }
+    run := results.New("windowedThroughput")
+    run.AddResult(res)
+    run.AddLatency(&latency)
+    if sizeSpec != "" {
+    	run.AddLatencyBySize(&latencyBySize)
+    }
+    run.AddRuntime(runtimeDelta, totalMessages)
+    run.Param("allocs", "process: clients and servers together")
+    sizes, err := messageSizes(0)
+    checkError(err)
+    sample, err := payload.Generate(payloadKind, sizes.Max())
+    checkError(err)
+    run.AddPayload(sample)
+    store.Save(run)
 }
 
 //starts a TCP client connected to the designated port (with default server)
 func startTCPClient(port int) (*rpc.Client) {
 	log.Printf("Starting Client connecting to %v\n", DEFAULTSERVER + fmt.Sprintf(":%d", port))
-	client, err := rpc.Dial("tcp", DEFAULTSERVER + fmt.Sprintf(":%d", port))
+	client, err := dialCodec(DEFAULTSERVER + fmt.Sprintf(":%d", port))
 	checkError(err)
 
 	return client
 }
 
+//dials a counted connection speaking the -codec codec
+func dialCodec(addr string) (*rpc.Client, error) {
+	conn, err := connstat.DialConn("tcp", addr, &clientConns)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Client(codecName, conn, codecOpts)
+}
+
+//starts a client pooling connsPerServer connections to every server
+func startPooledClient() (*rpcpool.Pool) {
+	policy, err := rpcpool.ParsePolicy(balance)
+	checkError(err)
+
+	var addrs []string
+	for i := 0; i < numServers; i++ {
+		addrs = append(addrs, DEFAULTSERVER + fmt.Sprintf(":%d", PORTBASE + i))
+	}
+	log.Printf("Starting pooled client (%v) over %v\n", policy, addrs)
+	pool, err := rpcpool.DialWith(dialCodec, addrs, connsPerServer, policy)
+	checkError(err)
+
+	return pool
+}
+
 //starts a TCP server that accepts at the given port
 func startTCPServer(port int) (*rpc.Server) {
 	log.Printf("Starting server on port %d\n", port)
@@ -188,11 +437,11 @@ func startTCPServer(port int) (*rpc.Server) {
 
 	newServer := rpc.NewServer()
 
-	arith := new(Arith)
+	arith := &Arith{work: work}
 	newServer.Register(arith)
 
 	log.Printf("Server at port %d trying to accept new connections", port)	
-	go newServer.Accept(listener)
+	go codec.Accept(newServer, connstat.WrapListener(listener, &serverConns), codecName, codecOpts)
 	//fmt.Println("Accepted new connection?")	
 	return newServer
 }
@@ -200,6 +449,6 @@ func startTCPServer(port int) (*rpc.Server) {
 func checkError(err error) {
 	if err != nil {
 		fmt.Println("Fatal error ", err.Error())
-		os.Exit(1)
+		profiling.Exit(1)
 	}
 }
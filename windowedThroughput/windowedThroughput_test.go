@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"testing"
+
+	"gorpc-tests/codec"
+)
+
+// payload sizes the benchmarks sweep
+var sizes = []int{64, 4096, 65536, 1 << 20}
+
+// calls the benchmarks keep outstanding, like -ws
+const benchWindow = 10
+
+func TestMain(m *testing.M) {
+	if !DEBUG {
+		// as in main, Echo logs every call
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// dialArith connects to an Arith with no simulated work, served on a
+// loopback port with the named codec.
+func dialArith(t testing.TB, codecName string) *rpc.Client {
+	server := rpc.NewServer()
+	server.Register(new(Arith))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go codec.Accept(server, l, codecName, codec.DefaultOptions())
+	client, err := codec.Dial("tcp", l.Addr().String(), codecName, codec.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// method with benchWindow calls outstanding
+func benchmarkArith(b *testing.B, method string, newReply func() interface{}) {
+	for _, size := range sizes {
+		for _, codecName := range codec.Names {
+			b.Run(fmt.Sprintf("size=%d/codec=%s", size, codecName), func(b *testing.B) {
+				client := dialArith(b, codecName)
+				args := &ByteArgs{A: make([]byte, size)}
+				done := make(chan *rpc.Call, benchWindow)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				sent := 0
+				for ; sent < benchWindow && sent < b.N; sent++ {
+					client.Go(method, args, newReply(), done)
+				}
+				for received := 0; received < b.N; received++ {
+					call := <-done
+					if call.Error != nil {
+						b.Fatal(call.Error)
+					}
+					if sent < b.N {
+						client.Go(method, args, newReply(), done)
+						sent++
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkArithEcho(b *testing.B) {
+	benchmarkArith(b, "Arith.Echo", func() interface{} { return new(ByteArgs) })
+}
+
+func BenchmarkArithFindLen(b *testing.B) {
+	benchmarkArith(b, "Arith.FindLen", func() interface{} { return new(LenArgs) })
+}
+
+func TestArithEchoFindLen(t *testing.T) {
+	for _, codecName := range codec.Names {
+		client := dialArith(t, codecName)
+		args := &ByteArgs{A: []byte{1, 2, 3, 4, 5}}
+		var echo ByteArgs
+		if err := client.Call("Arith.Echo", args, &echo); err != nil {
+			t.Fatalf("%s: %v", codecName, err)
+		}
+		if !bytes.Equal(echo.A, args.A) {
+			t.Errorf("%s: Echo returned %v, want %v", codecName, echo.A, args.A)
+		}
+		var n LenArgs
+		if err := client.Call("Arith.FindLen", args, &n); err != nil {
+			t.Fatalf("%s: %v", codecName, err)
+		}
+		if n.A != len(args.A) {
+			t.Errorf("%s: FindLen returned %d, want %d", codecName, n.A, len(args.A))
+		}
+	}
+}
@@ -1,38 +1,29 @@
 package main
 
+import "context"
 import "fmt"
-import "sync"
 import "time"
+import "gorpc-tests/workpool"
 
-func worker(linkChan chan int, w *sync.WaitGroup) {
-	// Signal this is complete when we leave the function
-	defer w.Done()
-	//
-	for v := range linkChan {
+func work(v int) workpool.Task {
+	return func(ctx context.Context) error {
 		time.Sleep(1 * time.Second)
 		fmt.Println("Finished", v)
+		return nil
 	}
 }
 
 func main() {
-	// The channel distributes work to the workers
-	lCh := make(chan int)
-	// Wait group allows us to wait until everyone is done
-	w := new(sync.WaitGroup)
-
-	// Set up the worker pool
-	for i := 0; i < 10; i++ {
-		w.Add(1)
-		go worker(lCh, w)
-	}
+	// The pool distributes work to 10 workers; see workpool for the
+	// channel and WaitGroup it replaces
+	p := workpool.New(context.Background(), workpool.Config{Workers: 10})
 
 	// Send in the work requests to the workers
 	for i := 0; i < 100; i++ {
-		lCh <- i
+		p.Submit(work(i))
 	}
 
-	// Close the channel
-	close(lCh)
 	// Wait until all workers are complete
-	w.Wait()
+	p.Close()
+	fmt.Println(p.Stats())
 }
@@ -0,0 +1,381 @@
+/* Worker pools with bounded queues, cancellation and metrics
+ *
+ * The benchmarks used to hand work to goroutines with a hand-rolled pool: a
+ * channel, a loop of workers ranging over it and a WaitGroup to wait for
+ * them. Pool is that pattern once, with what every copy of it ends up
+ * growing:
+ *
+ *   - Submit blocks while the queue is full, so a producer cannot run
+ *     ahead of the workers by more than QueueSize tasks
+ *   - every task gets the pool's context; once it is cancelled, Submit
+ *     fails and queued tasks are dropped instead of run
+ *   - Close waits for the queued tasks and returns all their errors
+ *   - Stats has the time tasks waited in the queue and ran, and how many
+ *     each worker ran
+ *   - Resize adds or retires workers while tasks run
+ *
+ * Dispatch says how tasks reach the workers:
+ *
+ *   Unbuffered  one shared channel, each task handed to a free worker
+ *   Buffered    one shared channel of QueueSize
+ *   PerWorker   a channel of QueueSize per worker, filled round robin; no
+ *               shared channel to contend on, but a slow task holds up
+ *               those queued behind it
+ *   Stealing    PerWorker, and a worker whose queue is empty takes tasks
+ *               from the others
+ *
+ * Basic usage:
+ *   p := workpool.New(ctx, workpool.Config{Workers: 10, QueueSize: 100})
+ *   for _, b := range blocks {
+ *       b := b
+ *       p.Submit(func(ctx context.Context) error { return fetch(ctx, b) })
+ *   }
+ *   err := p.Close()
+ *   fmt.Println(p.Stats())
+ */
+
+package workpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorpc-tests/measure"
+)
+
+type Dispatch int
+
+const (
+	Unbuffered Dispatch = iota
+	Buffered
+	PerWorker
+	Stealing
+)
+
+// Dispatches in the order the package doc lists them
+var Dispatches = []Dispatch{Unbuffered, Buffered, PerWorker, Stealing}
+
+func ParseDispatch(s string) (Dispatch, error) {
+	for _, d := range Dispatches {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dispatch %q (want unbuffered, buffered, perworker or stealing)", s)
+}
+
+func (d Dispatch) String() string {
+	switch d {
+	case Buffered:
+		return "buffered"
+	case PerWorker:
+		return "perworker"
+	case Stealing:
+		return "stealing"
+	}
+	return "unbuffered"
+}
+
+// A Task runs on a worker; ctx is the pool's.
+type Task func(ctx context.Context) error
+
+type Config struct {
+	Workers   int // 0 means GOMAXPROCS
+	QueueSize int // tasks queued (per worker for PerWorker and Stealing); 0 means 1 when a queue is needed
+	Dispatch  Dispatch
+}
+
+var ErrClosed = errors.New("workpool: pool closed")
+
+// Stats counts a pool's tasks since it started.
+type Stats struct {
+	Workers   int
+	Submitted int64
+	Done      int64             // run, with or without an error
+	Failed    int64             // returned an error
+	Canceled  int64             // dropped from the queue when the context was cancelled
+	Stolen    int64             // run by another worker than the one they were queued for
+	Ran       []int64           // tasks run by each worker ever started
+	Wait      measure.Histogram // from Submit to start
+	Run       measure.Histogram // from start to return
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d workers, %d tasks (%d failed, %d canceled, %d stolen), wait p50 %v p99 %v, run p50 %v p99 %v",
+		s.Workers, s.Done, s.Failed, s.Canceled, s.Stolen,
+		s.Wait.Percentile(0.5), s.Wait.Percentile(0.99), s.Run.Percentile(0.5), s.Run.Percentile(0.99))
+}
+
+type item struct {
+	task   Task
+	queued time.Time
+}
+
+type worker struct {
+	id    int
+	queue chan *item    // PerWorker and Stealing
+	quit  chan struct{} // shared queue: closed to retire the worker
+}
+
+type Pool struct {
+	ctx   context.Context
+	cfg   Config
+	queue chan *item    // Unbuffered and Buffered
+	kick  chan struct{} // Stealing: wakes an idle worker to steal
+	next  uint64        // round robin over the per-worker queues
+
+	mu      sync.RWMutex
+	workers []*worker    // the active ones; retired workers finish on their own
+	victims atomic.Value // a copy of workers for steal, which cannot wait for mu
+	started int
+	closed  bool
+	running sync.WaitGroup
+
+	statMu sync.Mutex
+	stats  Stats
+	errs   []error
+}
+
+func New(ctx context.Context, cfg Config) *Pool {
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1
+	}
+	p := &Pool{ctx: ctx, cfg: cfg}
+	switch cfg.Dispatch {
+	case Unbuffered:
+		p.queue = make(chan *item)
+	case Buffered:
+		p.queue = make(chan *item, cfg.QueueSize)
+	case Stealing:
+		p.kick = make(chan struct{}, 1)
+	}
+	p.mu.Lock()
+	p.grow(cfg.Workers)
+	p.mu.Unlock()
+	return p
+}
+
+func (p *Pool) perWorker() bool {
+	return p.cfg.Dispatch == PerWorker || p.cfg.Dispatch == Stealing
+}
+
+// grow starts n workers; p.mu is held.
+func (p *Pool) grow(n int) {
+	for i := 0; i < n; i++ {
+		w := &worker{id: p.started, quit: make(chan struct{})}
+		if p.perWorker() {
+			w.queue = make(chan *item, p.cfg.QueueSize)
+		}
+		p.started++
+		p.workers = append(p.workers, w)
+		p.statMu.Lock()
+		p.stats.Ran = append(p.stats.Ran, 0)
+		p.statMu.Unlock()
+		p.running.Add(1)
+		go p.work(w)
+	}
+	p.victims.Store(append([]*worker(nil), p.workers...))
+}
+
+// Resize sets the number of workers. Retired workers finish the task they
+// are running, and with per-worker queues the tasks queued for them.
+func (p *Pool) Resize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("workpool: resize to %d workers, want at least one", n)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if n > len(p.workers) {
+		p.grow(n - len(p.workers))
+		return nil
+	}
+	for _, w := range p.workers[n:] {
+		// no Submit is sending while p.mu is held
+		if w.queue != nil {
+			close(w.queue)
+		} else {
+			close(w.quit)
+		}
+	}
+	p.workers = p.workers[:n]
+	p.victims.Store(append([]*worker(nil), p.workers...))
+	return nil
+}
+
+// Submit queues t, waiting while the queue is full. It fails once the
+// context is cancelled or the pool is closed.
+func (p *Pool) Submit(t Task) error {
+	it := &item{t, time.Now()}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	queue := p.queue
+	if p.perWorker() {
+		i := atomic.AddUint64(&p.next, 1) % uint64(len(p.workers))
+		queue = p.workers[i].queue
+	}
+	select {
+	case queue <- it:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+	p.statMu.Lock()
+	p.stats.Submitted++
+	p.statMu.Unlock()
+	if p.kick != nil {
+		select {
+		case p.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (p *Pool) work(w *worker) {
+	defer p.running.Done()
+	if !p.perWorker() {
+		for {
+			select {
+			case it, ok := <-p.queue:
+				if !ok {
+					return
+				}
+				p.run(w, it, false)
+			case <-w.quit:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case it, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			p.run(w, it, false)
+			continue
+		default:
+		}
+		if p.kick != nil {
+			if it := p.steal(w); it != nil {
+				p.run(w, it, true)
+				continue
+			}
+		}
+		select {
+		case it, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			p.run(w, it, false)
+		case <-p.kick:
+		}
+	}
+}
+
+// steal takes a task queued for another worker, if there is one, and
+// wakes another idle worker to look for more. It does not take mu: a
+// Submit holding it may be waiting for this worker's queue to drain.
+func (p *Pool) steal(w *worker) *item {
+	victims := p.victims.Load().([]*worker)
+	n := len(victims)
+	first := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		victim := victims[(first+i)%n]
+		if victim == w {
+			continue
+		}
+		select {
+		case it, ok := <-victim.queue:
+			if !ok {
+				continue
+			}
+			select {
+			case p.kick <- struct{}{}:
+			default:
+			}
+			return it
+		default:
+		}
+	}
+	return nil
+}
+
+func (p *Pool) run(w *worker, it *item, stolen bool) {
+	if p.ctx.Err() != nil {
+		p.statMu.Lock()
+		p.stats.Canceled++
+		p.statMu.Unlock()
+		return
+	}
+	began := time.Now()
+	err := it.task(p.ctx)
+	took := time.Since(began)
+	p.statMu.Lock()
+	defer p.statMu.Unlock()
+	p.stats.Done++
+	p.stats.Ran[w.id]++
+	if stolen {
+		p.stats.Stolen++
+	}
+	p.stats.Wait.Record(began.Sub(it.queued))
+	p.stats.Run.Record(took)
+	if err != nil {
+		p.stats.Failed++
+		p.errs = append(p.errs, err)
+	}
+}
+
+// Close stops Submit, waits for the queued tasks and returns their errors
+// joined, and the context's if it dropped any.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		if p.perWorker() {
+			for _, w := range p.workers {
+				close(w.queue)
+			}
+		} else {
+			close(p.queue)
+		}
+	}
+	p.mu.Unlock()
+	p.running.Wait()
+	p.statMu.Lock()
+	defer p.statMu.Unlock()
+	errs := p.errs
+	if p.stats.Canceled > 0 {
+		errs = append(errs[:len(errs):len(errs)], p.ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pool) Stats() Stats {
+	p.mu.RLock()
+	workers := len(p.workers)
+	p.mu.RUnlock()
+	p.statMu.Lock()
+	defer p.statMu.Unlock()
+	s := p.stats
+	s.Workers = workers
+	s.Ran = append([]int64(nil), s.Ran...)
+	return s
+}
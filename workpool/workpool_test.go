@@ -0,0 +1,220 @@
+package workpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runPool pushes tasks through a pool with dispatch and returns its stats.
+func runPool(d Dispatch, workers, queue, tasks int, task func(int) Task) (Stats, error) {
+	p := New(context.Background(), Config{Workers: workers, QueueSize: queue, Dispatch: d})
+	for i := 0; i < tasks; i++ {
+		if err := p.Submit(task(i)); err != nil {
+			return p.Stats(), err
+		}
+	}
+	err := p.Close()
+	return p.Stats(), err
+}
+
+func TestParseDispatch(t *testing.T) {
+	for _, d := range Dispatches {
+		got, err := ParseDispatch(d.String())
+		if err != nil || got != d {
+			t.Errorf("ParseDispatch(%q) = %v, %v", d.String(), got, err)
+		}
+	}
+	if _, err := ParseDispatch("fifo"); err == nil {
+		t.Error("ParseDispatch accepted fifo")
+	}
+}
+
+// every dispatch runs every task once and counts it
+func TestAllRun(t *testing.T) {
+	for _, d := range Dispatches {
+		var ran int64
+		stats, err := runPool(d, 4, 8, 1000, func(int) Task {
+			return func(ctx context.Context) error {
+				atomic.AddInt64(&ran, 1)
+				return nil
+			}
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", d, err)
+		}
+		if ran != 1000 || stats.Done != 1000 || stats.Submitted != 1000 {
+			t.Errorf("%v: ran %d, stats %v, want 1000", d, ran, stats)
+		}
+		var sum int64
+		for _, n := range stats.Ran {
+			sum += n
+		}
+		if sum != 1000 || stats.Wait.Count() != 1000 {
+			t.Errorf("%v: per-worker counts add up to %d, %d waits, want 1000", d, sum, stats.Wait.Count())
+		}
+	}
+}
+
+var errOdd = errors.New("odd task")
+
+// Close returns the error of every failed task
+func TestErrors(t *testing.T) {
+	for _, d := range Dispatches {
+		stats, err := runPool(d, 3, 4, 100, func(i int) Task {
+			return func(ctx context.Context) error {
+				if i%2 == 1 {
+					return fmt.Errorf("task %d: %w", i, errOdd)
+				}
+				return nil
+			}
+		})
+		if !errors.Is(err, errOdd) || strings.Count(err.Error(), "odd task") != 50 {
+			t.Errorf("%v: Close returned %v, want 50 odd tasks", d, err)
+		}
+		if stats.Failed != 50 || stats.Done != 100 {
+			t.Errorf("%v: %v, want 50 of 100 failed", d, stats)
+		}
+	}
+}
+
+// Cancelling the context fails Submit and drops the queued tasks
+func TestCancel(t *testing.T) {
+	for _, d := range Dispatches {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := New(ctx, Config{Workers: 2, QueueSize: 4, Dispatch: d})
+		release := make(chan struct{})
+		blocked := func(ctx context.Context) error {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil
+		}
+		// both workers busy, and every queue full behind them
+		n := map[Dispatch]int{Unbuffered: 2, Buffered: 2 + 4}[d]
+		if n == 0 {
+			n = 2 + 2*4
+		}
+		for i := 0; i < n; i++ {
+			if err := p.Submit(blocked); err != nil {
+				t.Fatalf("%v: %v", d, err)
+			}
+		}
+		cancel()
+		if err := p.Submit(blocked); err != context.Canceled {
+			t.Errorf("%v: Submit after cancel returned %v", d, err)
+		}
+		close(release)
+		err := p.Close()
+		stats := p.Stats()
+		if !errors.Is(err, context.Canceled) && stats.Canceled > 0 {
+			t.Errorf("%v: Close returned %v with %d tasks dropped", d, err, stats.Canceled)
+		}
+		if stats.Done+stats.Canceled != stats.Submitted {
+			t.Errorf("%v: %v: tasks lost", d, stats)
+		}
+		if d != Unbuffered && stats.Canceled == 0 {
+			t.Errorf("%v: nothing dropped from the queue", d)
+		}
+	}
+}
+
+// Submit after Close fails instead of queueing a task nobody runs
+func TestSubmitAfterClose(t *testing.T) {
+	p := New(context.Background(), Config{Workers: 1})
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Submit(func(context.Context) error { return nil }); err != ErrClosed {
+		t.Errorf("Submit after Close returned %v, want %v", err, ErrClosed)
+	}
+}
+
+// Resize adds workers that take queued tasks, and retires them without
+// losing any
+func TestResize(t *testing.T) {
+	for _, d := range Dispatches {
+		p := New(context.Background(), Config{Workers: 1, QueueSize: 16, Dispatch: d})
+		if err := p.Resize(4); err != nil {
+			t.Fatal(err)
+		}
+		// four tasks that only finish once all four run at once
+		var arrived int64
+		all := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			err := p.Submit(func(ctx context.Context) error {
+				if atomic.AddInt64(&arrived, 1) == 4 {
+					close(all)
+				}
+				select {
+				case <-all:
+					return nil
+				case <-time.After(5 * time.Second):
+					return errors.New("the resized pool never ran four tasks at once")
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: the resized pool never ran four tasks at once", d)
+		}
+		if err := p.Resize(1); err != nil {
+			t.Fatal(err)
+		}
+		var ran int64
+		for i := 0; i < 100; i++ {
+			p.Submit(func(ctx context.Context) error {
+				atomic.AddInt64(&ran, 1)
+				return nil
+			})
+		}
+		if err := p.Close(); err != nil {
+			t.Fatalf("%v: %v", d, err)
+		}
+		if stats := p.Stats(); ran != 100 || stats.Workers != 1 || len(stats.Ran) != 4 {
+			t.Errorf("%v: ran %d of 100, %v", d, ran, stats)
+		}
+	}
+}
+
+// Tasks queued behind a slow one are taken by idle workers with Stealing
+// and wait for it without
+func TestStealing(t *testing.T) {
+	for _, d := range []Dispatch{PerWorker, Stealing} {
+		p := New(context.Background(), Config{Workers: 2, QueueSize: 8, Dispatch: d})
+		release := make(chan struct{})
+		// round robin puts even tasks behind task 0, which blocks
+		for i := 0; i < 8; i++ {
+			i := i
+			p.Submit(func(ctx context.Context) error {
+				if i == 0 {
+					<-release
+				}
+				return nil
+			})
+		}
+		time.Sleep(50 * time.Millisecond)
+		done := p.Stats().Done
+		close(release)
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		stats := p.Stats()
+		switch {
+		case d == Stealing && (done != 7 || stats.Stolen == 0):
+			t.Errorf("stealing: %d of 7 tasks done while one blocked, %d stolen", done, stats.Stolen)
+		case d == PerWorker && done == 7:
+			t.Error("perworker: tasks queued behind a blocked one ran")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Dispatch strategies of workpool, side by side.
+ *
+ * Runs -tasks tasks through a pool of -workers with each dispatch and
+ * prints tasks per second, how long tasks waited in the queue and how
+ * evenly the workers shared them. Most tasks sleep -work, as a call
+ * waiting on a server does; one in -every sleeps -slow instead, which is
+ * what per-worker queues are worst at.
+ *
+ * workpoolbench  [-dispatches unbuffered,buffered,perworker,stealing]
+ *                [-workers 8] [-queue 16, per worker for perworker and stealing]
+ *                [-tasks 20000] [-work 50us] [-slow 5ms] [-every 100]
+ *                [-cpuprofile/-memprofile/... see profiling]
+ *                [-results directory results are stored in, see results]
+ *
+ * go test -bench . gorpc-tests/workpoolbench times dispatch itself (empty
+ * tasks) and the skewed sleeps above; the pool's checks are workpool's tests.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorpc-tests/profiling"
+	"gorpc-tests/results"
+	"gorpc-tests/workpool"
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Fatal error ", err.Error())
+		profiling.Exit(1)
+	}
+}
+
+var work, slow = 50 * time.Microsecond, 5 * time.Millisecond
+var every = 100
+
+// task i sleeps work, or slow for one in every
+func task(i int) workpool.Task {
+	d := work
+	if every > 0 && i%every == 0 {
+		d = slow
+	}
+	return func(ctx context.Context) error {
+		if d > 0 {
+			time.Sleep(d)
+		}
+		return nil
+	}
+}
+
+// runPool pushes tasks through a pool with dispatch and returns its stats
+// and how long it took.
+func runPool(d workpool.Dispatch, workers, queue, tasks int, task func(int) workpool.Task) (workpool.Stats, time.Duration, error) {
+	began := time.Now()
+	p := workpool.New(context.Background(), workpool.Config{Workers: workers, QueueSize: queue, Dispatch: d})
+	for i := 0; i < tasks; i++ {
+		if err := p.Submit(task(i)); err != nil {
+			return p.Stats(), 0, err
+		}
+	}
+	err := p.Close()
+	return p.Stats(), time.Since(began), err
+}
+
+// imbalance is the most tasks a worker ran over the mean
+func imbalance(ran []int64) float64 {
+	var max, sum int64
+	for _, n := range ran {
+		sum += n
+		if n > max {
+			max = n
+		}
+	}
+	return float64(max) * float64(len(ran)) / float64(sum)
+}
+
+func us(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func main() {
+	dispatchesFlag := flag.String("dispatches", "unbuffered,buffered,perworker,stealing", "workpool dispatches, comma separated")
+	workers := flag.Int("workers", 8, "workers per pool")
+	queue := flag.Int("queue", 16, "queued tasks (per worker for perworker and stealing)")
+	tasks := flag.Int("tasks", 20000, "tasks per dispatch")
+	flag.DurationVar(&work, "work", work, "sleep of a task")
+	flag.DurationVar(&slow, "slow", slow, "sleep of one task in -every")
+	flag.IntVar(&every, "every", every, "one task in this many is slow (0: none)")
+	prof := profiling.AddFlags()
+	store := results.AddFlags()
+	flag.Parse()
+	sess := prof.Start()
+	defer sess.Stop()
+
+	var dispatches []workpool.Dispatch
+	for _, s := range strings.Split(*dispatchesFlag, ",") {
+		d, err := workpool.ParseDispatch(s)
+		checkError(err)
+		dispatches = append(dispatches, d)
+	}
+	fmt.Printf("%d tasks of %v, one in %d of %v, on %d workers\n\n", *tasks, work, every, slow, *workers)
+	fmt.Printf("%-11s %10s %12s %12s %10s %8s\n", "dispatch", "tasks/s", "wait p50", "wait p99", "imbalance", "stolen")
+	run := results.New("workpoolbench")
+	run.Param("workers", *workers)
+	run.Param("queue", *queue)
+	for _, d := range dispatches {
+		stats, elapsed, err := runPool(d, *workers, *queue, *tasks, task)
+		checkError(err)
+		rate := float64(stats.Done) / elapsed.Seconds()
+		w50, w99 := stats.Wait.Percentile(0.5), stats.Wait.Percentile(0.99)
+		fmt.Printf("%-11v %10.0f %12v %12v %10.2f %8d\n", d, rate, w50, w99, imbalance(stats.Ran), stats.Stolen)
+		run.Add(d.String()+" throughput", "tasks/s", true, rate)
+		run.Add(d.String()+" wait-p50", "µs", false, us(w50))
+		run.Add(d.String()+" wait-p99", "µs", false, us(w99))
+	}
+	store.Save(run)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gorpc-tests/workpool"
+)
+
+// b.N tasks through 8 workers, for each dispatch: empty ones for the cost
+// of dispatch itself, and the skewed sleeps of the main run
+func BenchmarkDispatch(b *testing.B) {
+	kinds := []struct {
+		name string
+		task func(int) workpool.Task
+	}{
+		{"empty", func(int) workpool.Task { return func(context.Context) error { return nil } }},
+		{"skewed", task},
+	}
+	for _, k := range kinds {
+		for _, d := range workpool.Dispatches {
+			b.Run(fmt.Sprintf("tasks=%s/dispatch=%v", k.name, d), func(b *testing.B) {
+				b.ReportAllocs()
+				if _, _, err := runPool(d, 8, 16, b.N, k.task); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}